@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key object types of approval requests and of the pending request index
+const (
+	ApprovalIndex        = "Approval~ID"
+	PendingApprovalIndex = "Approval~Function~ID"
+)
+
+// Approval request statuses
+const (
+	ApprovalPending  = "pending"
+	ApprovalExecuted = "executed"
+	ApprovalExpired  = "expired"
+)
+
+// approvableFunctions are the Invoke functions Config.Approvals may hold back for approval
+var approvableFunctions = map[string]func(t *MyChaincode, stub shim.ChaincodeStubInterface, args []string) peer.Response{
+	"updateAsset": (*MyChaincode).updateAsset,
+	"deleteAsset": (*MyChaincode).deleteAsset,
+}
+
+// approvalBypasses are the Invoke functions that change assets like an approvable function,
+// they are rejected while Config.Approvals holds a policy for it
+var approvalBypasses = map[string]string{
+	"updateAssetsBatch": "updateAsset",
+	"deleteAssetsBatch": "deleteAsset",
+	"importState":       "updateAsset",
+	"purchaseAsset":     "updateAsset",
+}
+
+// ApprovalPolicy is the approval a function needs, approvers are members of ApproverMSPs
+// or identities satisfying the ApproverGuard expression, anyone if both are empty
+type ApprovalPolicy struct {
+	Required      int      `json:"required"`
+	ApproverMSPs  []string `json:"approverMSPs"`
+	ApproverGuard string   `json:"approverGuard,omitempty"`
+	// Timeout is the number of seconds a request can be approved
+	Timeout int64 `json:"timeout"`
+}
+
+// Approval is the approval of a request by one identity
+type Approval struct {
+	MSPID     string `json:"mspId"`
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// ApprovalRequest is a call held back until it is approved, it keeps the policy it was proposed under
+type ApprovalRequest struct {
+	ID          string   `json:"id"`
+	Function    string   `json:"function"`
+	Args        []string `json:"args"`
+	ProposerMSP string   `json:"proposerMspId"`
+	Proposer    string   `json:"proposer"`
+	// ProposerCreator is the serialized identity of the proposer, the approved call runs as it
+	ProposerCreator []byte         `json:"proposerCreator"`
+	Policy          ApprovalPolicy `json:"policy"`
+	Approvals       []Approval     `json:"approvals"`
+	Status          string         `json:"status"`
+	CreatedAt       int64          `json:"createdAt"`
+	ExpiresAt       int64          `json:"expiresAt"`
+}
+
+// proposerStub runs an approved call as the identity that proposed it rather than the last approver
+type proposerStub struct {
+	shim.ChaincodeStubInterface
+	creator []byte
+}
+
+// GetCreator - the serialized identity of the proposer
+func (s *proposerStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+// checkApprovalBypass - return an error if function changes assets the way a function that needs approval does
+func checkApprovalBypass(config *Config, function string) error {
+	approvable, ok := approvalBypasses[function]
+	if !ok {
+		return nil
+	}
+	if _, ok := config.Approvals[approvable]; ok {
+		return fmt.Errorf("%s is disabled while %s requires approval, call %s for each asset", function, approvable, approvable)
+	}
+	return nil
+}
+
+// proposeRequest - store a call of a function that needs approval, the transaction id is the request id
+func (t *MyChaincode) proposeRequest(stub shim.ChaincodeStubInterface, function string, args []string, policy ApprovalPolicy) peer.Response {
+	caller, err := newCaller(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("%s requires approval, the proposer must be identified: %s", function, err.Error()))
+	}
+	proposerMSP, proposer, err := caller.names()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request := &ApprovalRequest{
+		ID:              stub.GetTxID(),
+		Function:        function,
+		Args:            args,
+		ProposerMSP:     proposerMSP,
+		Proposer:        proposer,
+		ProposerCreator: creator,
+		Policy:          policy,
+		Approvals:       []Approval{},
+		Status:          ApprovalPending,
+		CreatedAt:       now,
+		ExpiresAt:       now + policy.Timeout,
+	}
+	existing, err := getApprovalRequest(stub, request.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error("Approval request already exists: " + request.ID)
+	}
+	err = putApprovalRequest(stub, request)
+	if err == nil {
+		err = createIndex(stub, PendingApprovalIndex, []string{function, request.ID})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	newTxLog(stub).Info("pending approval", "request", request.ID)
+	return approvalResponse(request)
+}
+
+// ===============================================
+// approveRequest - approve a pending request, the approval that reaches the required number runs the call
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"approveRequest","args":["<request id>"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) approveRequest(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: request id")
+	}
+	request, err := getApprovalRequest(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if request == nil {
+		return shim.Error("Approval request does not exist: " + args[0])
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if request.Status != ApprovalPending {
+		return shim.Error(fmt.Sprintf("Approval request %s is %s", request.ID, request.Status))
+	}
+	if now > request.ExpiresAt {
+		return shim.Error(fmt.Sprintf("Approval request %s expired at %s", request.ID, time.Unix(request.ExpiresAt, 0).UTC().Format(time.RFC3339)))
+	}
+
+	caller, err := newCaller(stub)
+	if err != nil {
+		return shim.Error("The approver must be identified: " + err.Error())
+	}
+	approverMSP, approver, err := caller.names()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if approverMSP == request.ProposerMSP && approver == request.Proposer {
+		return shim.Error("The proposer cannot approve their own request")
+	}
+	for _, approval := range request.Approvals {
+		if approval.MSPID == approverMSP && approval.ID == approver {
+			return shim.Error("The request is already approved by this identity")
+		}
+	}
+	err = request.Policy.checkApprover(caller, approverMSP)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	request.Approvals = append(request.Approvals, Approval{MSPID: approverMSP, ID: approver, Timestamp: now})
+
+	if len(request.Approvals) >= request.Policy.Required {
+		// the call runs as part of this transaction on behalf of the proposer, in tenancy mode in
+		// the proposer's tenant, if it fails the approval is not recorded either
+		newTxLog(stub).Info("approval runs", "request", request.ID, "call", request.Function, "proposer", request.ProposerMSP+"/"+request.Proposer)
+		config, err := getConfig(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		proposerScope, err := tenantScope(&proposerStub{baseStub(stub), request.ProposerCreator}, config)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		response := approvableFunctions[request.Function](t, proposerScope, request.Args)
+		if response.Status != shim.OK {
+			return shim.Error(fmt.Sprintf("Approved %s failed: %s", request.Function, response.Message))
+		}
+		request.Status = ApprovalExecuted
+		err = deleteIndex(stub, PendingApprovalIndex, []string{request.Function, request.ID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = putApprovalRequest(stub, request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return approvalResponse(request)
+}
+
+// ===============================================
+// getApprovalRequest - get an approval request by id
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getApprovalRequest","args":["<request id>"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getApprovalRequest(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: request id")
+	}
+	request, err := getApprovalRequest(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if request == nil {
+		return shim.Error("Approval request does not exist: " + args[0])
+	}
+	return approvalResponse(request)
+}
+
+// ===============================================
+// getPendingApprovals - list the pending requests, optionally of one function,
+// requests past their expiry are listed as expired until expireApprovals removes them
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getPendingApprovals","args":["deleteAsset"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getPendingApprovals(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: function")
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requests, err := getPendingApprovals(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, request := range requests {
+		if now > request.ExpiresAt {
+			request.Status = ApprovalExpired
+		}
+	}
+	requestsJSONasBytes, err := json.Marshal(requests)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(requestsJSONasBytes)
+}
+
+// ===============================================
+// expireApprovals - mark the pending requests past their expiry as expired
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"expireApprovals","args":[],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) expireApprovals(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requests, err := getPendingApprovals(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	expired := []string{}
+	for _, request := range requests {
+		if now <= request.ExpiresAt {
+			continue
+		}
+		request.Status = ApprovalExpired
+		err = putApprovalRequest(stub, request)
+		if err == nil {
+			err = deleteIndex(stub, PendingApprovalIndex, []string{request.Function, request.ID})
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		expired = append(expired, request.ID)
+	}
+	expiredJSONasBytes, err := json.Marshal(expired)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(expiredJSONasBytes)
+}
+
+// checkApprover - return an error unless the caller may approve under the policy
+func (p *ApprovalPolicy) checkApprover(caller *Caller, mspid string) error {
+	if len(p.ApproverMSPs) == 0 && p.ApproverGuard == "" {
+		return nil
+	}
+	if containsString(p.ApproverMSPs, mspid) {
+		return nil
+	}
+	reason := fmt.Sprintf("%s is not an approver MSP", mspid)
+	if p.ApproverGuard != "" {
+		guard, err := ParseGuard(p.ApproverGuard)
+		if err != nil {
+			return err
+		}
+		err = guard.Check(caller)
+		if err == nil {
+			return nil
+		}
+		reason += fmt.Sprintf(" and the identity does not satisfy %s: %s", p.ApproverGuard, err.Error())
+	}
+	return errors.New("Not an approver, " + reason)
+}
+
+func validateApprovalPolicy(function string, policy ApprovalPolicy) error {
+	if _, ok := approvableFunctions[function]; !ok {
+		functions := make([]string, 0, len(approvableFunctions))
+		for name := range approvableFunctions {
+			functions = append(functions, name)
+		}
+		sort.Strings(functions)
+		return fmt.Errorf("approvals cannot be required for %s, only for %v", function, functions)
+	}
+	if policy.Required <= 0 {
+		return fmt.Errorf("approvals.%s.required must be a positive integer", function)
+	}
+	if policy.Timeout <= 0 {
+		return fmt.Errorf("approvals.%s.timeout must be a positive number of seconds", function)
+	}
+	if policy.ApproverGuard != "" {
+		_, err := ParseGuard(policy.ApproverGuard)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// names - the MSP ID and the cid.GetID of the caller
+func (c *Caller) names() (string, string, error) {
+	mspid, err := c.id.GetMSPID()
+	if err != nil {
+		return "", "", err
+	}
+	id, err := c.id.GetID()
+	if err != nil {
+		return "", "", err
+	}
+	return mspid, id, nil
+}
+
+func txUnixTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txTimestamp.Seconds, nil
+}
+
+func getApprovalRequest(stub shim.ChaincodeStubInterface, id string) (*ApprovalRequest, error) {
+	key, err := stub.CreateCompositeKey(ApprovalIndex, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	requestBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get approval request %s: %s", id, err.Error())
+	} else if requestBytes == nil {
+		return nil, nil
+	}
+	request := &ApprovalRequest{}
+	err = json.Unmarshal(requestBytes, request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal approval request %s: %s", id, err.Error())
+	}
+	return request, nil
+}
+
+func putApprovalRequest(stub shim.ChaincodeStubInterface, request *ApprovalRequest) error {
+	key, err := stub.CreateCompositeKey(ApprovalIndex, []string{request.ID})
+	if err != nil {
+		return err
+	}
+	requestJSONasBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, requestJSONasBytes)
+}
+
+// getPendingApprovals - the requests in the pending index, attributes narrows it to a function
+func getPendingApprovals(stub shim.ChaincodeStubInterface, attributes []string) ([]*ApprovalRequest, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(PendingApprovalIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	requests := []*ApprovalRequest{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		//Components should be function, id
+		request, err := getApprovalRequest(stub, components[1])
+		if err != nil {
+			return nil, err
+		} else if request != nil {
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
+func approvalResponse(request *ApprovalRequest) peer.Response {
+	requestJSONasBytes, err := json.Marshal(request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(requestJSONasBytes)
+}
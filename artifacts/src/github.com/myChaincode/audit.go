@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key object types of the audit log
+const (
+	// AuditIndex keys an entry by the transaction id
+	AuditIndex = "Audit~TxID"
+	// AuditCreatorIndex finds the entries of a creator: creator, time, transaction id
+	AuditCreatorIndex = "Audit~Creator~Time~TxID"
+	// AuditDayIndex finds the entries of a UTC day: day, time, transaction id
+	AuditDayIndex = "Audit~Day~Time~TxID"
+)
+
+// auditTimeFormat has a fixed width, so index keys sort by time
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// MaxAuditDays bounds the days queryAuditLog scans when no identity is given
+const MaxAuditDays = 366
+
+// AuditEntry records a successful call that changed the state, failed calls are not recorded
+// as Fabric does not commit their writes. PayloadDigest, the sha256 of the response payload,
+// is the result of the call. The private data functions have no ArgsDigest, a digest of
+// collection contents on the channel ledger could be matched against guesses.
+type AuditEntry struct {
+	TxID          string `json:"txId"`
+	Function      string `json:"function"`
+	ArgsDigest    string `json:"argsDigest,omitempty"`
+	Creator       string `json:"creator"`
+	Timestamp     string `json:"timestamp"`
+	PayloadDigest string `json:"payloadDigest,omitempty"`
+}
+
+// auditStub notes whether the handler of a call writes the state
+type auditStub struct {
+	shim.ChaincodeStubInterface
+	writes bool
+}
+
+func (s *auditStub) PutState(key string, value []byte) error {
+	s.writes = true
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
+
+func (s *auditStub) DelState(key string) error {
+	s.writes = true
+	return s.ChaincodeStubInterface.DelState(key)
+}
+
+func (s *auditStub) PutPrivateData(collection string, key string, value []byte) error {
+	s.writes = true
+	return s.ChaincodeStubInterface.PutPrivateData(collection, key, value)
+}
+
+func (s *auditStub) DelPrivateData(collection string, key string) error {
+	s.writes = true
+	return s.ChaincodeStubInterface.DelPrivateData(collection, key)
+}
+
+// auditResponse - record the call if it changed the state, the response is returned unchanged
+func auditResponse(stub *auditStub, function string, args []string, response peer.Response) peer.Response {
+	if response.Status != shim.OK || !stub.writes {
+		return response
+	}
+	err := putAuditEntry(stub.ChaincodeStubInterface, function, args, response)
+	if err != nil {
+		return shim.Error("Failed to write the audit log: " + err.Error())
+	}
+	return response
+}
+
+func putAuditEntry(stub shim.ChaincodeStubInterface, function string, args []string, response peer.Response) error {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return err
+	}
+	userOrg, userName, err := getTxCreatorInfo(creator)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	txTime := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	entry := &AuditEntry{
+		TxID:          stub.GetTxID(),
+		Function:      function,
+		Creator:       userOrg + "." + userName,
+		Timestamp:     txTime.Format(auditTimeFormat),
+		PayloadDigest: digest(response.Payload),
+	}
+	if !privateDataFunctions[function] {
+		argsJSONasBytes, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		entry.ArgsDigest = digest(argsJSONasBytes)
+	}
+	key, err := stub.CreateCompositeKey(AuditIndex, []string{entry.TxID})
+	if err != nil {
+		return err
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, entryJSONasBytes)
+	if err != nil {
+		return err
+	}
+	err = createIndex(stub, AuditCreatorIndex, []string{entry.Creator, entry.Timestamp, entry.TxID})
+	if err != nil {
+		return err
+	}
+	return createIndex(stub, AuditDayIndex, []string{txTime.Format("2006-01-02"), entry.Timestamp, entry.TxID})
+}
+
+// ===============================================
+// queryAuditLog - list the recorded calls in time order, args: identity ("userOrg.userName"),
+// function, from and to (RFC 3339, to is exclusive), empty arguments do not filter.
+// Without an identity from is required and at most MaxAuditDays days are scanned
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"queryAuditLog","args":["", "updateAsset", "2018-04-01T00:00:00Z", "2018-07-01T00:00:00Z"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) queryAuditLog(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4: identity, function, from, to")
+	}
+	identity, function := args[0], args[1]
+	var from, to time.Time
+	var err error
+	if len(args[2]) > 0 {
+		from, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be an RFC 3339 timestamp")
+		}
+	}
+	if len(args[3]) > 0 {
+		to, err = time.Parse(time.RFC3339, args[3])
+		if err != nil {
+			return shim.Error("4th argument must be an RFC 3339 timestamp")
+		}
+	} else {
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		to = time.Unix(txTimestamp.Seconds+1, 0)
+	}
+	fromKey, toKey := from.UTC().Format(auditTimeFormat), to.UTC().Format(auditTimeFormat)
+
+	// both indexes order the entries by time after the identity or the day
+	var partialKeys [][]string
+	var indexName string
+	if len(identity) > 0 {
+		indexName, partialKeys = AuditCreatorIndex, [][]string{{identity}}
+	} else if len(args[2]) <= 0 {
+		return shim.Error("Querying the audit log without an identity requires a time range")
+	} else {
+		indexName = AuditDayIndex
+		for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+			if len(partialKeys) == MaxAuditDays {
+				return shim.Error(fmt.Sprintf("Querying the audit log without an identity is limited to %d days", MaxAuditDays))
+			}
+			partialKeys = append(partialKeys, []string{day.Format("2006-01-02")})
+		}
+	}
+
+	entries := []AuditEntry{}
+	for _, partialKey := range partialKeys {
+		txIDs, err := getAuditTxIDs(stub, indexName, partialKey, fromKey, toKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, txID := range txIDs {
+			entry, err := getAuditEntry(stub, txID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if len(function) <= 0 || entry.Function == function {
+				entries = append(entries, *entry)
+			}
+		}
+	}
+	entriesJSONasBytes, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(entriesJSONasBytes)
+}
+
+// getAuditTxIDs - the transaction ids of the index entries under partialKey with a time in [fromKey, toKey)
+func getAuditTxIDs(stub shim.ChaincodeStubInterface, indexName string, partialKey []string, fromKey string, toKey string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, partialKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	txIDs := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		//Components should be creator or day, time, txID
+		if len(components) < 3 {
+			return nil, errors.New("Audit index is malformed")
+		}
+		if components[1] >= fromKey && components[1] < toKey {
+			txIDs = append(txIDs, components[2])
+		}
+	}
+	return txIDs, nil
+}
+
+func getAuditEntry(stub shim.ChaincodeStubInterface, txID string) (*AuditEntry, error) {
+	key, err := stub.CreateCompositeKey(AuditIndex, []string{txID})
+	if err != nil {
+		return nil, err
+	}
+	entryBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	} else if entryBytes == nil {
+		return nil, errors.New("Audit entry does not exist: " + txID)
+	}
+	entry := &AuditEntry{}
+	err = json.Unmarshal(entryBytes, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
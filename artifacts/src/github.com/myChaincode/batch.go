@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Batch modes, an atomic batch writes nothing unless every item is valid
+const (
+	BatchModeAtomic     = "atomic"
+	BatchModeBestEffort = "bestEffort"
+)
+
+// MaxBatchSize is the largest number of items a batch function accepts
+const MaxBatchSize = 500
+
+// BatchItemResult is the outcome of one item of a batch
+type BatchItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResult is the response of a batch function, and the error message of a failed atomic batch
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Items     []BatchItemResult `json:"items"`
+}
+
+// BatchDeleteItem is an item of deleteAssetsBatch, a bare id or {"id": ..., "version": ...}
+// where a version is the expected version, as the 3rd argument of deleteAsset
+type BatchDeleteItem struct {
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+// UnmarshalJSON - decode a bare id or an object without unknown fields
+func (item *BatchDeleteItem) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*item = BatchDeleteItem{}
+		return json.Unmarshal(data, &item.ID)
+	}
+	// the plain type does not recurse into this method
+	type plain BatchDeleteItem
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(item))
+}
+
+// assetBatch stages the changes of a batch on top of the ledger
+type assetBatch struct {
+	stub   shim.ChaincodeStubInterface
+	config *Config
+	// staged values by id, nil for a deleted asset
+	staged map[string][]byte
+	// ledger values of the staged ids
+	original map[string][]byte
+	events   []AssetEvent
+	result   BatchResult
+}
+
+// ===============================================
+// createAssetsBatch - create many assets in one transaction
+// args: JSON array of assets, [mode] "atomic" (default) or "bestEffort"
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"createAssetsBatch","args":["[{\"id\":\"001\",\"name\":\"test\",\"type\":\"food\",\"owner\":\"cathy\",\"flag\":true,\"updatedDate\":\"2018-05-25\",\"timeStamp\":1502688979}]"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) createAssetsBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	var demoAssets []DemoAsset
+	mode, err := parseBatchArgs(args, &demoAssets)
+	if err == nil {
+		err = checkBatchSize(len(demoAssets))
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batch, err := newAssetBatch(stub, mode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i := range demoAssets {
+		batch.add(i, demoAssets[i].ID, batch.create(&demoAssets[i]))
+	}
+	return batch.commit()
+}
+
+// ===============================================
+// updateAssetsBatch - replace many assets in one transaction, an asset with a version
+// fails unless it is the current version, args: JSON array of assets, [mode] "atomic" (default) or "bestEffort"
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"updateAssetsBatch","args":["[{\"id\":\"001\",\"name\":\"test_new\",\"type\":\"food\",\"owner\":\"cathy\",\"flag\":true,\"updatedDate\":\"2018-05-28\",\"timeStamp\":1502688979}]", "bestEffort"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) updateAssetsBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	var demoAssets []DemoAsset
+	mode, err := parseBatchArgs(args, &demoAssets)
+	if err == nil {
+		err = checkBatchSize(len(demoAssets))
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batch, err := newAssetBatch(stub, mode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i := range demoAssets {
+		batch.add(i, demoAssets[i].ID, batch.update(&demoAssets[i]))
+	}
+	return batch.commit()
+}
+
+// ===============================================
+// deleteAssetsBatch - delete many assets in one transaction, an item with a version
+// fails with a version conflict if the asset has another
+// args: JSON array of ids or {id, version} items, [mode] "atomic" (default) or "bestEffort"
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"deleteAssetsBatch","args":["[\"001\", {\"id\":\"002\",\"version\":3}]"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) deleteAssetsBatch(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	var items []BatchDeleteItem
+	mode, err := parseBatchArgs(args, &items)
+	if err == nil {
+		err = checkBatchSize(len(items))
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batch, err := newAssetBatch(stub, mode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i, item := range items {
+		batch.add(i, item.ID, batch.delete(item.ID, item.Version))
+	}
+	return batch.commit()
+}
+
+// parseBatchArgs - decode the JSON array of items and the mode
+func parseBatchArgs(args []string, items interface{}) (string, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return "", errors.New("Incorrect number of arguments. Expecting 1 or 2: JSON array, mode")
+	}
+	mode := BatchModeAtomic
+	if len(args) == 2 {
+		mode = args[1]
+	}
+	if mode != BatchModeAtomic && mode != BatchModeBestEffort {
+		return "", fmt.Errorf("2nd argument must be %s or %s", BatchModeAtomic, BatchModeBestEffort)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(args[0]))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(items)
+	if err != nil {
+		return "", errors.New("1st argument must be a JSON array: " + err.Error())
+	}
+	return mode, nil
+}
+
+func checkBatchSize(count int) error {
+	if count == 0 {
+		return errors.New("1st argument must contain at least one item")
+	} else if count > MaxBatchSize {
+		return fmt.Errorf("1st argument has %d items, at most %d are allowed", count, MaxBatchSize)
+	}
+	return nil
+}
+
+func newAssetBatch(stub shim.ChaincodeStubInterface, mode string) (*assetBatch, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &assetBatch{
+		stub:     stub,
+		config:   config,
+		staged:   make(map[string][]byte),
+		original: make(map[string][]byte),
+		result:   BatchResult{Mode: mode, Items: []BatchItemResult{}},
+	}, nil
+}
+
+// add - record the outcome of an item
+func (b *assetBatch) add(index int, id string, err error) {
+	item := BatchItemResult{Index: index, ID: id, OK: err == nil}
+	if err != nil {
+		item.Error = err.Error()
+		b.result.Failed++
+	} else {
+		b.result.Succeeded++
+	}
+	b.result.Items = append(b.result.Items, item)
+}
+
+// get - the staged value of an asset, the ledger value if the batch did not change it yet
+func (b *assetBatch) get(id string) ([]byte, error) {
+	if value, ok := b.staged[id]; ok {
+		return value, nil
+	}
+	err := checkAssetID(id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := b.stub.GetState(id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset: %s", err.Error())
+	}
+	b.original[id] = value
+	return value, nil
+}
+
+func (b *assetBatch) create(demoAsset *DemoAsset) error {
+	err := b.validate(demoAsset)
+	if err != nil {
+		return err
+	}
+	assetBytes, err := b.get(demoAsset.ID)
+	if err != nil {
+		return err
+	} else if assetBytes != nil {
+		return errors.New("This asset already exists: " + demoAsset.ID)
+	}
+	demoAsset.Version = 1
+	return b.stage(EventAssetCreated, demoAsset, nil)
+}
+
+func (b *assetBatch) update(demoAsset *DemoAsset) error {
+	err := b.validate(demoAsset)
+	if err != nil {
+		return err
+	}
+	assetBytes, err := b.get(demoAsset.ID)
+	if err != nil {
+		return err
+	} else if assetBytes == nil {
+		return errors.New("Asset does not exist: " + demoAsset.ID)
+	}
+	// a version in the item is the expected version, as the 9th argument of updateAsset
+	oldAsset := &DemoAsset{}
+	err = json.Unmarshal(assetBytes, oldAsset)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(oldAsset, demoAsset.Version)
+	if err != nil {
+		return err
+	}
+	demoAsset.Version = oldAsset.Version + 1
+	return b.stage(EventAssetUpdated, demoAsset, assetBytes)
+}
+
+// delete - stage the deletion of an asset, expected is its version or 0
+func (b *assetBatch) delete(id string, expected int) error {
+	if len(id) <= 0 {
+		return errors.New("id must be a non-empty string")
+	}
+	assetBytes, err := b.get(id)
+	if err != nil {
+		return err
+	} else if assetBytes == nil {
+		return errors.New("Asset does not exist: " + id)
+	}
+	demoAsset := &DemoAsset{}
+	err = json.Unmarshal(assetBytes, demoAsset)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(demoAsset, expected)
+	if err != nil {
+		return err
+	}
+
+	b.staged[id] = nil
+	b.events = append(b.events, newAssetEvent(b.stub, EventAssetDeleted, id, demoAsset.Type, assetBytes, nil))
+	return nil
+}
+
+// validate - the checks of createAsset and updateAsset, type is stored upper case
+func (b *assetBatch) validate(demoAsset *DemoAsset) error {
+	if len(demoAsset.ID) <= 0 {
+		return errors.New("id must be a non-empty string")
+	}
+	if len(demoAsset.Name) <= 0 {
+		return errors.New("name must be a non-empty string")
+	}
+	if len(demoAsset.Type) <= 0 {
+		return errors.New("type must be a non-empty string")
+	}
+	if len(demoAsset.Owner) <= 0 {
+		return errors.New("owner must be a non-empty string")
+	}
+	demoAsset.Type = strings.ToUpper(demoAsset.Type)
+	// ids and attributes must be usable in index keys
+	_, err := b.indexKeys(demoAsset)
+	return err
+}
+
+func (b *assetBatch) stage(eventType string, demoAsset *DemoAsset, before []byte) error {
+	assetJSONasBytes, err := json.Marshal(demoAsset)
+	if err != nil {
+		return err
+	}
+	b.staged[demoAsset.ID] = assetJSONasBytes
+	b.events = append(b.events, newAssetEvent(b.stub, eventType, demoAsset.ID, demoAsset.Type, before, assetJSONasBytes))
+	return nil
+}
+
+// indexKeys - the index entries of an asset under the configured index names
+func (b *assetBatch) indexKeys(demoAsset *DemoAsset) ([]string, error) {
+	keys := []string{}
+	for queryKey, indexName := range b.config.AssetIndexes {
+		indexKey, err := b.stub.CreateCompositeKey(indexName, assetIndexAttributes(queryKey, demoAsset))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, indexKey)
+	}
+	return keys, nil
+}
+
+// commit - write the staged assets unless an atomic batch has failed items.
+// Indexes are written once per batch: the entries of the ledger assets that the staged assets
+// no longer have are deleted, and only new entries are put.
+func (b *assetBatch) commit() peer.Response {
+	resultJSONasBytes, err := json.Marshal(b.result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if b.result.Failed > 0 && b.result.Mode == BatchModeAtomic {
+		return shim.Error(string(resultJSONasBytes))
+	}
+
+	ids := make([]string, 0, len(b.staged))
+	for id := range b.staged {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	oldIndexes := make(map[string]bool)
+	newIndexes := make(map[string]bool)
+	for _, id := range ids {
+		err = b.collectIndexKeys(b.original[id], oldIndexes)
+		if err == nil {
+			err = b.collectIndexKeys(b.staged[id], newIndexes)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if b.staged[id] == nil {
+			err = b.stub.DelState(id)
+			if err == nil {
+				err = deleteAssetGrants(b.stub, id, b.original[id])
+			}
+		} else {
+			err = b.stub.PutState(id, b.staged[id])
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	for _, indexKey := range sortedSet(oldIndexes) {
+		if !newIndexes[indexKey] {
+			err = b.stub.DelState(indexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+	for _, indexKey := range sortedSet(newIndexes) {
+		if !oldIndexes[indexKey] {
+			err = b.stub.PutState(indexKey, []byte{0x00})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	err = emitBatchEvent(b.stub, b.events)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
+
+// collectIndexKeys - add the index entries of an asset value to keys, nothing for a missing asset
+func (b *assetBatch) collectIndexKeys(assetBytes []byte, keys map[string]bool) error {
+	if assetBytes == nil {
+		return nil
+	}
+	demoAsset := &DemoAsset{}
+	err := json.Unmarshal(assetBytes, demoAsset)
+	if err != nil {
+		return err
+	}
+	indexKeys, err := b.indexKeys(demoAsset)
+	if err != nil {
+		return err
+	}
+	for _, indexKey := range indexKeys {
+		keys[indexKey] = true
+	}
+	return nil
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// ConfigIndex is the composite key object type of the chaincode configuration
+const ConfigIndex = "Config~Chaincode"
+
+// Config holds the settings of the handlers, Init sets it and setConfig changes it
+type Config struct {
+	// RESTURL is the service called by testRESTCC
+	RESTURL string `json:"restUrl"`
+	// EventName is the name of the event fired by fireCCEvent
+	EventName string `json:"eventName"`
+	// AssetIndexes maps the AssetQueryMap keys to composite key object types
+	AssetIndexes map[string]string `json:"assetIndexes"`
+	// MarbleColors and MarbleSizes are the values putPrivateData accepts
+	MarbleColors []string `json:"marbleColors"`
+	MarbleSizes  []string `json:"marbleSizes"`
+	// setConfig and the allowlist are changed by members of AdminMSPs, identities whose AdminAttribute is "true"
+	// and holders of the RoleAdmin role
+	AdminMSPs      []string `json:"adminMSPs"`
+	AdminAttribute string   `json:"adminAttribute"`
+	// Guards maps Invoke function names to the attribute expression the caller must satisfy,
+	// e.g. {"creatAsset": "hf.Type=client AND role in {maker,checker}"}, see ParseGuard
+	Guards map[string]string `json:"guards"`
+	// Approvals holds back calls of updateAsset or deleteAsset until approvers accept them,
+	// the batch, import and purchase functions that would bypass them are disabled, see approvals.go
+	Approvals map[string]ApprovalPolicy `json:"approvals"`
+	// Tenancy namespaces the assets by the MSP ID of the caller, it can only change while no assets exist,
+	// see tenancy.go
+	Tenancy bool `json:"tenancy"`
+	// Audit records the calls that change the state, see audit.go
+	Audit bool `json:"audit"`
+	// LogLevel is the level of the chaincode logger: DEBUG, INFO, NOTICE, WARNING, ERROR or CRITICAL,
+	// the environment variable LogLevelEnv overrides it
+	LogLevel string `json:"logLevel"`
+}
+
+// defaultConfig is the configuration of a ledger before Init or setConfig change it
+func defaultConfig() *Config {
+	assetIndexes := make(map[string]string)
+	for queryKey, indexName := range AssetQueryMap {
+		assetIndexes[queryKey] = indexName
+	}
+	return &Config{
+		RESTURL:        testRESTURL,
+		EventName:      "testEvent",
+		AssetIndexes:   assetIndexes,
+		MarbleColors:   []string{"red", "blue", "green"},
+		MarbleSizes:    []string{"10", "20", "30"},
+		AdminMSPs:      []string{},
+		AdminAttribute: "admin",
+		Guards:         map[string]string{},
+		Approvals:      map[string]ApprovalPolicy{},
+		LogLevel:       "INFO",
+	}
+}
+
+// ===============================================
+// getConfig - get the chaincode configuration
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getConfig","args":[],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getConfig(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(configJSONasBytes)
+}
+
+// ===============================================
+// setConfig - change settings, fields missing from the JSON argument keep their value
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"setConfig","args":["{\"eventName\":\"assetEvent\"}"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) setConfig(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: config JSON")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkAdmin(stub, config, "setConfig")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config, err = updateConfig(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(configJSONasBytes)
+}
+
+// getConfig - read the configuration, the defaults if it was never set
+func getConfig(stub shim.ChaincodeStubInterface) (*Config, error) {
+	key, err := stub.CreateCompositeKey(ConfigIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get config: %s", err.Error())
+	}
+
+	config := defaultConfig()
+	if configBytes != nil {
+		err = json.Unmarshal(configBytes, config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal config: %s", err.Error())
+		}
+	}
+	return config, nil
+}
+
+// updateConfig - apply the fields of configJSON to the configuration and save it
+func updateConfig(stub shim.ChaincodeStubInterface, configJSON string) (*Config, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	oldIndexes, oldGuards, oldApprovals, oldTenancy := config.AssetIndexes, config.Guards, config.Approvals, config.Tenancy
+
+	// unmarshal would merge maps, replace them instead
+	config.AssetIndexes, config.Guards, config.Approvals = nil, nil, nil
+	decoder := json.NewDecoder(strings.NewReader(configJSON))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, errors.New("Invalid config JSON: " + err.Error())
+	}
+	if config.AssetIndexes == nil {
+		config.AssetIndexes = oldIndexes
+	}
+	if config.Guards == nil {
+		config.Guards = oldGuards
+	}
+	if config.Approvals == nil {
+		config.Approvals = oldApprovals
+	}
+
+	err = validateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if !sameIndexes(oldIndexes, config.AssetIndexes) || oldTenancy != config.Tenancy {
+		// entries under the old names or keys would be orphaned
+		hasAssets, err := ledgerHasAssets(stub)
+		if err != nil {
+			return nil, err
+		}
+		if hasAssets && oldTenancy != config.Tenancy {
+			return nil, errors.New("tenancy cannot change once assets exist")
+		} else if hasAssets {
+			return nil, errors.New("assetIndexes cannot change once assets exist")
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(ConfigIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, configJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func validateConfig(config *Config) error {
+	if len(config.EventName) <= 0 {
+		return errors.New("eventName must be a non-empty string")
+	}
+	if len(config.MarbleColors) == 0 || len(config.MarbleSizes) == 0 {
+		return errors.New("marbleColors and marbleSizes must not be empty")
+	}
+	seen := make(map[string]bool)
+	for queryKey := range AssetQueryMap {
+		indexName := config.AssetIndexes[queryKey]
+		if len(indexName) <= 0 {
+			return fmt.Errorf("assetIndexes must name the %s index", queryKey)
+		}
+		if seen[indexName] {
+			return fmt.Errorf("assetIndexes must be distinct, %s is used twice", indexName)
+		}
+		seen[indexName] = true
+	}
+	if len(config.AssetIndexes) != len(AssetQueryMap) {
+		return errors.New("assetIndexes has unknown entries")
+	}
+	_, err := shim.LogLevel(config.LogLevel)
+	if err != nil {
+		return errors.New("logLevel must be one of DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
+	}
+	for _, expr := range config.Guards {
+		_, err := ParseGuard(expr)
+		if err != nil {
+			return err
+		}
+	}
+	for function, policy := range config.Approvals {
+		err := validateApprovalPolicy(function, policy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameIndexes(a map[string]string, b map[string]string) bool {
+	aBytes, _ := json.Marshal(a)
+	bBytes, _ := json.Marshal(b)
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// checkAdmin - return an error unless the creator is an administrator who may call function,
+// without admin MSPs or admin attribute no one is
+func checkAdmin(stub shim.ChaincodeStubInterface, config *Config, function string) error {
+	id, err := cid.New(stub)
+	if err != nil {
+		return fmt.Errorf("%s requires an administrator: %s", function, err.Error())
+	}
+	mspid, err := id.GetMSPID()
+	if err != nil {
+		return err
+	}
+	for _, adminMSP := range config.AdminMSPs {
+		if adminMSP == mspid {
+			return nil
+		}
+	}
+	clientID, err := id.GetID()
+	if err != nil {
+		return err
+	}
+	admin, err := hasRole(stub, RoleAdmin, mspid, clientID)
+	if err != nil || admin {
+		return err
+	}
+	if len(config.AdminAttribute) > 0 {
+		val, ok, err := id.GetAttributeValue(config.AdminAttribute)
+		if err == nil && ok && val == "true" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s requires an administrator, %s is not an admin MSP and the identity does not have %s=true or the admin role", function, mspid, config.AdminAttribute)
+}
+
+// validMarble - color and size, when given, must be among the configured values
+func validMarble(config *Config, marble *Marble) error {
+	if marble.Color != "" && !containsString(config.MarbleColors, strings.TrimSpace(marble.Color)) {
+		return fmt.Errorf("Color must be one of %v", config.MarbleColors)
+	}
+	if marble.Size != "" && !containsString(config.MarbleSizes, strings.TrimSpace(marble.Size)) {
+		return fmt.Errorf("Size must be one of %v", config.MarbleSizes)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// CCAllowlistIndex is the composite key object type of the cross-chaincode allowlist
+const CCAllowlistIndex = "CCAllowlist~Chaincode"
+
+// AllowAllFunctions permits every function of an allowlisted chaincode
+const AllowAllFunctions = "*"
+
+// CCAllowlistEntry lists the functions of a chaincode on a channel that may be invoked.
+// A function entry is either the function name, e.g. "invoke", or the function and its first
+// argument joined by ":", e.g. "invoke:query" for example02.
+type CCAllowlistEntry struct {
+	Channel   string   `json:"channel"`
+	Chaincode string   `json:"chaincode"`
+	Functions []string `json:"functions"`
+}
+
+// ===============================================
+// setCCAllowlist - allow invoking functions of another chaincode, admin only
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"setCCAllowlist","args":["", "obcs-example02", "[\"invoke:query\"]"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) setCCAllowlist(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: channel, chaincode, functions")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkAdmin(stub, config, "setCCAllowlist")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entry := CCAllowlistEntry{Channel: resolveChannel(stub, args[0]), Chaincode: args[1]}
+	err = json.Unmarshal([]byte(args[2]), &entry.Functions)
+	if err != nil {
+		return shim.Error("3rd argument must be a JSON array of function names: " + err.Error())
+	}
+	if len(entry.Functions) == 0 {
+		return shim.Error("3rd argument must list at least one function")
+	}
+
+	key, err := stub.CreateCompositeKey(CCAllowlistIndex, []string{entry.Channel, entry.Chaincode})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(key, entryJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(entryJSONasBytes)
+}
+
+// ===============================================
+// removeCCAllowlist - remove another chaincode from the allowlist, admin only
+// args: channel, chaincode
+// ===============================================
+func (t *MyChaincode) removeCCAllowlist(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: channel, chaincode")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkAdmin(stub, config, "removeCCAllowlist")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(CCAllowlistIndex, []string{resolveChannel(stub, args[0]), args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entryBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if entryBytes == nil {
+		return shim.Error("Chaincode is not in the allowlist: " + args[1])
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(entryBytes)
+}
+
+// ===============================================
+// getCCAllowlist - list the allowlisted chaincodes
+// ===============================================
+func (t *MyChaincode) getCCAllowlist(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(CCAllowlistIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	entries := []CCAllowlistEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var entry CCAllowlistEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entries = append(entries, entry)
+	}
+
+	entriesJSONasBytes, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(entriesJSONasBytes)
+}
+
+// ===============================================
+// invokeChaincode - invoke another chaincode after checking the allowlist,
+// the callee's response is returned as-is, including status and message on failure
+// ===============================================
+func invokeChaincode(stub shim.ChaincodeStubInterface, channel string, ccName string, ccArgs []string) peer.Response {
+	err := checkCCAllowlist(stub, resolveChannel(stub, channel), ccName, ccArgs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return stub.InvokeChaincode(ccName, util.ToChaincodeArgs(ccArgs...), channel)
+}
+
+// checkCCAllowlist - return an error unless the function of the chaincode is allowlisted
+func checkCCAllowlist(stub shim.ChaincodeStubInterface, channel string, ccName string, ccArgs []string) error {
+	key, err := stub.CreateCompositeKey(CCAllowlistIndex, []string{channel, ccName})
+	if err != nil {
+		return err
+	}
+	entryBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	} else if entryBytes == nil {
+		return fmt.Errorf("Chaincode %s on channel %q is not in the allowlist", ccName, channel)
+	}
+
+	var entry CCAllowlistEntry
+	err = json.Unmarshal(entryBytes, &entry)
+	if err != nil {
+		return err
+	}
+
+	for _, function := range entry.Functions {
+		if function == AllowAllFunctions || function == ccArgs[0] {
+			return nil
+		}
+		if len(ccArgs) > 1 && function == ccArgs[0]+":"+ccArgs[1] {
+			return nil
+		}
+	}
+	return fmt.Errorf("Function %v of chaincode %s is not in the allowlist", ccArgs, ccName)
+}
+
+// resolveChannel - an empty channel means the channel of the current transaction
+func resolveChannel(stub shim.ChaincodeStubInterface, channel string) string {
+	if channel == "" {
+		return stub.GetChannelID()
+	}
+	return channel
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/myChaincode/identity"
+)
+
+// DARIndex keys a DAR by its document id, the DARs of all tenants share it
+const DARIndex = "DAR~DocID"
+
+// ===============================================
+// createDar - store a new DAR, owned by the MSP ID of the caller. The owner grants
+// other MSPs access to it with grantAsset and the DAR object type
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"createDar","args":["{\"docId\":\"doc1\",\"aclId\":\"acl1\",\"version\":\"1\",\"docDigest\":\"5d41402a\",\"type\":\"contract\",\"fields\":[]}"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) createDar(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: DAR JSON")
+	}
+	dar, err := parseDAR(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := getDAR(stub, dar.DocID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error("DAR already exists: " + dar.DocID)
+	}
+	id, err := identity.New(stub)
+	if err != nil {
+		return shim.Error("The DAR owner must be identified: " + err.Error())
+	}
+	dar.Owner = id.MSPID
+	return putDAR(stub, dar)
+}
+
+// ===============================================
+// updateDar - replace a DAR as its owner or as the grantee of a write grant, the owner stays
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"updateDar","args":["{\"docId\":\"doc1\",\"aclId\":\"acl1\",\"version\":\"2\",\"docDigest\":\"7d793037\",\"type\":\"contract\",\"fields\":[]}"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) updateDar(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: DAR JSON")
+	}
+	dar, err := parseDAR(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := accessDAR(stub, dar.DocID, AccessWrite)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dar.Owner = existing.Owner
+	return putDAR(stub, dar)
+}
+
+// ===============================================
+// getDar - get a DAR by document id as its owner or as the grantee of a read grant
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getDar","args":["doc1"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getDar(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: document id")
+	}
+	dar, err := accessDAR(stub, args[0], AccessRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	darJSONasBytes, err := json.Marshal(dar)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(darJSONasBytes)
+}
+
+func parseDAR(darJSON string) (*DAR, error) {
+	dar := &DAR{}
+	err := json.Unmarshal([]byte(darJSON), dar)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DAR JSON: %s", err.Error())
+	} else if len(dar.DocID) <= 0 {
+		return nil, errors.New("docId must be a non-empty string")
+	}
+	return dar, nil
+}
+
+// accessDAR - an existing DAR the caller owns or is granted access to
+func accessDAR(stub shim.ChaincodeStubInterface, docID string, access string) (*DAR, error) {
+	dar, err := getDAR(stub, docID)
+	if err != nil {
+		return nil, err
+	} else if dar == nil {
+		return nil, fmt.Errorf("DAR does not exist: %s", docID)
+	}
+	owners, err := callerOwners(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(owners, dar.Owner) {
+		err = checkGrant(stub, DARObjectType, dar.Owner, docID, access)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dar, nil
+}
+
+// getDAR - the DAR of a document id, nil if there is none
+func getDAR(stub shim.ChaincodeStubInterface, docID string) (*DAR, error) {
+	key, err := stub.CreateCompositeKey(DARIndex, []string{docID})
+	if err != nil {
+		return nil, err
+	}
+	darBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DAR %s: %s", docID, err.Error())
+	} else if darBytes == nil {
+		return nil, nil
+	}
+	dar := &DAR{}
+	err = json.Unmarshal(darBytes, dar)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal DAR %s: %s", docID, err.Error())
+	}
+	return dar, nil
+}
+
+func putDAR(stub shim.ChaincodeStubInterface, dar *DAR) peer.Response {
+	key, err := stub.CreateCompositeKey(DARIndex, []string{dar.DocID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	darJSONasBytes, err := json.Marshal(dar)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(key, darJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(darJSONasBytes)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/myChaincode/identity"
+)
+
+// Chaincode event names, an indexer subscribes to all of them
+const (
+	AssetEventName = "AssetEvent"
+	BatchEventName = "BatchEvent"
+	GrantEventName = "GrantEvent"
+)
+
+// Event types carried in AssetEvent.EventType
+const (
+	EventAssetCreated   = "AssetCreated"
+	EventAssetUpdated   = "AssetUpdated"
+	EventAssetDeleted   = "AssetDeleted"
+	EventAssetPurchased = "AssetPurchased"
+	EventPrivateDataPut = "PrivateDataPut"
+	EventBatch          = "Batch"
+	EventGrantCreated   = "GrantCreated"
+	EventGrantRevoked   = "GrantRevoked"
+)
+
+// AssetEvent is the payload of the event emitted for a single state change,
+// a PrivateDataPut event only has the collection and the asset type
+type AssetEvent struct {
+	EventType    string `json:"eventType"`
+	AssetID      string `json:"assetId,omitempty"`
+	AssetType    string `json:"assetType"`
+	Collection   string `json:"collection,omitempty"`
+	BeforeDigest string `json:"beforeDigest,omitempty"`
+	AfterDigest  string `json:"afterDigest,omitempty"`
+	Creator      string `json:"creator"`
+	TxID         string `json:"txId"`
+}
+
+// BatchEvent wraps several state changes, Fabric keeps only one event per transaction
+type BatchEvent struct {
+	EventType string       `json:"eventType"`
+	Creator   string       `json:"creator"`
+	TxID      string       `json:"txId"`
+	Events    []AssetEvent `json:"events"`
+}
+
+// GrantEvent is the payload of the event emitted when a grant is created or revoked,
+// grants expire without an event
+type GrantEvent struct {
+	EventType string `json:"eventType"`
+	Grant     *Grant `json:"grant"`
+	Creator   string `json:"creator"`
+	TxID      string `json:"txId"`
+}
+
+// ===============================================
+// newAssetEvent - build an event for a state change, before/after are the raw values (nil if absent)
+// ===============================================
+func newAssetEvent(stub shim.ChaincodeStubInterface, eventType string, assetID string, assetType string, before []byte, after []byte) AssetEvent {
+	return AssetEvent{
+		EventType:    eventType,
+		AssetID:      assetID,
+		AssetType:    assetType,
+		BeforeDigest: digest(before),
+		AfterDigest:  digest(after),
+		Creator:      getCreatorName(stub),
+		TxID:         stub.GetTxID(),
+	}
+}
+
+// ===============================================
+// emitEvents - set the chaincode event of the transaction,
+// more than one state change is sent as a BatchEvent envelope
+// ===============================================
+func emitEvents(stub shim.ChaincodeStubInterface, events ...AssetEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if len(events) > 1 {
+		return emitBatchEvent(stub, events)
+	}
+
+	payload, err := json.Marshal(events[0])
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(AssetEventName, payload)
+}
+
+// ===============================================
+// emitBatchEvent - send state changes as a BatchEvent, batch functions use it even for a single change
+// ===============================================
+func emitBatchEvent(stub shim.ChaincodeStubInterface, events []AssetEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(BatchEvent{
+		EventType: EventBatch,
+		Creator:   events[0].Creator,
+		TxID:      stub.GetTxID(),
+		Events:    events,
+	})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(BatchEventName, payload)
+}
+
+// ===============================================
+// emitGrantEvent - send a change of the grants of an asset
+// ===============================================
+func emitGrantEvent(stub shim.ChaincodeStubInterface, eventType string, grant *Grant) error {
+	payload, err := json.Marshal(GrantEvent{
+		EventType: eventType,
+		Grant:     grant,
+		Creator:   getCreatorName(stub),
+		TxID:      stub.GetTxID(),
+	})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(GrantEventName, payload)
+}
+
+// digest - hex encoded sha256 of a value, empty for a missing value
+func digest(value []byte) string {
+	if value == nil {
+		return ""
+	}
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// getCreatorName - "userOrg.userName" of the transaction creator, empty if it cannot be resolved
+func getCreatorName(stub shim.ChaincodeStubInterface) string {
+	id, err := identity.New(stub)
+	if err != nil {
+		return ""
+	}
+	return id.Name()
+}
@@ -0,0 +1,94 @@
+// Package client calls the example02 chaincode from another chaincode
+// with typed arguments and results.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// InvokeFunc invokes example02 with string arguments, e.g. ["invoke", "query", "a"]
+type InvokeFunc func(args []string) pb.Response
+
+// Client is a typed client of the example02 chaincode
+type Client struct {
+	invoke InvokeFunc
+}
+
+// Account is the holding of an entity in example02
+type Account struct {
+	Name   string `json:"name"`
+	Amount int    `json:"amount"`
+}
+
+// CallError is returned when example02 does not answer with shim.OK
+type CallError struct {
+	Status  int32
+	Message string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("example02 returned status %d: %s", e.Status, e.Message)
+}
+
+// New returns a client invoking chaincodeName through stub.InvokeChaincode,
+// an empty channel means the channel of the current transaction
+func New(stub shim.ChaincodeStubInterface, chaincodeName string, channel string) *Client {
+	return NewWithInvoker(func(args []string) pb.Response {
+		return stub.InvokeChaincode(chaincodeName, util.ToChaincodeArgs(args...), channel)
+	})
+}
+
+// NewWithInvoker returns a client using invoke to call example02
+func NewWithInvoker(invoke InvokeFunc) *Client {
+	return &Client{invoke: invoke}
+}
+
+// Query returns the holding of name
+func (c *Client) Query(name string) (*Account, error) {
+	payload, err := c.call("query", name)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := strconv.Atoi(string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("example02 returned a non-numeric amount for %s: %q", name, payload)
+	}
+	return &Account{Name: name, Amount: amount}, nil
+}
+
+// Move transfers amount from one entity to another
+func (c *Client) Move(from string, to string, amount int) error {
+	_, err := c.call("move", from, to, strconv.Itoa(amount))
+	return err
+}
+
+// Delete removes an entity from example02
+func (c *Client) Delete(name string) error {
+	_, err := c.call("delete", name)
+	return err
+}
+
+func (c *Client) call(action string, args ...string) ([]byte, error) {
+	resp := c.invoke(append([]string{"invoke", action}, args...))
+	if resp.Status != shim.OK {
+		return nil, &CallError{Status: resp.Status, Message: errorMessage(resp.Message)}
+	}
+	return resp.Payload, nil
+}
+
+// errorMessage - unwrap {"Error":"..."} messages returned by example02
+func errorMessage(message string) string {
+	var jsonErr struct {
+		Error string `json:"Error"`
+	}
+	if err := json.Unmarshal([]byte(message), &jsonErr); err == nil && jsonErr.Error != "" {
+		return jsonErr.Error
+	}
+	return message
+}
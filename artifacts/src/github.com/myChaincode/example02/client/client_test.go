@@ -0,0 +1,64 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	exampleCC "github.com/myChaincode/example02"
+)
+
+func newTestClient(t *testing.T) (*shim.MockStub, *Client) {
+	stub := shim.NewMockStub("caller", nil)
+	stub2 := shim.NewMockStub("example02", new(exampleCC.SimpleChaincode))
+	res := stub2.MockInit("init", [][]byte{[]byte("Init"), []byte("a"), []byte("100"), []byte("b"), []byte("200")})
+	if res.Status != shim.OK {
+		t.Fatalf("example02 init failed: %s", res.Message)
+	}
+	stub.MockPeerChaincode("obcs-example02", stub2)
+	// example02 writes need a running transaction
+	stub.MockTransactionStart("tx1")
+	return stub2, New(stub, "obcs-example02", "")
+}
+
+func TestQuery(t *testing.T) {
+	_, c := newTestClient(t)
+	account, err := c.Query("a")
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	if account.Name != "a" || account.Amount != 100 {
+		t.Errorf("Query returned wrong account, got: %+v", account)
+	}
+
+	_, err = c.Query("nobody")
+	callErr, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("Query of unknown entity should return a CallError, got: %v", err)
+	}
+	if callErr.Status != shim.ERROR || callErr.Message != "Nil amount for nobody" {
+		t.Errorf("Query returned wrong error, got: %+v", callErr)
+	}
+}
+
+func TestMove(t *testing.T) {
+	stub2, c := newTestClient(t)
+	if err := c.Move("a", "b", 10); err != nil {
+		t.Fatalf("Move failed: %s", err)
+	}
+	if string(stub2.State["a"]) != "90" || string(stub2.State["b"]) != "210" {
+		t.Errorf("Move did not update holdings, got: a=%s b=%s", stub2.State["a"], stub2.State["b"])
+	}
+	if err := c.Move("a", "nobody", 10); err == nil {
+		t.Errorf("Move to unknown entity should fail")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	_, c := newTestClient(t)
+	// example02's delete counts the action as an argument and rejects every call,
+	// Delete has to hand that failure back as a CallError
+	err := c.Delete("a")
+	if _, ok := err.(*CallError); !ok {
+		t.Fatalf("Delete should return a CallError, got: %v", err)
+	}
+}
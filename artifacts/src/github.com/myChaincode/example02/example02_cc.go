@@ -20,6 +20,7 @@ limitations under the License.
 package example02	//package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -31,6 +32,25 @@ import (
 type SimpleChaincode struct {
 }
 
+// OverdraftIndex is the composite key object type of the per-entity overdraft limits
+const OverdraftIndex = "Overdraft~Entity"
+
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// Errors returned by move, every broken ledger rule has its own message
+var (
+	ErrInvalidAmount     = errors.New("Invalid transaction amount, expecting a positive integer value")
+	ErrSelfTransfer      = errors.New("Invalid transaction, cannot move to the same entity")
+	ErrInvalidHolding    = errors.New("Invalid holding stored in the ledger, expecting an integer value")
+	ErrInsufficientFunds = errors.New("Insufficient funds, transaction exceeds the overdraft limit")
+	ErrHoldingOverflow   = errors.New("Invalid transaction, holding would overflow")
+	ErrSourceMissing     = errors.New("Source entity not found")
+	ErrTargetMissing     = errors.New("Destination entity not found")
+)
+
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("########### example_cc Init ###########")
 	_, args := stub.GetFunctionAndParameters()
@@ -38,8 +58,10 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	var Aval, Bval int // Asset holdings
 	var err error
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	// overdraft limits are set here only, so that only the operators instantiating
+	// or upgrading the chaincode can allow an entity to go below zero
+	if len(args) != 4 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4, or 6 with the overdraft limits")
 	}
 
 	// Initialize the chaincode
@@ -66,6 +88,16 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	if len(args) == 6 {
+		err = setOverdraft(stub, A, args[4])
+		if err == nil {
+			err = setOverdraft(stub, B, args[5])
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	return shim.Success(nil)
 
 }
@@ -116,6 +148,15 @@ func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string)
 
 	A = args[1]
 	B = args[2]
+	if A == B {
+		return shim.Error(ErrSelfTransfer.Error())
+	}
+
+	// Perform the execution
+	X, err = strconv.Atoi(args[3])
+	if err != nil || X <= 0 {
+		return shim.Error(ErrInvalidAmount.Error())
+	}
 
 	// Get the state from the ledger
 	// TODO: will be nice to have a GetAllState call to ledger
@@ -124,23 +165,35 @@ func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("Failed to get state")
 	}
 	if Avalbytes == nil {
-		return shim.Error("Entity not found")
+		return shim.Error(ErrSourceMissing.Error())
+	}
+	Aval, err = strconv.Atoi(string(Avalbytes))
+	if err != nil {
+		return shim.Error(ErrInvalidHolding.Error())
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
 
 	Bvalbytes, err := stub.GetState(B)
 	if err != nil {
 		return shim.Error("Failed to get state")
 	}
 	if Bvalbytes == nil {
-		return shim.Error("Entity not found")
+		return shim.Error(ErrTargetMissing.Error())
+	}
+	Bval, err = strconv.Atoi(string(Bvalbytes))
+	if err != nil {
+		return shim.Error(ErrInvalidHolding.Error())
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[3])
+	overdraft, err := getOverdraft(stub, A)
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return shim.Error(err.Error())
+	}
+	// Aval - X >= -overdraft, written so that it cannot overflow
+	if Aval < minInt+X || Aval-X < -overdraft {
+		return shim.Error(ErrInsufficientFunds.Error())
+	}
+	if Bval > maxInt-X {
+		return shim.Error(ErrHoldingOverflow.Error())
 	}
 	Aval = Aval - X
 	Bval = Bval + X
@@ -177,6 +230,43 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(nil)
 }
 
+// Sets how far below zero an entity may go, 0 keeps the holding non-negative
+func setOverdraft(stub shim.ChaincodeStubInterface, A string, limitString string) error {
+	limit, err := strconv.Atoi(limitString)
+	if err != nil || limit < 0 {
+		return errors.New("Invalid overdraft limit, expecting a non-negative integer value")
+	}
+
+	overdraftKey, err := stub.CreateCompositeKey(OverdraftIndex, []string{A})
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return stub.DelState(overdraftKey)
+	}
+	return stub.PutState(overdraftKey, []byte(strconv.Itoa(limit)))
+}
+
+// Returns the overdraft limit of an entity, 0 if none is set
+func getOverdraft(stub shim.ChaincodeStubInterface, A string) (int, error) {
+	overdraftKey, err := stub.CreateCompositeKey(OverdraftIndex, []string{A})
+	if err != nil {
+		return 0, err
+	}
+	limitBytes, err := stub.GetState(overdraftKey)
+	if err != nil {
+		return 0, errors.New("Failed to get state")
+	}
+	if limitBytes == nil {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(string(limitBytes))
+	if err != nil {
+		return 0, errors.New("Invalid overdraft limit stored in the ledger")
+	}
+	return limit, nil
+}
+
 // Query callback representing the query of a chaincode
 func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
@@ -0,0 +1,97 @@
+package example02
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func newExampleStub(t *testing.T, aval string, bval string, overdraft string) *shim.MockStub {
+	stub := shim.NewMockStub("example02", new(SimpleChaincode))
+	res := stub.MockInit("init", util.ToChaincodeArgs("Init", "a", "100", "b", "200", overdraft, "0"))
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	// overwrite holdings directly to reach edge cases Init would not accept
+	stub.State["a"] = []byte(aval)
+	stub.State["b"] = []byte(bval)
+	return stub
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name      string
+		aval      string
+		bval      string
+		overdraft string
+		from, to  string
+		amount    string
+		wantErr   string
+		wantA     string
+		wantB     string
+	}{
+		{name: "ok", aval: "100", bval: "200", from: "a", to: "b", amount: "10", wantA: "90", wantB: "210"},
+		{name: "whole holding", aval: "100", bval: "200", from: "a", to: "b", amount: "100", wantA: "0", wantB: "300"},
+		{name: "zero amount", aval: "100", bval: "200", from: "a", to: "b", amount: "0", wantErr: ErrInvalidAmount.Error()},
+		{name: "negative amount", aval: "100", bval: "200", from: "a", to: "b", amount: "-10", wantErr: ErrInvalidAmount.Error()},
+		{name: "non-numeric amount", aval: "100", bval: "200", from: "a", to: "b", amount: "ten", wantErr: ErrInvalidAmount.Error()},
+		{name: "self transfer", aval: "100", bval: "200", from: "a", to: "a", amount: "10", wantErr: ErrSelfTransfer.Error()},
+		{name: "insufficient funds", aval: "100", bval: "200", from: "a", to: "b", amount: "101", wantErr: ErrInsufficientFunds.Error()},
+		{name: "within overdraft", aval: "100", bval: "200", overdraft: "50", from: "a", to: "b", amount: "150", wantA: "-50", wantB: "350"},
+		{name: "beyond overdraft", aval: "100", bval: "200", overdraft: "50", from: "a", to: "b", amount: "151", wantErr: ErrInsufficientFunds.Error()},
+		{name: "corrupt holding", aval: "abc", bval: "200", from: "a", to: "b", amount: "10", wantErr: ErrInvalidHolding.Error()},
+		{name: "overflow", aval: "100", bval: strconv.Itoa(maxInt), from: "a", to: "b", amount: "1", wantErr: ErrHoldingOverflow.Error()},
+		{name: "underflow", aval: strconv.Itoa(minInt), bval: "0", overdraft: strconv.Itoa(maxInt), from: "a", to: "b", amount: "1", wantErr: ErrInsufficientFunds.Error()},
+		{name: "unknown source", aval: "100", bval: "200", from: "c", to: "b", amount: "10", wantErr: ErrSourceMissing.Error()},
+		{name: "unknown destination", aval: "100", bval: "200", from: "a", to: "c", amount: "10", wantErr: ErrTargetMissing.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.overdraft == "" {
+				tt.overdraft = "0"
+			}
+			stub := newExampleStub(t, tt.aval, tt.bval, tt.overdraft)
+
+			res := stub.MockInvoke("tx1", util.ToChaincodeArgs("invoke", "move", tt.from, tt.to, tt.amount))
+			if tt.wantErr != "" {
+				if res.Status == shim.OK || res.Message != tt.wantErr {
+					t.Errorf("move got status %d message %q, want error %q", res.Status, res.Message, tt.wantErr)
+				}
+				return
+			}
+			if res.Status != shim.OK {
+				t.Fatalf("move failed: %s", res.Message)
+			}
+			if string(stub.State["a"]) != tt.wantA || string(stub.State["b"]) != tt.wantB {
+				t.Errorf("move got a=%s b=%s, want a=%s b=%s", stub.State["a"], stub.State["b"], tt.wantA, tt.wantB)
+			}
+		})
+	}
+}
+
+func TestOverdraftLimits(t *testing.T) {
+	stub := shim.NewMockStub("example02", new(SimpleChaincode))
+	res := stub.MockInit("init", util.ToChaincodeArgs("Init", "a", "100", "b", "200", "-1", "0"))
+	if res.Status == shim.OK {
+		t.Errorf("Init should reject a negative limit")
+	}
+
+	// callers cannot raise their own limit
+	stub = newExampleStub(t, "100", "200", "10")
+	res = stub.MockInvoke("tx1", util.ToChaincodeArgs("invoke", "setOverdraft", "b", "1000"))
+	if res.Status == shim.OK {
+		t.Errorf("setOverdraft should not be an Invoke action")
+	}
+	overdraftKey, _ := stub.CreateCompositeKey(OverdraftIndex, []string{"b"})
+	if stub.State[overdraftKey] != nil {
+		t.Errorf("Init stored a zero overdraft limit")
+	}
+
+	overdraftKey, _ = stub.CreateCompositeKey(OverdraftIndex, []string{"a"})
+	if string(stub.State[overdraftKey]) != "10" {
+		t.Errorf("Init did not store the overdraft limit, got: %s", stub.State[overdraftKey])
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// ExportFormat identifies the NDJSON layout written by exportState
+const ExportFormat = "myChaincode-state/1"
+
+// ExportPageSize is the default number of assets in an export page
+const ExportPageSize = 100
+
+// ImportOverwrite is the importState mode that replaces assets the ledger holds with a different value
+const ImportOverwrite = "overwrite"
+
+// ExportHeader is the first line of an export page. Bookmark is passed to exportState
+// for the next page, it is empty on the last page.
+type ExportHeader struct {
+	Format        string `json:"format"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Count         int    `json:"count"`
+	Bookmark      string `json:"bookmark"`
+}
+
+// ExportRecord is an asset line of an export page, Indexes holds the index attributes by AssetQueryMap key
+type ExportRecord struct {
+	Key     string              `json:"key"`
+	Record  DemoAsset           `json:"record"`
+	Indexes map[string][]string `json:"indexes"`
+}
+
+// ===============================================
+// exportState - export a page of assets and their index entries as newline-delimited JSON
+// args: [pageSize], [bookmark] from the header of the previous page
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"exportState","args":["100", ""],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) exportState(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2: page size, bookmark")
+	}
+	pageSize := ExportPageSize
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 || pageSize > MaxBatchSize {
+			return shim.Error(fmt.Sprintf("1st argument must be a page size between 1 and %d", MaxBatchSize))
+		}
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status, err := getSchemaStatus(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// buffer holds one ExportRecord per line, the header is written before it once the page is read
+	var buffer bytes.Buffer
+	header := ExportHeader{Format: ExportFormat, SchemaVersion: status.Version}
+	header.Bookmark, err = forEachAsset(stub, bookmark, pageSize, func(key string, assetBytes []byte) error {
+		record := ExportRecord{Key: key, Indexes: make(map[string][]string)}
+		err := json.Unmarshal(assetBytes, &record.Record)
+		if err != nil {
+			return err
+		}
+		for queryKey := range config.AssetIndexes {
+			record.Indexes[queryKey] = assetIndexAttributes(queryKey, &record.Record)
+		}
+		recordJSONasBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buffer.Write(recordJSONasBytes)
+		buffer.WriteString("\n")
+		header.Count++
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	headerJSONasBytes, err := json.Marshal(header)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	page := append(append(headerJSONasBytes, '\n'), buffer.Bytes()...)
+	return shim.Success(page)
+}
+
+// ===============================================
+// importState - load a page written by exportState, keeping the asset ids.
+// Assets equal to the ledger value are skipped, so a page can be imported again.
+// An asset the ledger holds with a different value is a conflict, unless the mode is overwrite
+// args: page, [mode]
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"importState","args":["{\"format\":\"myChaincode-state/1\",\"schemaVersion\":2,\"count\":1,\"bookmark\":\"\"}\n{\"key\":\"001\",\"record\":{...},\"indexes\":{...}}\n"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) importState(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2: export page, mode")
+	}
+	overwrite := len(args) == 2 && args[1] == ImportOverwrite
+	if len(args) == 2 && !overwrite {
+		return shim.Error(fmt.Sprintf("2nd argument must be %s", ImportOverwrite))
+	}
+
+	lines := strings.Split(strings.TrimRight(args[0], "\n"), "\n")
+	header := ExportHeader{}
+	err := decodeExportLine(lines[0], &header)
+	if err != nil {
+		return shim.Error("Invalid export header: " + err.Error())
+	}
+	if header.Format != ExportFormat {
+		return shim.Error(fmt.Sprintf("Unsupported export format %q, expecting %q", header.Format, ExportFormat))
+	}
+	status, err := getSchemaStatus(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if header.SchemaVersion != status.Version {
+		return shim.Error(fmt.Sprintf("Export schema version %d does not match ledger schema version %d", header.SchemaVersion, status.Version))
+	}
+	records := lines[1:]
+	if len(records) != header.Count {
+		return shim.Error(fmt.Sprintf("Export page has %d records, the header counts %d", len(records), header.Count))
+	}
+	err = checkBatchSize(len(records))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batch, err := newAssetBatch(stub, BatchModeAtomic)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i, line := range records {
+		record := ExportRecord{}
+		err = decodeExportLine(line, &record)
+		if err == nil {
+			err = batch.importRecord(&record, overwrite)
+		}
+		batch.add(i, record.Key, err)
+	}
+	return batch.commit()
+}
+
+func decodeExportLine(line string, v interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// importRecord - stage an exported asset, unless the ledger already holds it. A different
+// ledger value is only replaced with overwrite, the version then still goes up
+func (b *assetBatch) importRecord(record *ExportRecord, overwrite bool) error {
+	if record.Key != record.Record.ID {
+		return fmt.Errorf("key %s does not match the asset id %s", record.Key, record.Record.ID)
+	}
+	err := b.validate(&record.Record)
+	if err != nil {
+		return err
+	}
+	// the index entries must be the ones this asset has, under the local index names
+	indexes := make(map[string][]string)
+	for queryKey := range b.config.AssetIndexes {
+		indexes[queryKey] = assetIndexAttributes(queryKey, &record.Record)
+	}
+	if !reflect.DeepEqual(indexes, record.Indexes) {
+		return errors.New("indexes do not match the asset")
+	}
+
+	assetBytes, err := b.get(record.Key)
+	if err != nil {
+		return err
+	}
+	if assetBytes == nil {
+		return b.stage(EventAssetCreated, &record.Record, nil)
+	}
+	assetJSONasBytes, err := json.Marshal(record.Record)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(assetJSONasBytes, assetBytes) {
+		return nil
+	}
+	oldAsset := &DemoAsset{}
+	err = json.Unmarshal(assetBytes, oldAsset)
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		return fmt.Errorf("asset %s differs from the ledger version %d, import with mode %s to replace it", record.Key, oldAsset.Version, ImportOverwrite)
+	}
+	if record.Record.Version <= oldAsset.Version {
+		record.Record.Version = oldAsset.Version + 1
+	}
+	return b.stage(EventAssetUpdated, &record.Record, assetBytes)
+}
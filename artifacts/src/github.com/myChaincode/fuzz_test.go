@@ -0,0 +1,88 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/common/util"
+)
+
+// FuzzCreateAsset - go test -run '^$' -fuzz FuzzCreateAsset
+func FuzzCreateAsset(f *testing.F) {
+	f.Add("001", "test", "food", "cathy", "true", "2018-05-25", "1502688979")
+	f.Add("", "", "", "", "", "", "")
+	f.Add("002", "test", "drink", "tom", "F", "", "-1")
+	f.Add("003", "test", "food\x00", "tom", "1", "2018-05-25", "99999999999999999999")
+	f.Add("004", "\xff", "food", "é", "TRUE", "2018-05-25", "+7")
+	f.Fuzz(func(t *testing.T, id, name, _type, owner, _flag, updatedDate, _timestamp string) {
+		stub := NewTestStub("fuzzChaincodeStub", new(MyChaincode))
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("creatAsset", id, name, _type, owner, _flag, updatedDate, _timestamp))
+		if invokeResult.Status != 200 {
+			return
+		}
+
+		// an accepted asset is stored as parsed, with both index entries
+		flagValue, err := strconv.ParseBool(_flag)
+		if err != nil {
+			t.Fatalf("Create asset accepted flag %q", _flag)
+		}
+		timestampValue, err := strconv.Atoi(_timestamp)
+		if err != nil {
+			t.Fatalf("Create asset accepted timestamp %q", _timestamp)
+		}
+		want, _ := json.Marshal(DemoAsset{id, name, strings.ToUpper(_type), owner, flagValue, updatedDate, timestampValue, 1})
+		if !bytes.Equal(stub.State[id], want) {
+			t.Fatalf("Create asset stored %s, want: %s", stub.State[id], want)
+		}
+		assertIndex(t, stub, AssetQueryMap["AssetType"], []string{strings.ToUpper(_type), id}, true)
+		assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{owner, id}, true)
+
+		invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getAsset", id))
+		if invokeResult.Status != 200 || !bytes.Equal(invokeResult.Payload, want) {
+			t.Fatalf("Get asset after create returned %d %s, want: %s", invokeResult.Status, invokeResult.Payload, want)
+		}
+	})
+}
+
+// FuzzPutPrivateData - go test -run '^$' -fuzz FuzzPutPrivateData
+func FuzzPutPrivateData(f *testing.F) {
+	f.Add(`{"MarbleID":"m_001","Name":"mmm","Color":"red","Size":"10","OwnerID":"ssd"}`)
+	f.Add(`{"MarbleID":""}`)
+	f.Add(`{"MarbleID":1}`)
+	f.Add(`null`)
+	f.Add(`[]`)
+	f.Add(`{"MarbleID":"m_002","Metadata":{"a":[1,2,{"b":null}]}}`)
+	f.Fuzz(func(t *testing.T, marbleJSON string) {
+		stub := NewTestStub("fuzzChaincodeStub", new(MyChaincode))
+		stub.LoadCollections(t, "collection_definition.json")
+		stub.MSPID = "OBPFounder"
+
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("putPrivateData", "privateDataCollection", marbleJSON))
+		private := stub.PrivateState["privateDataCollection"]
+		if len(stub.State) != 0 {
+			t.Fatalf("Put private data wrote to the public state")
+		}
+		if invokeResult.Status != 200 {
+			if len(private) != 0 {
+				t.Fatalf("Rejected private data was stored: %s", invokeResult.Message)
+			}
+			return
+		}
+
+		// accepted input is a marble with an id, stored as given under that id
+		var marble Marble
+		err := json.Unmarshal([]byte(marbleJSON), &marble)
+		if err != nil || marble.MarbleID == "" {
+			t.Fatalf("Put private data accepted %q", marbleJSON)
+		}
+		if len(private) != 1 || string(private[marble.MarbleID]) != marbleJSON {
+			t.Fatalf("Put private data stored %v, want %s under %q", private, marbleJSON, marble.MarbleID)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// update rewrites the golden files: go test -run TestName -update
+var update = flag.Bool("update", false, "rewrite testdata/*.golden with the actual responses")
+
+// assertGolden compares a JSON response with testdata/<name>.golden, ignoring whitespace
+func assertGolden(t *testing.T, name string, payload []byte) {
+	t.Helper()
+	var indented bytes.Buffer
+	err := json.Indent(&indented, payload, "", "  ")
+	if err != nil {
+		t.Fatalf("Response %s is not valid JSON: %s\n%s", name, err, payload)
+	}
+	indented.WriteString("\n")
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err = os.MkdirAll("testdata", 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, indented.Bytes(), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write golden file: %s", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file, run go test -update to create it: %s", err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("Response %s does not match %s\ngot:\n%s\nwant:\n%s", name, path, indented.Bytes(), want)
+	}
+}
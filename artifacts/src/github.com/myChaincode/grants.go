@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/myChaincode/identity"
+)
+
+// Composite key object types of the grants
+const (
+	// GrantIndex keys a grant by the object type, the owner, the object id, the grantee MSP ID and user
+	GrantIndex = "Grant~Type~Owner~ID~Grantee"
+	// GranteeIndex finds the grants of a grantee: grantee MSP ID and user, object type, owner, object id
+	GranteeIndex = "Grant~Grantee~Type~Owner~ID"
+)
+
+// Object types a grant applies to
+const (
+	DemoAssetObjectType = "DemoAsset"
+	DARObjectType       = "DAR"
+)
+
+// Access levels of a grant, AccessWrite includes AccessRead
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// NoExpiry is the ExpiresAt of the grants of shareAsset, they apply until unshareAsset
+const NoExpiry = math.MaxInt64
+
+// Grant allows the members of MSPID, or only User when set, to read or write the object ID
+// of Owner until ExpiresAt, the tx timestamp in seconds it stops applying at. The owner of a
+// DemoAsset is its tenant in tenancy mode and its Owner otherwise, the owner of a DAR is the
+// MSP ID that created it.
+type Grant struct {
+	ObjectType string `json:"objectType"`
+	Owner      string `json:"owner"`
+	ID         string `json:"id"`
+	MSPID      string `json:"mspId"`
+	User       string `json:"user,omitempty"`
+	Access     string `json:"access"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	GrantedBy  string `json:"grantedBy"`
+	TxID       string `json:"txId"`
+	// Expired is set by listGrants, expired grants are not deleted
+	Expired bool `json:"expired,omitempty"`
+}
+
+// grantee - the MSP ID, optionally followed by / and the user id
+func (g *Grant) grantee() string {
+	if g.User == "" {
+		return g.MSPID
+	}
+	return g.MSPID + "/" + g.User
+}
+
+func (g *Grant) allows(access string, now int64) bool {
+	return now < g.ExpiresAt && (g.Access == access || g.Access == AccessWrite)
+}
+
+// objectNoun - how the errors name an object of the type
+func objectNoun(objectType string) string {
+	if objectType == DARObjectType {
+		return "DAR"
+	}
+	return "Asset"
+}
+
+// objectTypeArg - the object type of the optional argument i, DemoAsset when absent
+func objectTypeArg(args []string, i int, ordinal string) (string, error) {
+	if len(args) <= i {
+		return DemoAssetObjectType, nil
+	}
+	if args[i] != DemoAssetObjectType && args[i] != DARObjectType {
+		return "", fmt.Errorf("%s argument must be %s or %s", ordinal, DemoAssetObjectType, DARObjectType)
+	}
+	return args[i], nil
+}
+
+// ===============================================
+// grantAsset - grant read or write of an asset or DAR of the caller to another MSP, or to one user
+// as MSP ID/id with the id whoami reports, until a tx timestamp. The optional 5th argument is
+// the object type, DemoAsset or DAR. A new grant replaces the grantee's last one
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"grantAsset","args":["004", "Org2MSP", "read", "2018-06-30T00:00:00Z"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) grantAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5: id, grantee, access, expiry, object type")
+	}
+	objectType, err := objectTypeArg(args, 4, "5th")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant := &Grant{ObjectType: objectType, ID: args[0], Access: args[2], TxID: stub.GetTxID()}
+	parts := strings.SplitN(args[1], "/", 2)
+	grant.MSPID = parts[0]
+	if len(parts) == 2 {
+		grant.User = parts[1]
+	}
+	if len(grant.MSPID) <= 0 || (len(parts) == 2 && len(grant.User) <= 0) {
+		return shim.Error("2nd argument must be an MSP ID or MSP ID/id")
+	}
+	if grant.Access != AccessRead && grant.Access != AccessWrite {
+		return shim.Error("3rd argument must be read or write")
+	}
+	expiry, err := time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		return shim.Error("4th argument must be an RFC 3339 timestamp")
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant.ExpiresAt = expiry.Unix()
+	if grant.ExpiresAt <= now {
+		return shim.Error("4th argument must be after the transaction timestamp")
+	}
+	return createGrant(stub, grant)
+}
+
+// ===============================================
+// shareAsset - allow the members of another MSP to read an asset of the caller's tenant,
+// a read grant to the MSP without expiry. A later grantAsset to the MSP replaces it
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"shareAsset","args":["004", "Org2MSP"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) shareAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: id, MSP ID")
+	}
+	s, ok := stub.(*tenantStub)
+	if !ok {
+		return shim.Error("Tenancy is not enabled")
+	}
+	if len(args[1]) <= 0 || args[1] == s.tenant || strings.Contains(args[1], "/") {
+		return shim.Error("2nd argument must be the MSP ID of another tenant")
+	}
+	grant := &Grant{ObjectType: DemoAssetObjectType, ID: args[0], MSPID: args[1], Access: AccessRead, ExpiresAt: NoExpiry, TxID: stub.GetTxID()}
+	return createGrant(stub, grant)
+}
+
+// ===============================================
+// unshareAsset - withdraw a share of shareAsset, revokeGrant withdraws any grant
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"unshareAsset","args":["004", "Org2MSP"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) unshareAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: id, MSP ID")
+	}
+	s, ok := stub.(*tenantStub)
+	if !ok {
+		return shim.Error("Tenancy is not enabled")
+	}
+	grant, err := getGrant(stub, DemoAssetObjectType, s.tenant, args[0], args[1], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if grant == nil || grant.Access != AccessRead || grant.ExpiresAt != NoExpiry {
+		return shim.Error(fmt.Sprintf("Asset %s is not shared with %s", args[0], args[1]))
+	}
+	err = deleteGrant(stub, grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return grantResponse(stub, EventGrantRevoked, grant)
+}
+
+// createGrant - store the grant of an object the caller owns and emit its event
+func createGrant(stub shim.ChaincodeStubInterface, grant *Grant) peer.Response {
+	owner, err := grantOwner(stub, grant.ObjectType, grant.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if grant.MSPID == owner {
+		return shim.Error("2nd argument must be a grantee other than the owner " + owner)
+	}
+	grant.Owner = owner
+
+	caller, err := newCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callerMSP, callerID, err := caller.names()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant.GrantedBy = callerMSP + "/" + callerID
+	err = putGrant(stub, grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return grantResponse(stub, EventGrantCreated, grant)
+}
+
+// grantOwner - the owner of an existing asset or DAR, the caller must be the owner
+func grantOwner(stub shim.ChaincodeStubInterface, objectType string, id string) (string, error) {
+	owner := ""
+	if objectType == DARObjectType {
+		dar, err := getDAR(stub, id)
+		if err != nil {
+			return "", err
+		} else if dar == nil {
+			return "", errors.New("DAR does not exist: " + id)
+		}
+		owner = dar.Owner
+	} else {
+		demoAsset, err := getDemoAsset(stub, id)
+		if err != nil {
+			return "", err
+		}
+		// the caller's tenant owns the assets it can get
+		if s, ok := stub.(*tenantStub); ok {
+			return s.tenant, nil
+		}
+		owner = demoAsset.Owner
+	}
+
+	owners, err := callerOwners(stub)
+	if err != nil {
+		return "", err
+	}
+	if !containsString(owners, owner) {
+		return "", fmt.Errorf("Only the owner can grant %s %s, %s is not the owner %s", objectNoun(objectType), id, strings.Join(owners, "/"), owner)
+	}
+	return owner, nil
+}
+
+// callerOwners - the owners the caller acts as: its tenant in tenancy mode, otherwise
+// its MSP ID and the common name of its account
+func callerOwners(stub shim.ChaincodeStubInterface) ([]string, error) {
+	if s, ok := stub.(*tenantStub); ok {
+		return []string{s.tenant}, nil
+	}
+	id, err := identity.New(stub)
+	if err != nil {
+		return nil, errors.New("The caller must be identified: " + err.Error())
+	}
+	owners := []string{id.MSPID}
+	if id.CommonName != "" && id.CommonName != id.MSPID {
+		owners = append(owners, id.CommonName)
+	}
+	return owners, nil
+}
+
+// ===============================================
+// revokeGrant - delete the grant of an asset or DAR of the caller to a grantee of grantAsset,
+// the optional 3rd argument is the object type
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"revokeGrant","args":["004", "Org2MSP"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) revokeGrant(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3: id, grantee, object type")
+	}
+	objectType, err := objectTypeArg(args, 2, "3rd")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owners, err := callerOwners(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	parts := append(strings.SplitN(args[1], "/", 2), "")
+	for _, owner := range owners {
+		grant, err := getGrant(stub, objectType, owner, args[0], parts[0], parts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if grant == nil {
+			continue
+		}
+		err = deleteGrant(stub, grant)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return grantResponse(stub, EventGrantRevoked, grant)
+	}
+	return shim.Error(fmt.Sprintf("%s %s has no grant for %s", objectNoun(objectType), args[0], args[1]))
+}
+
+// ===============================================
+// listGrants - list the grants of the assets and DARs of the caller, optionally of one id and
+// object type, expired grants are listed with expired set
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"listGrants","args":["004"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) listGrants(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2: id, object type")
+	}
+	objectTypes := []string{DemoAssetObjectType, DARObjectType}
+	ids := args
+	if len(args) == 2 {
+		objectType, err := objectTypeArg(args, 1, "2nd")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		objectTypes, ids = []string{objectType}, args[:1]
+	}
+	owners, err := callerOwners(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	grants := []Grant{}
+	for _, objectType := range objectTypes {
+		for _, owner := range owners {
+			ownerGrants, err := getGrants(stub, append([]string{objectType, owner}, ids...))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			grants = append(grants, ownerGrants...)
+		}
+	}
+	for i := range grants {
+		grants[i].Expired = now >= grants[i].ExpiresAt
+	}
+	grantsJSONasBytes, err := json.Marshal(grants)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(grantsJSONasBytes)
+}
+
+// grantResponse - emit the grant event and return the grant
+func grantResponse(stub shim.ChaincodeStubInterface, eventType string, grant *Grant) peer.Response {
+	grantJSONasBytes, err := json.Marshal(grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = emitGrantEvent(stub, eventType, grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(grantJSONasBytes)
+}
+
+// checkGrant - whether an unexpired grant of the object allows access to the caller
+func checkGrant(stub shim.ChaincodeStubInterface, objectType string, owner string, id string, access string) error {
+	caller, err := newCaller(stub)
+	if err != nil {
+		return err
+	}
+	callerMSP, callerID, err := caller.names()
+	if err != nil {
+		return err
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return err
+	}
+	for _, user := range []string{"", callerID} {
+		grant, err := getGrant(stub, objectType, owner, id, callerMSP, user)
+		if err != nil {
+			return err
+		}
+		if grant != nil && grant.allows(access, now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s of %s is not granted to %s for %s", objectNoun(objectType), id, owner, callerMSP, access)
+}
+
+// grantedScope - the stub to reach the asset id of owner through a grant to the caller. In tenancy
+// mode it is the namespace of the tenant owner, otherwise the asset must be owned by owner.
+func grantedScope(stub shim.ChaincodeStubInterface, owner string, id string, access string) (shim.ChaincodeStubInterface, error) {
+	if s, ok := stub.(*tenantStub); ok {
+		if owner == s.tenant {
+			return stub, nil
+		}
+		err := checkGrant(stub, DemoAssetObjectType, owner, id, access)
+		if err != nil {
+			return nil, err
+		}
+		return scopeToTenant(stub, owner), nil
+	}
+
+	// grants are of the owner at grant time, they apply while it owns the asset
+	demoAsset, err := getDemoAsset(stub, id)
+	if err != nil {
+		return nil, err
+	} else if demoAsset.Owner != owner {
+		return nil, fmt.Errorf("Asset %s is not owned by %s", id, owner)
+	}
+	owners, err := callerOwners(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(owners, owner) {
+		err = checkGrant(stub, DemoAssetObjectType, owner, id, access)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stub, nil
+}
+
+// GrantedAsset is an asset of another tenant readable through a grant
+type GrantedAsset struct {
+	Owner string
+	ID    string
+	Value []byte
+}
+
+// getGrantedAssets - the assets other tenants grant the caller to read, in owner and id order,
+// nil without tenancy where the list queries already cover every asset
+func getGrantedAssets(stub shim.ChaincodeStubInterface) ([]GrantedAsset, error) {
+	s, ok := stub.(*tenantStub)
+	if !ok {
+		return nil, nil
+	}
+	caller, err := newCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	_, callerID, err := caller.names()
+	if err != nil {
+		return nil, err
+	}
+	now, err := txUnixTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	granted := make(map[[2]string]bool)
+	for _, user := range []string{"", callerID} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(GranteeIndex, []string{s.tenant, user, DemoAssetObjectType})
+		if err != nil {
+			return nil, err
+		}
+		err = collectGranted(stub, resultsIterator, s.tenant, user, now, granted)
+		resultsIterator.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	assets := make([]GrantedAsset, 0, len(granted))
+	for key := range granted {
+		value, err := scopeToTenant(stub, key[0]).GetState(key[1])
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			assets = append(assets, GrantedAsset{Owner: key[0], ID: key[1], Value: value})
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Owner < assets[j].Owner || (assets[i].Owner == assets[j].Owner && assets[i].ID < assets[j].ID)
+	})
+	return assets, nil
+}
+
+// collectGranted - add the owner and id of the grantee index entries that grant read now
+func collectGranted(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, mspid string, user string, now int64, granted map[[2]string]bool) error {
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		//Components should be grantee MSP ID, user, object type, owner, id
+		if len(components) < 5 {
+			return errors.New("Grantee index is malformed")
+		}
+		grant, err := getGrant(stub, components[2], components[3], components[4], mspid, user)
+		if err != nil {
+			return err
+		}
+		if grant != nil && grant.allows(AccessRead, now) {
+			granted[[2]string{grant.Owner, grant.ID}] = true
+		}
+	}
+	return nil
+}
+
+// deleteAssetGrants - delete the grants of a deleted asset, an asset created later with the id starts without any
+func deleteAssetGrants(stub shim.ChaincodeStubInterface, id string, assetBytes []byte) error {
+	owner := ""
+	if s, ok := stub.(*tenantStub); ok {
+		owner = s.tenant
+	} else {
+		demoAsset := &DemoAsset{}
+		err := json.Unmarshal(assetBytes, demoAsset)
+		if err != nil {
+			return fmt.Errorf("Failed to unmarshal asset %s: %s", id, err.Error())
+		}
+		owner = demoAsset.Owner
+	}
+	grants, err := getGrants(stub, []string{DemoAssetObjectType, owner, id})
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		err = deleteGrant(stub, &grant)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getGrant(stub shim.ChaincodeStubInterface, objectType string, owner string, id string, mspid string, user string) (*Grant, error) {
+	key, err := stub.CreateCompositeKey(GrantIndex, []string{objectType, owner, id, mspid, user})
+	if err != nil {
+		return nil, err
+	}
+	grantBytes, err := stub.GetState(key)
+	if err != nil || grantBytes == nil {
+		return nil, err
+	}
+	grant := &Grant{}
+	err = json.Unmarshal(grantBytes, grant)
+	if err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func putGrant(stub shim.ChaincodeStubInterface, grant *Grant) error {
+	key, err := stub.CreateCompositeKey(GrantIndex, []string{grant.ObjectType, grant.Owner, grant.ID, grant.MSPID, grant.User})
+	if err != nil {
+		return err
+	}
+	grantJSONasBytes, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, grantJSONasBytes)
+	if err != nil {
+		return err
+	}
+	return createIndex(stub, GranteeIndex, []string{grant.MSPID, grant.User, grant.ObjectType, grant.Owner, grant.ID})
+}
+
+func deleteGrant(stub shim.ChaincodeStubInterface, grant *Grant) error {
+	err := deleteIndex(stub, GrantIndex, []string{grant.ObjectType, grant.Owner, grant.ID, grant.MSPID, grant.User})
+	if err != nil {
+		return err
+	}
+	return deleteIndex(stub, GranteeIndex, []string{grant.MSPID, grant.User, grant.ObjectType, grant.Owner, grant.ID})
+}
+
+// getGrants - the grants in key order, attributes narrows them to an object type, an owner and an id
+func getGrants(stub shim.ChaincodeStubInterface, attributes []string) ([]Grant, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(GrantIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	grants := []Grant{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		grant := Grant{}
+		err = json.Unmarshal(queryResponse.Value, &grant)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
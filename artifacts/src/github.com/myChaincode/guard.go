@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Guard is a condition on the attributes of the caller certificate
+type Guard interface {
+	// Check returns nil if the caller satisfies the guard, otherwise the reason for the denial
+	Check(caller *Caller) error
+}
+
+// Caller is the identity guards are checked against
+type Caller struct {
+	id    cid.ClientIdentity
+	attrs *attrmgr.Attributes
+}
+
+// newCaller - the X.509 identity of the transaction creator and its attributes
+func newCaller(stub shim.ChaincodeStubInterface) (*Caller, error) {
+	id, err := cid.New(stub)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := id.GetX509Certificate()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := attrmgr.New().GetAttributesFromCert(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &Caller{id: id, attrs: attrs}, nil
+}
+
+type attrEquals struct{ name, value string }
+
+// AttrEquals requires the attribute name to have the given value
+func AttrEquals(name string, value string) Guard { return attrEquals{name, value} }
+
+func (g attrEquals) Check(caller *Caller) error {
+	return caller.id.AssertAttributeValue(g.name, g.value)
+}
+
+type attrIn struct {
+	name   string
+	values []string
+}
+
+// AttrIn requires the attribute name to have one of the given values
+func AttrIn(name string, values ...string) Guard { return attrIn{name, values} }
+
+func (g attrIn) Check(caller *Caller) error {
+	value, ok, err := caller.attrs.Value(g.name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Attribute '%s' was not found", g.name)
+	}
+	if !containsString(g.values, value) {
+		return fmt.Errorf("Attribute '%s' equals '%s', not one of {%s}", g.name, value, strings.Join(g.values, ","))
+	}
+	return nil
+}
+
+type attrTrue struct{ name string }
+
+// AttrTrue requires the boolean attribute name to be "true"
+func AttrTrue(name string) Guard { return attrTrue{name} }
+
+func (g attrTrue) Check(caller *Caller) error {
+	return caller.attrs.True(g.name)
+}
+
+type allOf []Guard
+
+// AllOf requires every guard, the denial reason is that of the first failing guard
+func AllOf(guards ...Guard) Guard { return allOf(guards) }
+
+func (g allOf) Check(caller *Caller) error {
+	for _, guard := range g {
+		err := guard.Check(caller)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type anyOf []Guard
+
+// AnyOf requires one of the guards, the denial reason lists why each of them failed
+func AnyOf(guards ...Guard) Guard { return anyOf(guards) }
+
+func (g anyOf) Check(caller *Caller) error {
+	reasons := make([]string, 0, len(g))
+	for _, guard := range g {
+		err := guard.Check(caller)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return errors.New(strings.Join(reasons, " OR "))
+}
+
+var (
+	attrNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+	attrInPattern   = regexp.MustCompile(`^(\S+)\s+in\s+\{(.*)\}$`)
+)
+
+// ParseGuard - parse a guard expression such as "hf.Type=client AND role in {maker,checker} OR admin",
+// OR binds weaker than AND and a bare attribute name requires the attribute to be true.
+func ParseGuard(expr string) (Guard, error) {
+	var alternatives []Guard
+	for _, term := range strings.Split(expr, " OR ") {
+		var conditions []Guard
+		for _, factor := range strings.Split(term, " AND ") {
+			guard, err := parseCondition(strings.TrimSpace(factor))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid guard %q: %s", expr, err.Error())
+			}
+			conditions = append(conditions, guard)
+		}
+		alternatives = append(alternatives, AllOf(conditions...))
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return AnyOf(alternatives...), nil
+}
+
+func parseCondition(condition string) (Guard, error) {
+	if match := attrInPattern.FindStringSubmatch(condition); match != nil {
+		values := strings.Split(match[2], ",")
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+			if values[i] == "" {
+				return nil, errors.New("empty value in " + condition)
+			}
+		}
+		return checkAttrName(match[1], AttrIn(match[1], values...))
+	}
+	if parts := strings.SplitN(condition, "=", 2); len(parts) == 2 {
+		name := strings.TrimSpace(parts[0])
+		return checkAttrName(name, AttrEquals(name, strings.TrimSpace(parts[1])))
+	}
+	return checkAttrName(condition, AttrTrue(condition))
+}
+
+func checkAttrName(name string, guard Guard) (Guard, error) {
+	if !attrNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%q is not an attribute name", name)
+	}
+	return guard, nil
+}
+
+// checkGuard - return an error unless the caller satisfies the guard configured for function
+func checkGuard(stub shim.ChaincodeStubInterface, config *Config, function string) error {
+	expr, ok := config.Guards[function]
+	if !ok {
+		return nil
+	}
+	guard, err := ParseGuard(expr)
+	if err != nil {
+		return err
+	}
+
+	caller, err := newCaller(stub)
+	if err == nil {
+		err = guard.Check(caller)
+	}
+	if err != nil {
+		return fmt.Errorf("Access denied to %s, requires %s: %s", function, expr, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package identity decodes the creator of a transaction, the msp.SerializedIdentity
+// returned by GetCreator, into the fields chaincode functions need.
+package identity
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// Identity types
+const (
+	TypeX509   = "X.509"
+	TypeIdemix = "idemix"
+)
+
+// ErrNoCreator is returned for a transaction without creator, e.g. in a MockStub
+var ErrNoCreator = errors.New("The transaction has no creator")
+
+// Identity is a decoded transaction creator. Idemix identities are anonymous,
+// they only have an MSP ID, OUs and the role attribute.
+type Identity struct {
+	MSPID        string            `json:"mspId"`
+	Type         string            `json:"type"`
+	CommonName   string            `json:"commonName,omitempty"`
+	SubjectDN    string            `json:"subjectDN,omitempty"`
+	IssuerDN     string            `json:"issuerDN,omitempty"`
+	SerialNumber string            `json:"serialNumber,omitempty"`
+	OUs          []string          `json:"ous"`
+	NotBefore    *time.Time        `json:"notBefore,omitempty"`
+	NotAfter     *time.Time        `json:"notAfter,omitempty"`
+	Attributes   map[string]string `json:"attributes"`
+	// Certificate is nil for an idemix identity
+	Certificate *x509.Certificate `json:"-"`
+}
+
+// CreatorGetter is the part of shim.ChaincodeStubInterface this package uses
+type CreatorGetter interface {
+	GetCreator() ([]byte, error)
+}
+
+// New decodes the creator of the transaction of stub
+func New(stub CreatorGetter) (*Identity, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transaction creator: %s", err.Error())
+	}
+	return Parse(creator)
+}
+
+// Parse decodes a serialized identity, IdBytes must be a PEM encoded X.509
+// certificate or a serialized idemix identity
+func Parse(creator []byte) (*Identity, error) {
+	if len(creator) == 0 {
+		return nil, ErrNoCreator
+	}
+	serializedID := &msp.SerializedIdentity{}
+	err := proto.Unmarshal(creator, serializedID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal creator identity: %s", err.Error())
+	}
+	if len(serializedID.IdBytes) == 0 {
+		return nil, fmt.Errorf("Creator identity of %s is empty", serializedID.Mspid)
+	}
+
+	block, _ := pem.Decode(serializedID.IdBytes)
+	if block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Creator identity of %s is a PEM %s, expecting a CERTIFICATE", serializedID.Mspid, block.Type)
+		}
+		return parseX509(serializedID.Mspid, block.Bytes)
+	}
+
+	idemixID := &msp.SerializedIdemixIdentity{}
+	err = proto.Unmarshal(serializedID.IdBytes, idemixID)
+	if err == nil && len(idemixID.NymX) > 0 && len(idemixID.NymY) > 0 && len(idemixID.Proof) > 0 {
+		return parseIdemix(serializedID.Mspid, idemixID)
+	}
+	return nil, fmt.Errorf("Creator identity of %s is neither an X.509 certificate nor an idemix identity", serializedID.Mspid)
+}
+
+func parseX509(mspID string, der []byte) (*Identity, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse creator certificate: %s", err.Error())
+	}
+	attrs, err := attrmgr.New().GetAttributesFromCert(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get attributes of creator certificate: %s", err.Error())
+	}
+
+	id := &Identity{
+		MSPID:        mspID,
+		Type:         TypeX509,
+		CommonName:   cert.Subject.CommonName,
+		SubjectDN:    cert.Subject.String(),
+		IssuerDN:     cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		OUs:          append([]string{}, cert.Subject.OrganizationalUnit...),
+		NotBefore:    &cert.NotBefore,
+		NotAfter:     &cert.NotAfter,
+		Attributes:   make(map[string]string),
+		Certificate:  cert,
+	}
+	for name, value := range attrs.Attrs {
+		id.Attributes[name] = value
+	}
+	return id, nil
+}
+
+func parseIdemix(mspID string, idemixID *msp.SerializedIdemixIdentity) (*Identity, error) {
+	id := &Identity{
+		MSPID:      mspID,
+		Type:       TypeIdemix,
+		OUs:        []string{},
+		Attributes: make(map[string]string),
+	}
+	if len(idemixID.Ou) > 0 {
+		ou := &common.OrganizationUnit{}
+		err := proto.Unmarshal(idemixID.Ou, ou)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal idemix OU: %s", err.Error())
+		}
+		id.OUs = append(id.OUs, ou.OrganizationalUnitIdentifier)
+	}
+	if len(idemixID.Role) > 0 {
+		role := &common.MSPRole{}
+		err := proto.Unmarshal(idemixID.Role, role)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal idemix role: %s", err.Error())
+		}
+		id.Attributes["role"] = role.Role.String()
+	}
+	return id, nil
+}
+
+// Roles in the order Role prefers them, they are the NodeOU identifiers of an MSP
+var roles = []string{"admin", "orderer", "peer", "client"}
+
+// Role is the NodeOU role of an X.509 identity or the MSP role of an idemix identity,
+// lower case, e.g. "client" or "admin". It is empty if the MSP does not use NodeOUs.
+func (id *Identity) Role() string {
+	if id.Type == TypeIdemix {
+		return strings.ToLower(id.Attributes["role"])
+	}
+	for _, role := range roles {
+		for _, ou := range id.OUs {
+			if strings.EqualFold(ou, role) {
+				return role
+			}
+		}
+	}
+	return ""
+}
+
+// Name is "mspID.commonName", an idemix identity is only named by its MSP
+func (id *Identity) Name() string {
+	if id.CommonName == "" {
+		return id.MSPID
+	}
+	return id.MSPID + "." + id.CommonName
+}
+
+// ValidAt reports whether the certificate is valid at t, idemix identities have no validity period
+func (id *Identity) ValidAt(t time.Time) bool {
+	if id.Certificate == nil {
+		return true
+	}
+	return !t.Before(id.Certificate.NotBefore) && !t.After(id.Certificate.NotAfter)
+}
@@ -0,0 +1,169 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+type creatorStub struct {
+	creator []byte
+	err     error
+}
+
+func (s *creatorStub) GetCreator() ([]byte, error) {
+	return s.creator, s.err
+}
+
+// issuePEM - a self-signed certificate with attributes
+func issuePEM(t *testing.T, template *x509.Certificate, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	if attrs != nil {
+		err = attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: attrs}, template)
+		if err != nil {
+			t.Fatalf("Failed to add attributes: %s", err)
+		}
+		template.ExtraExtensions = template.Extensions
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func serialize(t *testing.T, mspID string, idBytes []byte) []byte {
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	if err != nil {
+		t.Fatalf("Failed to marshal identity: %s", err)
+	}
+	return creator
+}
+
+func marshal(t *testing.T, m proto.Message) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal %T: %s", m, err)
+	}
+	return b
+}
+
+func TestParseX509(t *testing.T) {
+	notBefore := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)
+	certPEM := issuePEM(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4711),
+		Subject:      pkix.Name{CommonName: "user1", Organization: []string{"Org1"}, OrganizationalUnit: []string{"client", "dept1"}},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}, map[string]string{"role": "maker", "hf.EnrollmentID": "user1"})
+
+	// the MSP ID holds characters of "-----BEGIN", which confused the old certificate search
+	id, err := Parse(serialize(t, "BIG-Org1MSP", certPEM))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	// a multi-valued RDN is a DER SET, sorted by encoding
+	want := Identity{
+		MSPID:        "BIG-Org1MSP",
+		Type:         TypeX509,
+		CommonName:   "user1",
+		SubjectDN:    "CN=user1,OU=dept1+OU=client,O=Org1",
+		IssuerDN:     "CN=user1,OU=dept1+OU=client,O=Org1",
+		SerialNumber: "4711",
+		OUs:          []string{"dept1", "client"},
+		Attributes:   map[string]string{"role": "maker", "hf.EnrollmentID": "user1"},
+	}
+	got := *id
+	if !got.NotBefore.Equal(notBefore) || !got.NotAfter.Equal(notAfter) {
+		t.Errorf("Parse returned validity %s - %s, want: %s - %s", got.NotBefore, got.NotAfter, notBefore, notAfter)
+	}
+	if got.Certificate == nil {
+		t.Errorf("Parse did not return the certificate")
+	}
+	got.NotBefore, got.NotAfter, got.Certificate = nil, nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse returned %+v, want: %+v", got, want)
+	}
+	if id.Role() != "client" {
+		t.Errorf("Role returned %q, want: client", id.Role())
+	}
+	if id.Name() != "BIG-Org1MSP.user1" {
+		t.Errorf("Name returned %s", id.Name())
+	}
+	if !id.ValidAt(notBefore) || id.ValidAt(notAfter.Add(time.Second)) {
+		t.Errorf("ValidAt does not follow the certificate validity")
+	}
+}
+
+func TestParseIdemix(t *testing.T) {
+	idemixID := &msp.SerializedIdemixIdentity{
+		NymX:  []byte{1, 2, 3},
+		NymY:  []byte{4, 5, 6},
+		Ou:    marshal(t, &common.OrganizationUnit{MspIdentifier: "IdemixOrg", OrganizationalUnitIdentifier: "dept1"}),
+		Role:  marshal(t, &common.MSPRole{MspIdentifier: "IdemixOrg", Role: common.MSPRole_CLIENT}),
+		Proof: []byte{7, 8, 9},
+	}
+	id, err := Parse(serialize(t, "IdemixOrg", marshal(t, idemixID)))
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	want := &Identity{
+		MSPID:      "IdemixOrg",
+		Type:       TypeIdemix,
+		OUs:        []string{"dept1"},
+		Attributes: map[string]string{"role": "CLIENT"},
+	}
+	if !reflect.DeepEqual(id, want) {
+		t.Errorf("Parse returned %+v, want: %+v", id, want)
+	}
+	if id.Name() != "IdemixOrg" || id.Role() != "client" || !id.ValidAt(time.Now()) {
+		t.Errorf("Idemix identity has name %s, role %s, valid: %t", id.Name(), id.Role(), id.ValidAt(time.Now()))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}})
+	badCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not DER")})
+	tests := []struct {
+		name    string
+		creator []byte
+		message string
+	}{
+		{"no creator", nil, ErrNoCreator.Error()},
+		{"not a serialized identity", []byte{0xff, 0xff}, "Failed to unmarshal creator identity"},
+		{"empty identity", serialize(t, "Org1MSP", nil), "Creator identity of Org1MSP is empty"},
+		{"public key", serialize(t, "Org1MSP", keyPEM), "Creator identity of Org1MSP is a PEM PUBLIC KEY, expecting a CERTIFICATE"},
+		{"invalid certificate", serialize(t, "Org1MSP", badCertPEM), "Failed to parse creator certificate"},
+		{"text", serialize(t, "Org1MSP", []byte("-----BEGIN nothing")), "Creator identity of Org1MSP is neither an X.509 certificate nor an idemix identity"},
+		{"incomplete idemix", serialize(t, "Org1MSP", marshal(t, &msp.SerializedIdemixIdentity{NymX: []byte{1}})), "Creator identity of Org1MSP is neither an X.509 certificate nor an idemix identity"},
+	}
+	for _, tt := range tests {
+		id, err := Parse(tt.creator)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.message) {
+			t.Errorf("%s: Parse returned %+v, %v, want error: %s", tt.name, id, err, tt.message)
+		}
+	}
+
+	_, err := New(&creatorStub{err: errors.New("no proposal")})
+	if err == nil || err.Error() != "Failed to get transaction creator: no proposal" {
+		t.Errorf("New returned wrong error: %v", err)
+	}
+}
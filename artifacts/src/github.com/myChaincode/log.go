@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// LogLevelEnv names the environment variable of the log level, it overrides Config.LogLevel
+// so a peer can be made verbose without a transaction
+const LogLevelEnv = "MYCHAINCODE_LOG_LEVEL"
+
+// logger is the chaincode logger, Init and Invoke set its level, see setLogLevel
+var logger = shim.NewLogger("myChaincode")
+
+// writeLog sends a formatted line to the logger, tests replace it to inspect the lines
+var writeLog = func(level shim.LoggingLevel, line string) {
+	switch level {
+	case shim.LogDebug:
+		logger.Debug(line)
+	case shim.LogInfo:
+		logger.Info(line)
+	case shim.LogNotice:
+		logger.Notice(line)
+	case shim.LogWarning:
+		logger.Warning(line)
+	default:
+		logger.Error(line)
+	}
+}
+
+// privateDataFunctions handle collection contents, their error messages may quote them
+var privateDataFunctions = map[string]bool{
+	"putPrivateData": true,
+	"getPrivateData": true,
+}
+
+// setLogLevel - the level of LogLevelEnv, otherwise of the config
+func setLogLevel(config *Config) {
+	levelString := config.LogLevel
+	if env := os.Getenv(LogLevelEnv); env != "" {
+		levelString = env
+	}
+	level, err := shim.LogLevel(levelString)
+	if err != nil {
+		logger.Warningf("Invalid log level %q, logging at INFO", levelString)
+		level = shim.LogInfo
+	}
+	logger.SetLevel(level)
+}
+
+// txLog writes structured lines: the message, the transaction id and the function
+// of the stub, then the key value pairs of the call site
+type txLog struct {
+	txID     string
+	function string
+}
+
+func newTxLog(stub shim.ChaincodeStubInterface) *txLog {
+	function, _ := stub.GetFunctionAndParameters()
+	return &txLog{txID: stub.GetTxID(), function: function}
+}
+
+func (l *txLog) Debug(msg string, keyvals ...interface{})   { l.log(shim.LogDebug, msg, keyvals) }
+func (l *txLog) Info(msg string, keyvals ...interface{})    { l.log(shim.LogInfo, msg, keyvals) }
+func (l *txLog) Warning(msg string, keyvals ...interface{}) { l.log(shim.LogWarning, msg, keyvals) }
+func (l *txLog) Error(msg string, keyvals ...interface{})   { l.log(shim.LogError, msg, keyvals) }
+
+func (l *txLog) log(level shim.LoggingLevel, msg string, keyvals []interface{}) {
+	if !logger.IsEnabledFor(level) {
+		return
+	}
+	writeLog(level, formatLogLine(msg, append([]interface{}{"txId", l.txID, "function", l.function}, keyvals...)))
+}
+
+// logResponse - the outcome of a call, payloads are never written
+func logResponse(log *txLog, response peer.Response) {
+	if response.Status < shim.ERRORTHRESHOLD {
+		log.Debug("invoke succeeded", "status", response.Status, "size", len(response.Payload))
+		return
+	}
+	var message interface{} = response.Message
+	if privateDataFunctions[log.function] {
+		message = redacted(response.Message)
+	}
+	log.Warning("invoke failed", "status", response.Status, "error", message)
+}
+
+// formatLogLine - msg="..." key=value ..., values with spaces, quotes or = are quoted
+func formatLogLine(msg string, keyvals []interface{}) string {
+	var line bytes.Buffer
+	line.WriteString("msg=" + strconv.Quote(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		value := "<missing>"
+		if i+1 < len(keyvals) {
+			value = fmt.Sprint(keyvals[i+1])
+		}
+		if value == "" || strings.ContainsAny(value, " \"=\n\t") {
+			value = strconv.Quote(value)
+		}
+		line.WriteString(fmt.Sprintf(" %v=%s", keyvals[i], value))
+	}
+	return line.String()
+}
+
+// redacted stands for a private value in a log line, only its size is written
+type redacted []byte
+
+func (r redacted) String() string {
+	return fmt.Sprintf("<redacted %d bytes>", len(r))
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// mangoQuery is the subset of a CouchDB Mango query understood by TestStub:
+// $eq $ne $gt $gte $lt $lte $in $nin $exists $regex $not $size $elemMatch on fields,
+// $and $or $nor on selectors, nested and dotted fields, sort, fields, limit, skip and bookmark.
+type mangoQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Sort     []interface{}          `json:"sort"`
+	Fields   []string               `json:"fields"`
+	Limit    int                    `json:"limit"`
+	Skip     int                    `json:"skip"`
+	Bookmark string                 `json:"bookmark"`
+}
+
+type mangoDoc struct {
+	key   string
+	value map[string]interface{}
+}
+
+// runMangoQuery - evaluate query against the JSON objects in state, pageSize and bookmark
+// override the limit and bookmark of the query when set
+func runMangoQuery(state map[string][]byte, query string, pageSize int, bookmark string) ([]*queryresult.KV, string, error) {
+	q := &mangoQuery{}
+	err := json.Unmarshal([]byte(query), q)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid query %s: %s", query, err)
+	}
+	if q.Selector == nil {
+		return nil, "", fmt.Errorf("query has no selector: %s", query)
+	}
+
+	// documents are scanned in _id order, as CouchDB does without a sort
+	docs := []mangoDoc{}
+	// composite keys are documents too, index entries are not JSON so only their _id is stored
+	for _, key := range sortedKeys(state) {
+		var value map[string]interface{}
+		if json.Unmarshal(state[key], &value) != nil {
+			// not a JSON object, CouchDB stores it as an attachment that selectors never match
+			continue
+		}
+		ok, err := matchSelector(q.Selector, value)
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			docs = append(docs, mangoDoc{key, value})
+		}
+	}
+
+	err = sortDocs(docs, q.Sort)
+	if err != nil {
+		return nil, "", err
+	}
+
+	offset := q.Skip
+	if bookmark == "" {
+		bookmark = q.Bookmark
+	}
+	if bookmark != "" {
+		offset, err = decodeBookmark(bookmark)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	limit := q.Limit
+	if pageSize > 0 {
+		limit = pageSize
+	}
+	if offset > len(docs) {
+		offset = len(docs)
+	}
+	end := len(docs)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	results := []*queryresult.KV{}
+	for _, doc := range docs[offset:end] {
+		value := doc.value
+		if len(q.Fields) > 0 {
+			value = projectFields(value, q.Fields)
+		}
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, "", err
+		}
+		results = append(results, &queryresult.KV{Key: doc.key, Value: valueBytes})
+	}
+	return results, encodeBookmark(end), nil
+}
+
+// matchSelector - every entry of the selector must match the document
+func matchSelector(selector map[string]interface{}, doc interface{}) (bool, error) {
+	for field, cond := range selector {
+		var ok bool
+		var err error
+		switch field {
+		case "$and", "$or", "$nor":
+			ok, err = matchCombination(field, cond, func(sub interface{}) (bool, error) {
+				subSelector, isMap := sub.(map[string]interface{})
+				if !isMap {
+					return false, fmt.Errorf("%s expects an array of selectors", field)
+				}
+				return matchSelector(subSelector, doc)
+			})
+		default:
+			if strings.HasPrefix(field, "$") {
+				return false, fmt.Errorf("unsupported selector operator %s", field)
+			}
+			value, exists := lookupField(doc, field)
+			ok, err = matchCondition(value, exists, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchCondition - match a field value against a literal (implicit $eq), an operator object
+// or a nested selector
+func matchCondition(value interface{}, exists bool, cond interface{}) (bool, error) {
+	condMap, isMap := cond.(map[string]interface{})
+	if !isMap || len(condMap) == 0 {
+		return exists && compareJSON(value, cond) == 0, nil
+	}
+	for key, arg := range condMap {
+		var ok bool
+		var err error
+		if strings.HasPrefix(key, "$") {
+			ok, err = matchOperator(value, exists, key, arg)
+		} else {
+			sub, subExists := lookupField(value, key)
+			ok, err = matchCondition(sub, subExists, arg)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(value interface{}, exists bool, op string, arg interface{}) (bool, error) {
+	switch op {
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return false, fmt.Errorf("$exists expects a boolean")
+		}
+		return exists == want, nil
+	case "$not":
+		ok, err := matchCondition(value, exists, arg)
+		return !ok, err
+	case "$and", "$or", "$nor":
+		return matchCombination(op, arg, func(sub interface{}) (bool, error) {
+			return matchCondition(value, exists, sub)
+		})
+	}
+
+	// every other operator needs the field
+	if !exists {
+		return false, nil
+	}
+	switch op {
+	case "$eq":
+		return compareJSON(value, arg) == 0, nil
+	case "$ne":
+		return compareJSON(value, arg) != 0, nil
+	case "$gt":
+		return compareJSON(value, arg) > 0, nil
+	case "$gte":
+		return compareJSON(value, arg) >= 0, nil
+	case "$lt":
+		return compareJSON(value, arg) < 0, nil
+	case "$lte":
+		return compareJSON(value, arg) <= 0, nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", op)
+		}
+		found := inList(value, list)
+		if values, isArray := value.([]interface{}); isArray {
+			for _, v := range values {
+				found = found || inList(v, list)
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return false, fmt.Errorf("$regex expects a string")
+		}
+		str, isString := value.(string)
+		if !isString {
+			return false, nil
+		}
+		return regexp.MatchString(pattern, str)
+	case "$size":
+		size, ok := arg.(float64)
+		values, isArray := value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$size expects a number")
+		}
+		return isArray && len(values) == int(size), nil
+	case "$elemMatch":
+		values, isArray := value.([]interface{})
+		if !isArray {
+			return false, nil
+		}
+		for _, v := range values {
+			ok, err := matchCondition(v, true, arg)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported operator %s", op)
+}
+
+// matchCombination - evaluate $and, $or and $nor over an array of sub conditions
+func matchCombination(op string, arg interface{}, match func(interface{}) (bool, error)) (bool, error) {
+	subs, ok := arg.([]interface{})
+	if !ok {
+		return false, fmt.Errorf("%s expects an array", op)
+	}
+	matched := 0
+	for _, sub := range subs {
+		ok, err := match(sub)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	switch op {
+	case "$and":
+		return matched == len(subs), nil
+	case "$or":
+		return matched > 0, nil
+	default:
+		return matched == 0, nil
+	}
+}
+
+func inList(value interface{}, list []interface{}) bool {
+	for _, item := range list {
+		if compareJSON(value, item) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupField - resolve a dotted field path in a decoded JSON document
+func lookupField(doc interface{}, path string) (interface{}, bool) {
+	value := doc
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// compareJSON - CouchDB collation: null < false < true < numbers < strings < arrays < objects
+func compareJSON(a interface{}, b interface{}) int {
+	rankA, rankB := jsonRank(a), jsonRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+	switch va := a.(type) {
+	case bool:
+		vb := b.(bool)
+		if va == vb {
+			return 0
+		} else if !va {
+			return -1
+		}
+		return 1
+	case float64:
+		vb := b.(float64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(va, b.(string))
+	case []interface{}:
+		vb := b.([]interface{})
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			if c := compareJSON(va[i], vb[i]); c != 0 {
+				return c
+			}
+		}
+		return len(va) - len(vb)
+	case map[string]interface{}:
+		if reflect.DeepEqual(a, b) {
+			return 0
+		}
+		aBytes, _ := json.Marshal(a)
+		bBytes, _ := json.Marshal(b)
+		return strings.Compare(string(aBytes), string(bBytes))
+	}
+	return 0
+}
+
+func jsonRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	}
+	return 5
+}
+
+// sortDocs - apply a Mango sort, e.g. ["name", {"timeStamp": "desc"}]
+func sortDocs(docs []mangoDoc, sortSpec []interface{}) error {
+	type sortField struct {
+		path string
+		desc bool
+	}
+	fields := []sortField{}
+	for _, spec := range sortSpec {
+		switch s := spec.(type) {
+		case string:
+			fields = append(fields, sortField{path: s})
+		case map[string]interface{}:
+			for path, dir := range s {
+				if dir != "asc" && dir != "desc" {
+					return fmt.Errorf("invalid sort direction %v for %s", dir, path)
+				}
+				fields = append(fields, sortField{path: path, desc: dir == "desc"})
+			}
+		default:
+			return fmt.Errorf("invalid sort %v", spec)
+		}
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range fields {
+			a, _ := lookupField(docs[i].value, field.path)
+			b, _ := lookupField(docs[j].value, field.path)
+			c := compareJSON(a, b)
+			if c == 0 {
+				continue
+			}
+			if field.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+// projectFields - keep only the listed fields of a document
+func projectFields(doc map[string]interface{}, fields []string) map[string]interface{} {
+	projected := map[string]interface{}{}
+	for _, path := range fields {
+		value, ok := lookupField(doc, path)
+		if !ok {
+			continue
+		}
+		names := strings.Split(path, ".")
+		target := projected
+		for _, name := range names[:len(names)-1] {
+			next, ok := target[name].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				target[name] = next
+			}
+			target = next
+		}
+		target[names[len(names)-1]] = value
+	}
+	return projected
+}
+
+// bookmarks are opaque to callers, here they carry the offset of the next page
+func encodeBookmark(offset int) string {
+	return base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeBookmark(bookmark string) (int, error) {
+	offsetBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bookmark %s", bookmark)
+	}
+	offset, err := strconv.Atoi(string(offsetBytes))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid bookmark %s", bookmark)
+	}
+	return offset, nil
+}
+
+func TestMangoPagination(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	for _, id := range []string{"001", "002", "003", "004", "005"} {
+		createAsset(t, stub, DemoAsset{id, "test" + id, "food", "cathy", true, "2018-05-25", 1502688979, 1})
+	}
+
+	query := `{"selector": {"owner": "cathy"}, "sort": [{"id": "desc"}], "fields": ["id"]}`
+	keys := []string{}
+	bookmark := ""
+	for page := 0; page < 3; page++ {
+		iter, metadata, err := stub.GetQueryResultWithPagination(query, 2, bookmark)
+		if err != nil {
+			t.Fatalf("Paginated query failed: %s", err)
+		}
+		for iter.HasNext() {
+			kv, _ := iter.Next()
+			keys = append(keys, kv.Key)
+			if string(kv.Value) != `{"id":"`+kv.Key+`"}` {
+				t.Errorf("Fields projection failed, got: %s", kv.Value)
+			}
+		}
+		if int(metadata.FetchedRecordsCount) != len(keys)-2*page {
+			t.Errorf("Wrong fetched records count on page %d: %d", page, metadata.FetchedRecordsCount)
+		}
+		bookmark = metadata.Bookmark
+	}
+	if strings.Join(keys, ",") != "005,004,003,002,001" {
+		t.Errorf("Paginated query returned wrong keys, got: %v", keys)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// SchemaIndex is the composite key object type of the schema status
+const SchemaIndex = "Schema~Status"
+
+// MigrationBatchSize is the default number of records a transaction migrates
+const MigrationBatchSize = 100
+
+// Migration upgrades the ledger data to Version. Run handles at most limit records after cursor
+// and returns the cursor to resume from in the next transaction, "" once the step is complete.
+// Asset functions keep working while a migration is pending, so steps must be idempotent.
+type Migration struct {
+	Version     int
+	Description string
+	Run         func(stub shim.ChaincodeStubInterface, cursor string, limit int) (string, error)
+}
+
+// migrations are run in Version order, append new steps with the next version
+var migrations = []Migration{
+	{1, "rewrite assets in the current DemoAsset format", rewriteAssets},
+	{2, "rebuild DemoAsset~Type and DemoAsset~Owner indexes", rebuildAssetIndexes},
+	{3, "number the versions of assets written before versions", versionAssets},
+}
+
+// SchemaStatus is the migration state of the ledger
+type SchemaStatus struct {
+	// Version is the last completed migration, Target the latest registered one
+	Version int `json:"version"`
+	Target  int `json:"target"`
+	// Next describes the pending migration, Cursor is where it resumes
+	Next   string `json:"next,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	TxID   string `json:"txId"`
+}
+
+// ===============================================
+// migrate - continue pending migrations, Init runs them on instantiate and upgrade
+// args: [limit], the number of records to migrate in this transaction
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"migrate","args":["100"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	limit := MigrationBatchSize
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: limit")
+	} else if len(args) == 1 {
+		var err error
+		limit, err = strconv.Atoi(args[0])
+		if err != nil || limit <= 0 {
+			return shim.Error("1st argument must be a positive integer")
+		}
+	}
+
+	status, err := runMigrations(stub, limit)
+	if err != nil {
+		return shim.Error("Migration failed: " + err.Error())
+	}
+	statusJSONasBytes, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusJSONasBytes)
+}
+
+// ===============================================
+// getSchemaStatus - get the schema version and the pending migration
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getSchemaStatus","args":[],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getSchemaStatus(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	status, err := getSchemaStatus(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	statusJSONasBytes, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusJSONasBytes)
+}
+
+// runMigrations - run pending migrations until one needs another transaction
+func runMigrations(stub shim.ChaincodeStubInterface, limit int) (*SchemaStatus, error) {
+	status, err := getSchemaStatus(stub)
+	if err != nil {
+		return nil, err
+	}
+	if status.Version > status.Target {
+		return nil, fmt.Errorf("Ledger schema version %d is newer than this chaincode (%d)", status.Version, status.Target)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, migration := range sortedMigrations() {
+		if migration.Version <= status.Version {
+			continue
+		}
+		newTxLog(stub).Info("migrate", "version", migration.Version, "description", migration.Description, "cursor", status.Cursor)
+		var cursor string
+		if config.Tenancy {
+			cursor, err = runInTenants(stub, config, migration.Run, status.Cursor, limit)
+		} else {
+			cursor, err = migration.Run(stub, status.Cursor, limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("version %d (%s): %s", migration.Version, migration.Description, err.Error())
+		}
+		status.Cursor = cursor
+		if cursor != "" {
+			break
+		}
+		status.Version = migration.Version
+	}
+
+	status.TxID = stub.GetTxID()
+	err = putSchemaStatus(stub, status)
+	if err != nil {
+		return nil, err
+	}
+	return describeSchemaStatus(status), nil
+}
+
+func getSchemaStatus(stub shim.ChaincodeStubInterface) (*SchemaStatus, error) {
+	key, err := stub.CreateCompositeKey(SchemaIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	statusBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get schema status: %s", err.Error())
+	}
+
+	// a ledger without status predates migrations
+	status := &SchemaStatus{}
+	if statusBytes != nil {
+		err = json.Unmarshal(statusBytes, status)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal schema status: %s", err.Error())
+		}
+	}
+	return describeSchemaStatus(status), nil
+}
+
+func putSchemaStatus(stub shim.ChaincodeStubInterface, status *SchemaStatus) error {
+	key, err := stub.CreateCompositeKey(SchemaIndex, []string{})
+	if err != nil {
+		return err
+	}
+	statusJSONasBytes, err := json.Marshal(SchemaStatus{Version: status.Version, Cursor: status.Cursor, TxID: status.TxID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, statusJSONasBytes)
+}
+
+// describeSchemaStatus - fill in the fields that depend on the registered migrations
+func describeSchemaStatus(status *SchemaStatus) *SchemaStatus {
+	status.Target, status.Next = 0, ""
+	for _, migration := range sortedMigrations() {
+		status.Target = migration.Version
+		if status.Next == "" && migration.Version > status.Version {
+			status.Next = migration.Description
+		}
+	}
+	return status
+}
+
+func sortedMigrations() []Migration {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// ===============================================
+// forEachAsset - call fn for at most limit assets after cursor, returns the cursor to resume from
+// ===============================================
+func forEachAsset(stub shim.ChaincodeStubInterface, cursor string, limit int, fn func(key string, assetBytes []byte) error) (string, error) {
+	startKey := ""
+	if cursor != "" {
+		// the smallest key after the cursor
+		startKey = cursor + "\x00"
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "")
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		if count == limit {
+			return cursor, nil
+		}
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		err = fn(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return "", fmt.Errorf("asset %s: %s", queryResponse.Key, err.Error())
+		}
+		cursor = queryResponse.Key
+		count++
+	}
+	return "", nil
+}
+
+// rewriteAssets - fields added to DemoAsset get their zero value in records written by older versions
+func rewriteAssets(stub shim.ChaincodeStubInterface, cursor string, limit int) (string, error) {
+	return forEachAsset(stub, cursor, limit, func(key string, assetBytes []byte) error {
+		demoAsset := &DemoAsset{}
+		err := json.Unmarshal(assetBytes, demoAsset)
+		if err != nil {
+			return err
+		}
+		assetJSONasBytes, err := json.Marshal(demoAsset)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(assetJSONasBytes, assetBytes) {
+			return nil
+		}
+		return stub.PutState(key, assetJSONasBytes)
+	})
+}
+
+// versionAssets - assets written before versions are at version 0, they start at 1 as new assets do
+func versionAssets(stub shim.ChaincodeStubInterface, cursor string, limit int) (string, error) {
+	return forEachAsset(stub, cursor, limit, func(key string, assetBytes []byte) error {
+		demoAsset := &DemoAsset{}
+		err := json.Unmarshal(assetBytes, demoAsset)
+		if err != nil || demoAsset.Version != 0 {
+			return err
+		}
+		demoAsset.Version = 1
+		assetJSONasBytes, err := json.Marshal(demoAsset)
+		if err != nil {
+			return err
+		}
+		return stub.PutState(key, assetJSONasBytes)
+	})
+}
+
+// rebuildAssetIndexes - index every asset, then drop the index entries that do not match an asset,
+// updateAsset before v1.8 did not move the indexes of a changed type or owner.
+// The cursor is "asset:<id>" while indexing and "index:<composite key>" while cleaning up.
+func rebuildAssetIndexes(stub shim.ChaincodeStubInterface, cursor string, limit int) (string, error) {
+	const assetPhase, indexPhase = "asset:", "index:"
+
+	if !strings.HasPrefix(cursor, indexPhase) {
+		next, err := forEachAsset(stub, strings.TrimPrefix(cursor, assetPhase), limit, func(key string, assetBytes []byte) error {
+			demoAsset := &DemoAsset{}
+			err := json.Unmarshal(assetBytes, demoAsset)
+			if err != nil {
+				return err
+			}
+			return createIndexHelper(stub, demoAsset)
+		})
+		if err != nil || next != "" {
+			return assetPhase + next, err
+		}
+		cursor = indexPhase
+	}
+	cursor = strings.TrimPrefix(cursor, indexPhase)
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	queryKeys := make([]string, 0, len(config.AssetIndexes))
+	for queryKey := range config.AssetIndexes {
+		queryKeys = append(queryKeys, queryKey)
+	}
+	sort.Slice(queryKeys, func(i, j int) bool { return config.AssetIndexes[queryKeys[i]] < config.AssetIndexes[queryKeys[j]] })
+
+	count := 0
+	for _, queryKey := range queryKeys {
+		more, err := cleanIndex(stub, queryKey, config.AssetIndexes[queryKey], &cursor, limit, &count)
+		if err != nil {
+			return "", err
+		} else if more {
+			return indexPhase + cursor, nil
+		}
+	}
+	return "", nil
+}
+
+// cleanIndex - delete the stale entries of an index after cursor, it returns true when the limit
+// was reached before the end of the index. cursor and count are shared across indexes.
+func cleanIndex(stub shim.ChaincodeStubInterface, queryKey string, indexName string, cursor *string, limit int, count *int) (bool, error) {
+	if *cursor != "" {
+		objectType, components, err := stub.SplitCompositeKey(*cursor)
+		if err != nil {
+			return false, err
+		}
+		if objectType > indexName {
+			// cleaned up by an earlier transaction
+			return false, nil
+		}
+		if objectType == indexName && len(components) > 0 {
+			// composite keys can only be queried by whole attributes, so first finish
+			// the entries of the cursor's type or owner, then go on with the rest of the index
+			more, err := cleanIndexEntries(stub, queryKey, indexName, components[:1], cursor, limit, count)
+			if err != nil || more {
+				return more, err
+			}
+		}
+	}
+	return cleanIndexEntries(stub, queryKey, indexName, []string{}, cursor, limit, count)
+}
+
+// cleanIndexEntries - delete the stale entries of an index that start with attributes and sort after cursor
+func cleanIndexEntries(stub shim.ChaincodeStubInterface, queryKey string, indexName string, attributes []string, cursor *string, limit int, count *int) (bool, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+
+	more := false
+	staleKeys := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return false, err
+		}
+		if queryResponse.Key <= *cursor {
+			continue
+		}
+		if *count == limit {
+			more = true
+			break
+		}
+		*count++
+		*cursor = queryResponse.Key
+
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return false, err
+		}
+		//Components should be type or owner, id
+		stale := len(components) < 2
+		if !stale {
+			stale, err = isStaleIndexEntry(stub, queryKey, components[0], components[1])
+			if err != nil {
+				return false, err
+			}
+		}
+		if stale {
+			staleKeys = append(staleKeys, queryResponse.Key)
+		}
+	}
+
+	// delete after iterating, the mock iterator stops at a deleted key
+	for _, key := range staleKeys {
+		err = stub.DelState(key)
+		if err != nil {
+			return false, err
+		}
+	}
+	return more, nil
+}
+
+// isStaleIndexEntry - an entry is stale when its asset was deleted or no longer has the indexed type or owner,
+// an asset that cannot be read is an error, not a reason to drop its entry
+func isStaleIndexEntry(stub shim.ChaincodeStubInterface, queryKey string, value string, id string) (bool, error) {
+	assetBytes, err := stub.GetState(id)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get asset %s: %s", id, err.Error())
+	} else if assetBytes == nil {
+		return true, nil
+	}
+	demoAsset := &DemoAsset{}
+	err = json.Unmarshal(assetBytes, demoAsset)
+	if err != nil {
+		return false, fmt.Errorf("Failed to unmarshal asset %s: %s", id, err.Error())
+	}
+	return (queryKey == "AssetType" && demoAsset.Type != value) ||
+		(queryKey == "AssetOwner" && demoAsset.Owner != value), nil
+}
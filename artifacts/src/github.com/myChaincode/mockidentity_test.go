@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// TestCA is a throwaway certificate authority issuing identities for tests
+type TestCA struct {
+	MSPID  string
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+	serial int64
+}
+
+// TestIdentity describes a certificate issued by a TestCA
+type TestIdentity struct {
+	CommonName string
+	// OUs of the subject, e.g. "client", "peer" or "admin" with NodeOUs enabled
+	OUs []string
+	// Attrs are Fabric CA attributes, e.g. "hf.Type" or "role"
+	Attrs    map[string]string
+	NotAfter time.Time
+}
+
+// NewTestCA creates a CA for the given MSP with a fresh key
+func NewTestCA(t *testing.T, mspID string) *TestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca." + mspID, Organization: []string{mspID}},
+		NotBefore:             time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2038, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %s", err)
+	}
+	return &TestCA{MSPID: mspID, key: key, cert: cert, serial: 1}
+}
+
+// IssuePEM returns a PEM encoded certificate for the identity
+func (ca *TestCA) IssuePEM(t *testing.T, identity TestIdentity) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	notAfter := identity.NotAfter
+	if notAfter.IsZero() {
+		notAfter = time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject: pkix.Name{
+			CommonName:         identity.CommonName,
+			Organization:       []string{ca.MSPID},
+			OrganizationalUnit: identity.OUs,
+		},
+		NotBefore: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:  notAfter,
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+	if identity.Attrs != nil {
+		// attrmgr adds the extension to Extensions, certificates are created from ExtraExtensions
+		err = attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: identity.Attrs}, template)
+		if err != nil {
+			t.Fatalf("Failed to add attributes: %s", err)
+		}
+		template.ExtraExtensions = template.Extensions
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// Creator returns the serialized identity of a new certificate, as returned by GetCreator
+func (ca *TestCA) Creator(t *testing.T, identity TestIdentity) []byte {
+	return serializeIdentity(t, ca.MSPID, ca.IssuePEM(t, identity))
+}
+
+// serializeIdentity - marshal an msp.SerializedIdentity, idBytes need not be a certificate
+func serializeIdentity(t *testing.T, mspID string, idBytes []byte) []byte {
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	if err != nil {
+		t.Fatalf("Failed to marshal identity: %s", err)
+	}
+	return creator
+}
+
+// SetIdentity makes the stub report a new certificate of the CA as the transaction creator
+func (s *TestStub) SetIdentity(t *testing.T, ca *TestCA, identity TestIdentity) {
+	s.Creator = ca.Creator(t, identity)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// collectionDefinition is an entry of collection_definition.json
+type collectionDefinition struct {
+	Name   string `json:"name"`
+	Policy struct {
+		Identities []struct {
+			Role struct {
+				Name  string `json:"name"`
+				MspID string `json:"mspId"`
+			} `json:"role"`
+		} `json:"identities"`
+	} `json:"policy"`
+	RequiredPeerCount int  `json:"requiredPeerCount"`
+	MaxPeerCount      int  `json:"maxPeerCount"`
+	BlockToLive       int  `json:"blockToLive"`
+	MemberOnlyRead    bool `json:"memberOnlyRead"`
+	MemberOnlyWrite   bool `json:"memberOnlyWrite"`
+}
+
+// isMember - an MSP is a member if the policy names it, the policy expression itself is not evaluated
+func (c *collectionDefinition) isMember(mspID string) bool {
+	for _, identity := range c.Policy.Identities {
+		if identity.Role.MspID == mspID {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCollections defines the private data collections of the stub from a collection definition file
+func (s *TestStub) LoadCollections(t testing.TB, path string) {
+	definitionBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read collection definition: %s", err)
+	}
+	var definitions []*collectionDefinition
+	err = json.Unmarshal(definitionBytes, &definitions)
+	if err != nil {
+		t.Fatalf("Failed to parse collection definition: %s", err)
+	}
+	s.Collections = make(map[string]*collectionDefinition)
+	for _, definition := range definitions {
+		s.Collections[definition.Name] = definition
+	}
+}
+
+// GetTransient returns the transient map set by the test
+func (s *TestStub) GetTransient() (map[string][]byte, error) {
+	return s.Transient, nil
+}
+
+// GetPrivateData reads a key of a collection the peer is a member of
+func (s *TestStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	state, err := s.readableCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	return state[key], nil
+}
+
+// PutPrivateData writes a key of a collection, private data never reaches the public state
+func (s *TestStub) PutPrivateData(collection string, key string, value []byte) error {
+	if s.TxID == "" {
+		return errors.New("cannot PutPrivateData without a transactions - call stub.MockTransactionStart()?")
+	}
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if len(value) == 0 {
+		return s.DelPrivateData(collection, key)
+	}
+	state, err := s.writableCollection(collection)
+	if err != nil {
+		return err
+	}
+	state[key] = value
+	return nil
+}
+
+// DelPrivateData deletes a key of a collection
+func (s *TestStub) DelPrivateData(collection string, key string) error {
+	state, err := s.writableCollection(collection)
+	if err != nil {
+		return err
+	}
+	delete(state, key)
+	return nil
+}
+
+// GetPrivateDataByRange iterates over the keys of a collection in [startKey, endKey)
+func (s *TestStub) GetPrivateDataByRange(collection string, startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	state, err := s.readableCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(state) {
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			continue
+		}
+		if key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		results = append(results, &queryresult.KV{Key: key, Value: state[key]})
+	}
+	return newSliceIterator(results), nil
+}
+
+// GetPrivateDataByPartialCompositeKey iterates over the composite keys of a collection
+func (s *TestStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	state, err := s.readableCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(state) {
+		if strings.HasPrefix(key, prefix) {
+			results = append(results, &queryresult.KV{Key: key, Value: state[key]})
+		}
+	}
+	return newSliceIterator(results), nil
+}
+
+// GetPrivateDataQueryResult evaluates a CouchDB query against the JSON values of a collection
+func (s *TestStub) GetPrivateDataQueryResult(collection string, query string) (shim.StateQueryIteratorInterface, error) {
+	state, err := s.readableCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	results, _, err := runMangoQuery(state, query, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return newSliceIterator(results), nil
+}
+
+// readableCollection - only peers of member MSPs hold the private data of a collection
+func (s *TestStub) readableCollection(collection string) (map[string][]byte, error) {
+	definition, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	peerMSPID := s.MSPID
+	if peerMSPID == "" {
+		peerMSPID = s.creatorMSPID()
+	}
+	if !definition.isMember(peerMSPID) {
+		return nil, fmt.Errorf("peer of MSP %s is not a member of collection %s, private data is not available", peerMSPID, collection)
+	}
+	if definition.MemberOnlyRead && !definition.isMember(s.creatorMSPID()) {
+		return nil, fmt.Errorf("tx creator does not have read access permission on privatedata in chaincodeName:%s collectionName: %s", s.Name, collection)
+	}
+	return s.privateState(collection), nil
+}
+
+// writableCollection - any peer may endorse a write unless the collection is member only
+func (s *TestStub) writableCollection(collection string) (map[string][]byte, error) {
+	definition, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if definition.MemberOnlyWrite && !definition.isMember(s.creatorMSPID()) {
+		return nil, fmt.Errorf("tx creator does not have write access permission on privatedata in chaincodeName:%s collectionName: %s", s.Name, collection)
+	}
+	return s.privateState(collection), nil
+}
+
+func (s *TestStub) collection(collection string) (*collectionDefinition, error) {
+	definition, ok := s.Collections[collection]
+	if !ok {
+		return nil, fmt.Errorf("collection %s is not defined for chaincode %s", collection, s.Name)
+	}
+	return definition, nil
+}
+
+func (s *TestStub) privateState(collection string) map[string][]byte {
+	if s.PrivateState == nil {
+		s.PrivateState = make(map[string]map[string][]byte)
+	}
+	state, ok := s.PrivateState[collection]
+	if !ok {
+		state = make(map[string][]byte)
+		s.PrivateState[collection] = state
+	}
+	return state
+}
+
+// creatorMSPID - MSP ID of the identity installed with SetIdentity
+func (s *TestStub) creatorMSPID() string {
+	sid := &msp.SerializedIdentity{}
+	if s.Creator == nil || proto.Unmarshal(s.Creator, sid) != nil {
+		return ""
+	}
+	return sid.Mspid
+}
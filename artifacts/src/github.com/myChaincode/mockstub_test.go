@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// TestStub extends shim.MockStub with the ledger features the mock does not provide,
+// so that handlers relying on them can be tested offline.
+//
+// shim.MockStub.MockInvoke passes the embedded MockStub to the chaincode, which would bypass
+// the overrides below, so TestStub keeps its own arguments and drives the chaincode itself.
+type TestStub struct {
+	*shim.MockStub
+	cc   shim.Chaincode
+	args [][]byte
+
+	// Clock is the timestamp of the next transaction, it advances by Tick after each one
+	Clock time.Time
+	Tick  time.Duration
+
+	// History holds every write to a key, oldest first
+	History     map[string][]*queryresult.KeyModification
+	txSeq       int
+	lastWriteTx map[string]int
+
+	// Creator is the serialized identity returned by GetCreator, see SetIdentity
+	Creator []byte
+
+	// Collections are the private data collections, see LoadCollections. MSPID is the MSP
+	// of the mock peer, collection membership falls back to the creator MSP when it is empty
+	Collections  map[string]*collectionDefinition
+	PrivateState map[string]map[string][]byte
+	MSPID        string
+	Transient    map[string][]byte
+}
+
+// NewTestStub returns a TestStub running cc
+func NewTestStub(name string, cc shim.Chaincode) *TestStub {
+	return &TestStub{
+		MockStub:    shim.NewMockStub(name, cc),
+		cc:          cc,
+		Clock:       time.Date(2018, 5, 25, 0, 0, 0, 0, time.UTC),
+		Tick:        time.Second,
+		History:     make(map[string][]*queryresult.KeyModification),
+		lastWriteTx: make(map[string]int),
+	}
+}
+
+// MockInit calls the chaincode Init in a transaction
+func (s *TestStub) MockInit(uuid string, args [][]byte) peer.Response {
+	s.args = args
+	s.MockTransactionStart(uuid)
+	res := s.cc.Init(s)
+	s.MockTransactionEnd(uuid)
+	return res
+}
+
+// MockInvoke calls the chaincode Invoke in a transaction
+func (s *TestStub) MockInvoke(uuid string, args [][]byte) peer.Response {
+	s.args = args
+	s.MockTransactionStart(uuid)
+	res := s.cc.Invoke(s)
+	s.MockTransactionEnd(uuid)
+	return res
+}
+
+// MockInvokeAt calls the chaincode Invoke in a transaction with the given timestamp
+func (s *TestStub) MockInvokeAt(uuid string, at time.Time, args [][]byte) peer.Response {
+	s.Clock = at
+	return s.MockInvoke(uuid, args)
+}
+
+// MockInvokeAs calls the chaincode Invoke in a transaction created by the serialized identity creator
+func (s *TestStub) MockInvokeAs(creator []byte, uuid string, args ...string) peer.Response {
+	s.Creator = creator
+	return s.MockInvoke(uuid, util.ToChaincodeArgs(args...))
+}
+
+// MockTransactionStart starts a transaction stamped with Clock
+func (s *TestStub) MockTransactionStart(uuid string) {
+	s.MockStub.MockTransactionStart(uuid)
+	s.TxTimestamp = &timestamp.Timestamp{Seconds: s.Clock.Unix(), Nanos: int32(s.Clock.Nanosecond())}
+	s.txSeq++
+}
+
+// MockTransactionEnd ends a transaction and advances Clock
+func (s *TestStub) MockTransactionEnd(uuid string) {
+	s.MockStub.MockTransactionEnd(uuid)
+	s.Clock = s.Clock.Add(s.Tick)
+}
+
+// PutState writes the key and records it in its history
+func (s *TestStub) PutState(key string, value []byte) error {
+	err := s.MockStub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	// an empty value deletes the key
+	s.recordHistory(key, value, len(value) == 0)
+	return nil
+}
+
+// DelState deletes the key and records it in its history
+func (s *TestStub) DelState(key string) error {
+	err := s.MockStub.DelState(key)
+	if err != nil {
+		return err
+	}
+	s.recordHistory(key, nil, true)
+	return nil
+}
+
+// GetHistoryForKey returns the recorded writes of a key, oldest first like Fabric 1.4
+func (s *TestStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{results: s.History[key]}, nil
+}
+
+// recordHistory - the ledger keeps only the last write of a key in a transaction
+func (s *TestStub) recordHistory(key string, value []byte, isDelete bool) {
+	modification := &queryresult.KeyModification{
+		TxId:      s.TxID,
+		Value:     value,
+		Timestamp: s.TxTimestamp,
+		IsDelete:  isDelete,
+	}
+	history := s.History[key]
+	if len(history) > 0 && s.lastWriteTx[key] == s.txSeq {
+		history = history[:len(history)-1]
+	}
+	s.History[key] = append(history, modification)
+	s.lastWriteTx[key] = s.txSeq
+}
+
+func (s *TestStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *TestStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(s.args))
+	for _, barg := range s.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (s *TestStub) GetFunctionAndParameters() (string, []string) {
+	allargs := s.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+// GetCreator returns the identity installed with SetIdentity
+func (s *TestStub) GetCreator() ([]byte, error) {
+	return s.Creator, nil
+}
+
+// GetStateByRange skips composite keys like the peer does, shim.MockStub returns them as well
+func (s *TestStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(s.State) {
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			continue
+		}
+		if key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		results = append(results, &queryresult.KV{Key: key, Value: s.State[key]})
+	}
+	return newSliceIterator(results), nil
+}
+
+// GetQueryResult evaluates a CouchDB query against the JSON values in state
+func (s *TestStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	results, _, err := runMangoQuery(s.State, query, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return newSliceIterator(results), nil
+}
+
+// GetQueryResultWithPagination evaluates a CouchDB query and returns one page of it
+func (s *TestStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	results, nextBookmark, err := runMangoQuery(s.State, query, int(pageSize), bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: int32(len(results)), Bookmark: nextBookmark}
+	return newSliceIterator(results), metadata, nil
+}
+
+// sortedKeys - keys of a state map in ledger order
+func sortedKeys(state map[string][]byte) []string {
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errNoMoreResults = errors.New("iterator has no more results")
+
+// mockInvoker is implemented by shim.MockStub and TestStub
+type mockInvoker interface {
+	MockInvoke(uuid string, args [][]byte) peer.Response
+}
+
+// sliceIterator iterates over precomputed query results
+type sliceIterator struct {
+	results []*queryresult.KV
+	next    int
+}
+
+func newSliceIterator(results []*queryresult.KV) *sliceIterator {
+	return &sliceIterator{results: results}
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return it.next < len(it.results)
+}
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errNoMoreResults
+	}
+	it.next++
+	return it.results[it.next-1], nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// historyIterator iterates over the recorded history of a key
+type historyIterator struct {
+	results []*queryresult.KeyModification
+	next    int
+}
+
+func (it *historyIterator) HasNext() bool {
+	return it.next < len(it.results)
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, errNoMoreResults
+	}
+	it.next++
+	return it.results[it.next-1], nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
+}
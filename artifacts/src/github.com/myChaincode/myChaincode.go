@@ -6,9 +6,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -17,17 +15,17 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang/protobuf/proto"
-	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/protos/msp"
 	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/myChaincode/identity"
 )
 
 type MyChaincode struct {
 }
 
+// Marble is the private data of putPrivateData, the accepted colors and sizes are configured
+// in Config, the validate tags show the defaults
 type Marble struct {
 	AssetType string      `json:"AssetType" final:"myChaincode.Marble"`
 	MarbleID  string      `json:"MarbleID" validate:"string" id:"true" mandatory:"true"`
@@ -46,6 +44,8 @@ type DemoAsset struct {
 	Flag        bool   `json:"flag"`
 	UpdatedDate string `json:"updatedDate"`
 	Timestamp   int    `json:"timeStamp"`
+	// Version counts the writes of the asset, it is 1 once created, see versions.go
+	Version int `json:"version"`
 }
 
 var AssetQueryMap = map[string]string{
@@ -62,6 +62,7 @@ type DAR struct {
 	DocDigest string  `json:"docDigest"`
 	Type      string  `json:"type"`
 	Fields    []Field `json:"fields"`
+	Owner     string  `json:"owner,omitempty"`
 }
 
 type Field struct {
@@ -88,17 +89,94 @@ type UserAccess struct {
 func main() {
 	err := shim.Start(new(MyChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Parts Trace chaincode: %s", err)
+		logger.Errorf("Error starting Parts Trace chaincode: %s", err)
 	}
 }
 
+// Init applies the config JSON argument, see config.go, grants the admin role to the identities
+// of the admins JSON argument, see rbac.go, and runs the pending data migrations, see migrations.go.
+// All arguments are optional, an empty config keeps the current one on upgrade.
+// The limit caps the records migrated, the rest is continued by invoking migrate:
+// peer chaincode upgrade -n myChaincode -v v1.8 -c '{"Args":["init","{\"eventName\":\"assetEvent\"}","100","[{\"mspId\":\"Org1MSP\",\"id\":\"<id>\"}]"]}'
 func (t *MyChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
-	return shim.Success(nil)
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 3: config JSON, migration limit, admins JSON")
+	}
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		_, err := updateConfig(stub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// the log level of the config, see log.go
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	setLogLevel(config)
+	if len(args) > 2 && len(args[2]) > 0 {
+		err := bootstrapAdmins(stub, args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if len(args) > 1 && len(args[1]) > 0 {
+		return t.migrate(stub, args[1:2])
+	}
+	return t.migrate(stub, []string{})
 }
 
 func (t *MyChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("invoke is running " + function)
+	log := newTxLog(stub)
+
+	config, err := getConfig(stub)
+	if err != nil {
+		log.Error("invoke failed to get the config", "error", err)
+		return shim.Error(err.Error())
+	}
+	setLogLevel(config)
+	log.Info("invoke is running", "args", len(args))
+
+	var response peer.Response
+	if !config.Audit {
+		response = t.invoke(stub, config, function, args)
+	} else {
+		// calls that change the state are recorded, see audit.go
+		auditor := &auditStub{ChaincodeStubInterface: stub}
+		response = auditResponse(auditor, function, args, t.invoke(auditor, config, function, args))
+	}
+	logResponse(log, response)
+	return response
+}
+
+// invoke - check the access to function and call it
+func (t *MyChaincode) invoke(stub shim.ChaincodeStubInterface, config *Config, function string, args []string) peer.Response {
+	// the attributes required by the config guards, see guard.go
+	err := checkGuard(stub, config, function)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the roles of the ledger registry, see rbac.go
+	err = checkRoles(stub, config, function)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// sensitive calls wait for approval, see approvals.go
+	if policy, ok := config.Approvals[function]; ok {
+		return t.proposeRequest(stub, function, args, policy)
+	}
+	err = checkApprovalBypass(config, function)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the assets of the caller's tenant, see tenancy.go
+	stub, err = tenantScope(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Handle different functions
 	if function == "creatAsset" { //create a new asset
@@ -107,16 +185,82 @@ func (t *MyChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		return t.updateAsset(stub, args)
 	} else if function == "deleteAsset" { //delete an asset
 		return t.deleteAsset(stub, args)
+	} else if function == "createAssetsBatch" { // create many assets in one transaction
+		return t.createAssetsBatch(stub, args)
+	} else if function == "updateAssetsBatch" { // update many assets in one transaction
+		return t.updateAssetsBatch(stub, args)
+	} else if function == "deleteAssetsBatch" { // delete many assets in one transaction
+		return t.deleteAssetsBatch(stub, args)
 	} else if function == "getAllAssets" { // get all assets from chaincode state
 		return t.getAllAssets(stub, args)
+	} else if function == "exportState" { // export a page of assets as NDJSON
+		return t.exportState(stub, args)
+	} else if function == "importState" { // import a page written by exportState
+		return t.importState(stub, args)
 	} else if function == "getAsset" { // get an asset from chaincode state by id
 		return t.getAsset(stub, args)
+	} else if function == "grantAsset" { // allow another MSP to read or write an asset or DAR until a time
+		return t.grantAsset(stub, args)
+	} else if function == "revokeGrant" { // withdraw a grant
+		return t.revokeGrant(stub, args)
+	} else if function == "shareAsset" { // allow another tenant to read an asset
+		return t.shareAsset(stub, args)
+	} else if function == "unshareAsset" { // withdraw a share
+		return t.unshareAsset(stub, args)
+	} else if function == "listGrants" { // list the grants of the caller's assets and DARs
+		return t.listGrants(stub, args)
+	} else if function == "createDar" { // store a DAR owned by the caller's MSP
+		return t.createDar(stub, args)
+	} else if function == "updateDar" { // replace a DAR as its owner or a write grantee
+		return t.updateDar(stub, args)
+	} else if function == "getDar" { // get a DAR as its owner or a read grantee
+		return t.getDar(stub, args)
+	} else if function == "queryAuditLog" { // list the recorded calls by identity, function and time
+		return t.queryAuditLog(stub, args)
 	} else if function == "getAssetByType" { // Filter by type
 		return t.getAssetByType(stub, args)
 	} else if function == "getHistoryForRecord" { //get history of values for a record
 		return t.getHistoryForRecord(stub, args)
 	} else if function == "invokeOtherCC" { // invoke other chaincode, e.g. Example02.go, get A
 		return t.invokeOtherCC(stub, args)
+	} else if function == "invokeOtherChannelCC" { // invoke other chaincode on another channel
+		return t.invokeOtherChannelCC(stub, args)
+	} else if function == "setCCAllowlist" { // allow invoking functions of other chaincode
+		return t.setCCAllowlist(stub, args)
+	} else if function == "removeCCAllowlist" { // remove other chaincode from the allowlist
+		return t.removeCCAllowlist(stub, args)
+	} else if function == "getCCAllowlist" { // list the allowlisted chaincodes
+		return t.getCCAllowlist(stub, args)
+	} else if function == "offerAsset" { // put an asset up for sale
+		return t.offerAsset(stub, args)
+	} else if function == "withdrawOffer" { // take an asset off sale
+		return t.withdrawOffer(stub, args)
+	} else if function == "purchaseAsset" { // buy an offered asset with example02 balance
+		return t.purchaseAsset(stub, args)
+	} else if function == "grantRole" { // give an identity a role, admin only
+		return t.grantRole(stub, args)
+	} else if function == "revokeRole" { // take a role from an identity, admin only
+		return t.revokeRole(stub, args)
+	} else if function == "listRoles" { // list the role memberships
+		return t.listRoles(stub, args)
+	} else if function == "approveRequest" { // approve a call held back for approval
+		return t.approveRequest(stub, args)
+	} else if function == "getApprovalRequest" { // get an approval request by id
+		return t.getApprovalRequest(stub, args)
+	} else if function == "getPendingApprovals" { // list the requests waiting for approval
+		return t.getPendingApprovals(stub, args)
+	} else if function == "expireApprovals" { // close the requests past their expiry
+		return t.expireApprovals(stub, args)
+	} else if function == "migrate" { // continue pending data migrations
+		return t.migrate(stub, args)
+	} else if function == "getSchemaStatus" { // get the schema version and pending migration
+		return t.getSchemaStatus(stub, args)
+	} else if function == "getConfig" { // get the chaincode configuration
+		return t.getConfig(stub, args)
+	} else if function == "setConfig" { // change the chaincode configuration, admin only
+		return t.setConfig(stub, args)
+	} else if function == "whoami" { // describe the caller identity as JSON
+		return t.whoami(stub, args)
 	} else if function == "getCertificate" { // getCertificate -  get certificate of the Signed Proposal
 		return t.getCertificate(stub, args)
 	} else if function == "testRESTCC" { // test REST
@@ -133,27 +277,17 @@ func (t *MyChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		return t.putPrivateData(stub, args)
 	}
 
-	if function == "createAcl" || function == "getAcl" || function == "updateAcl" || function == "createDar" || function == "getDar" || function == "getTxCreatorInfo" {
-		var err error
-		var message string
-
+	if function == "createAcl" || function == "getAcl" || function == "updateAcl" || function == "getTxCreatorInfo" {
 		// Get Trx Creator
 		creator, err := stub.GetCreator()
 		if err != nil {
-			message = fmt.Sprintf("Error getting transaction creator: %s\n", err.Error())
-			fmt.Errorf(message)
-			err = errors.New(message)
-			return shim.Error(err.Error())
+			return shim.Error(fmt.Sprintf("Error getting transaction creator: %s", err.Error()))
 		}
 
 		// Deserialize Creator Certificate
 		userOrg, userName, err := getTxCreatorInfo(creator)
-
 		if err != nil {
-			message = fmt.Sprintf("Error getting deserializing Creator Certificate: %s\n", err.Error())
-			fmt.Errorf(message)
-			err = errors.New(message)
-			return shim.Error(err.Error())
+			return shim.Error(fmt.Sprintf("Error deserializing creator identity: %s", err.Error()))
 		}
 
 		// if function == "createAcl" { // Create ACL
@@ -166,7 +300,6 @@ func (t *MyChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		}
 	}
 
-	fmt.Println("invoke did not find func: " + function) //error
 	return shim.Error("Received unknown function invocation")
 }
 
@@ -185,7 +318,6 @@ func (t *MyChaincode) createAsset(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	// ==== Input sanitation ====
-	fmt.Println("- start create an asset")
 	if len(args[0]) <= 0 {
 		return shim.Error("1st argument must be a non-empty string")
 	}
@@ -200,12 +332,15 @@ func (t *MyChaincode) createAsset(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	_id := args[0]
+	err = checkAssetID(_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	// ==== Check if asset already exists ====
 	assetBytes, err := stub.GetState(_id)
 	if err != nil {
 		return shim.Error("Failed to get asset: " + err.Error())
 	} else if assetBytes != nil {
-		fmt.Println("This asset already exists: " + _id)
 		return shim.Error("This asset already exists: " + _id)
 	}
 
@@ -220,14 +355,14 @@ func (t *MyChaincode) createAsset(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("7th argument must be a numeric string")
 	}
 
-	demoAsset := DemoAsset{_id, args[1], _type, args[3], _flag, args[5], _timestamp}
+	demoAsset := DemoAsset{_id, args[1], _type, args[3], _flag, args[5], _timestamp, 1}
 	assetJSONasBytes, err := json.Marshal(demoAsset)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// === Save asset to state ===
-	fmt.Println("Create asset: " + string(assetJSONasBytes))
+	newTxLog(stub).Debug("create asset", "id", demoAsset.ID, "type", demoAsset.Type)
 	err = stub.PutState(demoAsset.ID, assetJSONasBytes)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -239,8 +374,12 @@ func (t *MyChaincode) createAsset(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error(err.Error())
 	}
 
+	err = emitEvents(stub, newAssetEvent(stub, EventAssetCreated, demoAsset.ID, demoAsset.Type, nil, assetJSONasBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ==== Asset saved Return success ====
-	fmt.Println("- end create an asset")
 	return shim.Success(nil)
 }
 
@@ -287,15 +426,43 @@ func (t *MyChaincode) getAllAssets(stub shim.ChaincodeStubInterface, args []stri
 		bArrayMemberAlreadyWritten = true
 	}
 
+	// in tenancy mode the assets of other tenants granted to the caller follow, see grants.go
+	granted, err := getGrantedAssets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, asset := range granted {
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(asset.ID)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Tenant\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(asset.Owner)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		buffer.WriteString(string(bytes.Trim(asset.Value, "\x00")))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+
 	buffer.WriteString("]")
 
-	fmt.Printf("- get all assets:\n%s\n", buffer.String())
+	newTxLog(stub).Debug("get all assets", "size", buffer.Len())
 
 	return shim.Success(buffer.Bytes())
 }
 
 // ===============================================
-// getAsset - get an asset from chaincode state by id
+// getAsset - get an asset from chaincode state by id, optionally through a grant of its owner,
+// args: id, owner: the tenant MSP ID in tenancy mode, otherwise the asset Owner, If-None-Match.
+// The message of the response is the ETag of the asset, a matching If-None-Match
+// is answered with StatusNotModified and no payload
 // curl --request POST \
 //   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
 //   --header 'content-type: application/json' \
@@ -305,42 +472,54 @@ func (t *MyChaincode) getAsset(stub shim.ChaincodeStubInterface, args []string)
 	var _id, jsonResp string
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting id of the asset to query")
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3: id, owner, If-None-Match")
 	}
 
 	_id = args[0]
+	err = checkAssetID(_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) >= 2 && len(args[1]) > 0 {
+		stub, err = grantedScope(stub, args[1], _id, AccessRead)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	valAsbytes, err := stub.GetState(_id) //get the asset from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + _id + "\"}"
-		fmt.Println(jsonResp)
 		return shim.Error(jsonResp)
 	} else if valAsbytes == nil {
 		jsonResp = "{\"Error\":\"Asset does not exist: " + _id + "\"}"
-		fmt.Println(jsonResp)
 		return shim.Error(jsonResp)
 	}
 
-	fmt.Printf("- get asset by id:\n%s\n", valAsbytes)
-
-	return shim.Success(valAsbytes)
+	ifNoneMatch := ""
+	if len(args) == 3 {
+		ifNoneMatch = args[2]
+	}
+	return conditionalResponse(valAsbytes, ifNoneMatch)
 }
 
 // ===============================================
-// updateAsset - update an exsting asset
+// updateAsset - update an exsting asset, the 8th argument may name the owner of an asset
+// granted to the caller for write: its tenant in tenancy mode, otherwise its Owner
+// The optional 9th argument is the expected version, the update fails with StatusConflict
+// if the asset has another
 // curl --request POST \
 //   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
 //   --header 'content-type: application/json' \
-//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"updateAsset","args":["004", "test004_new", "food", "cathy", "true", "2018-05-21", "1502688979"],"chaincodeVer":"v1.8"}'
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"updateAsset","args":["004", "test004_new", "food", "cathy", "true", "2018-05-21", "1502688979", "", "3"],"chaincodeVer":"v1.8"}'
 // ===============================================
 func (t *MyChaincode) updateAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 	var err error
-	if len(args) != 7 {
-		return shim.Error("Incorrect number of arguments. Expecting 7")
+	if len(args) < 7 || len(args) > 9 {
+		return shim.Error("Incorrect number of arguments. Expecting 7 to 9: id, name, type, owner, flag, updated date, timestamp, owner, expected version")
 	}
 
 	// ==== Input sanitation ====
-	fmt.Println("- start create an asset")
 	if len(args[0]) <= 0 {
 		return shim.Error("1st argument must be a non-empty string")
 	}
@@ -355,15 +534,41 @@ func (t *MyChaincode) updateAsset(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	_id := args[0]
+	err = checkAssetID(_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) >= 8 && len(args[7]) > 0 {
+		stub, err = grantedScope(stub, args[7], _id, AccessWrite)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	expectedVersion := 0
+	if len(args) == 9 {
+		expectedVersion, err = parseExpectedVersion(args[8], "9th")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	// ==== Check if asset already exists ====
 	assetBytes, err := stub.GetState(_id)
 	if err != nil {
 		return shim.Error("Failed to get asset: " + err.Error())
 	} else if assetBytes == nil {
 		jsonResp := "{\"Error\":\"Update asset fail - Asset does not exist: " + _id + "\"}"
-		fmt.Println(jsonResp)
 		return shim.Error(jsonResp)
 	} else if assetBytes != nil {
+		oldAsset := &DemoAsset{}
+		err = json.Unmarshal(assetBytes, oldAsset)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = checkVersion(oldAsset, expectedVersion)
+		if err != nil {
+			return versionError(err)
+		}
+
 		// ==== Update asset object and marshal to JSON ====
 		_type := strings.ToUpper(args[2])
 		_flag, err := strconv.ParseBool(args[4])
@@ -375,33 +580,40 @@ func (t *MyChaincode) updateAsset(stub shim.ChaincodeStubInterface, args []strin
 			return shim.Error("7th argument must be a numeric string")
 		}
 
-		demoAsset := DemoAsset{_id, args[1], _type, args[3], _flag, args[5], _timestamp}
+		demoAsset := DemoAsset{_id, args[1], _type, args[3], _flag, args[5], _timestamp, oldAsset.Version + 1}
 		assetJSONasBytes, err := json.Marshal(demoAsset)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
 		// === Save asset to state ===
-		fmt.Println("Update asset: " + string(assetJSONasBytes))
+		newTxLog(stub).Debug("update asset", "id", demoAsset.ID, "type", demoAsset.Type)
 		err = stub.PutState(demoAsset.ID, assetJSONasBytes)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
-		// create indexes
-		err = createIndexHelper(stub, &demoAsset)
+		// replace indexes, type and owner may have changed
+		err = updateIndexHelper(stub, oldAsset, &demoAsset)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = emitEvents(stub, newAssetEvent(stub, EventAssetUpdated, demoAsset.ID, demoAsset.Type, assetBytes, assetJSONasBytes))
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 	}
 
 	// ==== Asset saved Return success ====
-	fmt.Println("- end update an asset")
 	return shim.Success(nil)
 }
 
 // ===============================================
-// deleteAsset - delete an asset from chaincode state by id
+// deleteAsset - delete an asset and its grants from chaincode state by id, the 2nd argument may name
+// the owner of an asset granted to the caller for write: its tenant in tenancy mode, otherwise its Owner
+// The optional 3rd argument is the expected version, the delete fails with StatusConflict
+// if the asset has another
 // curl --request POST \
 //   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
 //   --header 'content-type: application/json' \
@@ -411,24 +623,46 @@ func (t *MyChaincode) deleteAsset(stub shim.ChaincodeStubInterface, args []strin
 	var _id, jsonResp string
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting id of the asset to query")
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3: id, owner, expected version")
 	}
 
 	_id = args[0]
+	err = checkAssetID(_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) >= 2 && len(args[1]) > 0 {
+		stub, err = grantedScope(stub, args[1], _id, AccessWrite)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	expectedVersion := 0
+	if len(args) == 3 {
+		expectedVersion, err = parseExpectedVersion(args[2], "3rd")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	valAsbytes, err := stub.GetState(_id) //get the asset from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + _id + "\", \"message\": \"" + err.Error() + "\" }"
-		fmt.Println(jsonResp)
 		return shim.Error(jsonResp)
 	} else if valAsbytes == nil {
 		jsonResp = "{\"Error\":\"Asset does not exist: " + _id + "\"}"
-		fmt.Println(jsonResp)
 		return shim.Error(jsonResp)
 	}
 
 	demoAsset := &DemoAsset{}
-	json.Unmarshal(valAsbytes, demoAsset)
+	err = json.Unmarshal(valAsbytes, demoAsset)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to unmarshal asset %s: %s", _id, err.Error()))
+	}
+	err = checkVersion(demoAsset, expectedVersion)
+	if err != nil {
+		return versionError(err)
+	}
 
 	err = stub.DelState(_id)
 	if err != nil {
@@ -441,6 +675,16 @@ func (t *MyChaincode) deleteAsset(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error(err.Error())
 	}
 
+	err = deleteAssetGrants(stub, _id, valAsbytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitEvents(stub, newAssetEvent(stub, EventAssetDeleted, demoAsset.ID, demoAsset.Type, valAsbytes, nil))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(valAsbytes)
 }
 
@@ -458,7 +702,11 @@ func (t *MyChaincode) getAssetByType(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("Incorrect number of arguments. Expecting type to query")
 	}
 	_type = strings.ToUpper(args[0])
-	indexName := AssetQueryMap["AssetType"]
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	indexName := config.AssetIndexes["AssetType"]
 	partIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{_type})
 	if err != nil {
 		return shim.Error(err.Error())
@@ -503,6 +751,24 @@ func (t *MyChaincode) getAssetByType(stub shim.ChaincodeStubInterface, args []st
 		bArrayMemberAlreadyWritten = true
 	}
 
+	// in tenancy mode the assets of the type other tenants granted to the caller follow, see grants.go
+	granted, err := getGrantedAssets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, asset := range granted {
+		demoAsset := &DemoAsset{}
+		err = json.Unmarshal(asset.Value, demoAsset)
+		if err != nil || demoAsset.Type != _type {
+			continue
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(asset.Value)
+		bArrayMemberAlreadyWritten = true
+	}
+
 	//Close the array and write the payload back to the caller
 	buffer.WriteString("]")
 	return shim.Success(buffer.Bytes())
@@ -521,8 +787,12 @@ func (t *MyChaincode) getHistoryForRecord(stub shim.ChaincodeStubInterface, args
 	}
 
 	recordKey := args[0]
+	err := checkAssetID(recordKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	fmt.Printf("- start getHistoryForRecord: %s\n", recordKey)
+	newTxLog(stub).Debug("start getHistoryForRecord", "id", recordKey)
 
 	resultsIterator, err := stub.GetHistoryForKey(recordKey)
 	if err != nil {
@@ -574,7 +844,7 @@ func (t *MyChaincode) getHistoryForRecord(stub shim.ChaincodeStubInterface, args
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getHistoryForRecord returning:\n%s\n", buffer.String())
+	newTxLog(stub).Debug("getHistoryForRecord returning", "size", buffer.Len())
 
 	return shim.Success(buffer.Bytes())
 }
@@ -593,40 +863,50 @@ func (t *MyChaincode) invokeOtherCC(stub shim.ChaincodeStubInterface, args []str
 
 	otherCCName := args[0]
 	_args := args[1:len(args)]
-	respMsg := stub.InvokeChaincode(otherCCName, util.ToChaincodeArgs(_args...), "")
+	respMsg := invokeChaincode(stub, "", otherCCName, _args)
 	if respMsg.Status != shim.OK {
-		return shim.Error("Failed to invoke other chaincode.")
+		return respMsg
 	}
 
-	var buffer bytes.Buffer
-	buffer.WriteString(string(respMsg.Payload))
-	return shim.Success(buffer.Bytes())
+	return shim.Success(respMsg.Payload)
 }
 
 // ===============================================
-// getCertificate -  get certificate of the Signed Proposal
+// invokeOtherChannelCC -  invoke other chaincode on another channel, e.g. Example02.go, get A
 // curl --request POST \
 //   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
 //   --header 'content-type: application/json' \
-//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getCertificate","args":[],"chaincodeVer":"v1.8"}'
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"invokeOtherChannelCC","args":["otherchannel", "obcs-example02", "invoke","query", "a"],"chaincodeVer":"v1.8"}'
 // ===============================================
-func (t *MyChaincode) getCertificate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	creatorByte, _ := stub.GetCreator()
-	certStart := bytes.IndexAny(creatorByte, "-----BEGIN")
-	if certStart == -1 {
-		fmt.Errorf("No certificate found")
+func (t *MyChaincode) invokeOtherChannelCC(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting >= 3")
 	}
-	certText := creatorByte[certStart:]
-	bl, _ := pem.Decode(certText)
-	if bl == nil {
-		fmt.Errorf("Could not decode the PEM structure")
+
+	respMsg := invokeChaincode(stub, args[0], args[1], args[2:])
+	if respMsg.Status != shim.OK {
+		return respMsg
 	}
 
-	cert, err := x509.ParseCertificate(bl.Bytes)
+	return shim.Success(respMsg.Payload)
+}
+
+// ===============================================
+// getCertificate -  get certificate of the Signed Proposal
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"getCertificate","args":[],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) getCertificate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	id, err := identity.New(stub)
 	if err != nil {
-		fmt.Errorf("ParseCertificate failed")
+		return shim.Error(err.Error())
 	}
-	uname := cert.Subject.CommonName
+	if id.Certificate == nil {
+		return shim.Error("The creator has no certificate, it is an " + id.Type + " identity of " + id.MSPID)
+	}
+	uname := id.CommonName
 	// orgArr := cert.Issuer.Organization
 	// mspname := strings.Join(orgArr,", ")
 	//	issuer := cert.Issuer.CommonName
@@ -634,20 +914,31 @@ func (t *MyChaincode) getCertificate(stub shim.ChaincodeStubInterface, args []st
 	return shim.Success([]byte("Called testCertificate " + uname))
 }
 
-func (t *MyChaincode) testRESTCC(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	url := "https://apex.oracle.com/pls/apex/xh/hr/employees/"
-	ret, err := http.Get(url)
+// testRESTURL is the default REST service called by testRESTCC, see Config.RESTURL
+const testRESTURL = "https://apex.oracle.com/pls/apex/xh/hr/employees/"
 
+// restClient is used for REST calls from chaincode, tests replace its transport to stay offline
+var restClient = &http.Client{Timeout: 30 * time.Second}
+
+func (t *MyChaincode) testRESTCC(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ret, err := restClient.Get(config.RESTURL)
 	if err != nil {
-		panic(err)
+		return shim.Error("testRESTCC request failed: " + err.Error())
 	}
 	defer ret.Body.Close()
 
 	body, err := ioutil.ReadAll(ret.Body)
 	if err != nil {
-		panic(err)
+		return shim.Error("testRESTCC failed to read response: " + err.Error())
 	}
-	fmt.Println("testRESTCC response msg:", string(body))
+	if ret.StatusCode != http.StatusOK {
+		return shim.Error(fmt.Sprintf("testRESTCC response status: %s", ret.Status))
+	}
+	newTxLog(stub).Debug("testRESTCC response", "status", ret.Status, "size", len(body))
 	return shim.Success([]byte(body))
 }
 
@@ -658,14 +949,21 @@ func (t *MyChaincode) fireCCEvent(stub shim.ChaincodeStubInterface, args []strin
 	} else {
 		value = []byte(args[0])
 	}
-	fmt.Println("fireCCEvent value:", string(value))
+	newTxLog(stub).Debug("fireCCEvent", "size", len(value))
 	//Write the value to our eventKey
 	//	err := stub.PutState("eventKey", value)
 	// if err != nil {
 	// 	shim.Error("Error writing to the event key!")
 	// }
 
-	stub.SetEvent("testEvent", value)
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent(config.EventName, value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(value)
 }
 
@@ -677,7 +975,7 @@ func (t *MyChaincode) createAcl(stub shim.ChaincodeStubInterface, args []string,
 
 	if len(args) != 1 {
 		message = "invalid number of args, expecting one arg for ACL"
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return shim.Error(err.Error())
 	}
@@ -687,7 +985,7 @@ func (t *MyChaincode) createAcl(stub shim.ChaincodeStubInterface, args []string,
 	if err != nil {
 
 		message = fmt.Sprintf("Error Unmarsheling input param %s. Error details %d", args[0], err.Error())
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return shim.Error(err.Error())
 	}
@@ -700,7 +998,7 @@ func (t *MyChaincode) createAcl(stub shim.ChaincodeStubInterface, args []string,
 	if err != nil {
 
 		message = fmt.Sprintf("Error marsheling acl with ID %s. Error details %d", acl.AclID, err.Error())
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return shim.Error(err.Error())
 	}
@@ -708,7 +1006,7 @@ func (t *MyChaincode) createAcl(stub shim.ChaincodeStubInterface, args []string,
 	err = stub.PutState(acl.AclID, aclJSON)
 	if err != nil {
 		message := fmt.Sprintf("Error Creating ACL with ID %s\n. Error details %d", acl.AclID, err.Error())
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return shim.Error(err.Error())
 	}
@@ -725,7 +1023,7 @@ func (t *MyChaincode) getAcl(stub shim.ChaincodeStubInterface, args []string, us
 
 	if len(args) != 1 {
 		message = "invalid number of args, expecting one arg for ACL ID"
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return shim.Error(err.Error())
 	}
@@ -758,14 +1056,14 @@ func getAclById(stub shim.ChaincodeStubInterface, aclId string) (ACL, error) {
 	aclBytes, err = stub.GetState(aclId)
 	if err != nil {
 		message = fmt.Sprintf("Error getting ACL with ID: %s\n", aclId)
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return acl, err
 	}
 
 	if aclBytes == nil {
 		message = fmt.Sprintf("No ACL exists with ID: %s\n", aclId)
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return acl, err
 	}
@@ -773,7 +1071,7 @@ func getAclById(stub shim.ChaincodeStubInterface, aclId string) (ACL, error) {
 	err = json.Unmarshal(aclBytes, &acl)
 	if err != nil {
 		message = fmt.Sprintf("Error Unmarshalling ACL with ID: %s\n", aclId)
-		fmt.Errorf(message)
+		logger.Error(message)
 		err = errors.New(message)
 		return acl, err
 	}
@@ -782,33 +1080,14 @@ func getAclById(stub shim.ChaincodeStubInterface, aclId string) (ACL, error) {
 }
 
 */
+// getTxCreatorInfo - the MSP ID and common name of a serialized creator identity,
+// the common name is empty for an idemix identity
 func getTxCreatorInfo(creator []byte) (string, string, error) {
-	var certASN1 *pem.Block
-	var cert *x509.Certificate
-	var err error
-
-	creatorSerializedId := &msp.SerializedIdentity{}
-	err = proto.Unmarshal(creator, creatorSerializedId)
+	id, err := identity.Parse(creator)
 	if err != nil {
-		fmt.Printf("Error unmarshalling creator identity: %s\n", err.Error())
 		return "", "", err
 	}
-
-	if len(creatorSerializedId.IdBytes) == 0 {
-		return "", "", errors.New("Empty certificate")
-	}
-	// modify by Cathy - begin
-	//	certASN1, _ = pem.Decode(creatorSerializedId.IdBytes)
-	certStart := bytes.IndexAny(creator, "-----BEGIN")
-	certASN1, _ = pem.Decode(creator[certStart:])
-	// modify by Cathy - end
-	cert, err = x509.ParseCertificate(certASN1.Bytes)
-	if err != nil {
-		return "", "", err
-	}
-
-	//	return creatorSerializedId.Mspid, cert.Issuer.CommonName, nil
-	return creatorSerializedId.Mspid, cert.Subject.CommonName, nil
+	return id.MSPID, id.CommonName, nil
 }
 
 func (t *MyChaincode) richQuery(stub shim.ChaincodeStubInterface, args []string) peer.Response {
@@ -850,7 +1129,7 @@ func (t *MyChaincode) richQuery(stub shim.ChaincodeStubInterface, args []string)
 
 	buffer.WriteString("]")
 
-	fmt.Printf("- Rich query assets:\n%s\n", buffer.String())
+	newTxLog(stub).Debug("rich query", "size", buffer.Len())
 
 	return shim.Success(buffer.Bytes())
 }
@@ -863,8 +1142,6 @@ func (t *MyChaincode) getABAC(stub shim.ChaincodeStubInterface, args []string) p
 	var buffer bytes.Buffer
 
 	id, err := cid.New(stub)
-	fmt.Println("client ID object:")
-	fmt.Println(id)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -885,13 +1162,6 @@ func (t *MyChaincode) getABAC(stub shim.ChaincodeStubInterface, args []string) p
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	fmt.Println("cert:")
-	fmt.Printf("%+v\n", cert)
-	fmt.Println("cert.Extensions :")
-	fmt.Printf("%+v\n", cert.Extensions)
-	fmt.Println("cert.Subject.CommonName:")
-	fmt.Println(cert.Subject.CommonName)
-
 	certStr := fmt.Sprintf("%+v", cert)
 	buffer.WriteString(", cert\":\"" + certStr + "\"")
 
@@ -904,7 +1174,7 @@ func (t *MyChaincode) getABAC(stub shim.ChaincodeStubInterface, args []string) p
 	}
 	buffer.WriteString(", \"" + args[0] + "\":\"" + val + "\"}")
 
-	fmt.Printf("- Get ABAC:\n%s\n", buffer.String())
+	newTxLog(stub).Debug("get ABAC", "mspId", mspid, "attribute", args[0])
 
 	return shim.Success(buffer.Bytes())
 }
@@ -947,10 +1217,24 @@ func (t *MyChaincode) getPrivateData(stub shim.ChaincodeStubInterface, args []st
 		"timeout": 60000,
 		"sync": true
 	}
+	The marble can also be passed in the transient map under "marble" to keep it out of the transaction:
+		"args": ["putPrivateData", "privateDataCollection"],
+		"transientMap": {"marble": "{\"MarbleID\":\"m_001\", ...}"}
 **/
 func (t *MyChaincode) putPrivateData(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) == 1 {
+		transientMap, err := stub.GetTransient()
+		if err != nil {
+			return shim.Error("Error getting transient: " + err.Error())
+		}
+		marbleBytes, ok := transientMap["marble"]
+		if !ok {
+			return shim.Error("marble must be a key in the transient map")
+		}
+		args = append(args, string(marbleBytes))
+	}
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return shim.Error("Incorrect number of arguments. Expecting 2: collection, marble JSON, or 1 with the marble in the transient map")
 	}
 
 	if len(args[0]) <= 0 {
@@ -961,25 +1245,92 @@ func (t *MyChaincode) putPrivateData(stub shim.ChaincodeStubInterface, args []st
 	}
 
 	marble := &Marble{AssetType: "myChaincode.Marble"}
-	json.Unmarshal([]byte(args[1]), marble)
+	err := json.Unmarshal([]byte(args[1]), marble)
+	if err != nil {
+		return shim.Error("2nd argument must be a marble JSON: " + err.Error())
+	}
+	if len(marble.MarbleID) <= 0 {
+		return shim.Error("MarbleID must be a non-empty string")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = validMarble(config, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// === Save asset to state ===
-	fmt.Println("Put private data, collection: " + string(args[0]) + ", value: " + string(args[1]))
-	err := stub.PutPrivateData(args[0], marble.MarbleID, []byte(args[1]))
+	newTxLog(stub).Info("put private data", "collection", args[0], "value", redacted(args[1]))
+	err = stub.PutPrivateData(args[0], marble.MarbleID, []byte(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// every channel member sees the event, it names neither the marble nor digests of its value
+	event := newAssetEvent(stub, EventPrivateDataPut, "", marble.AssetType, nil, nil)
+	event.Collection = args[0]
+	err = emitEvents(stub, event)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(nil)
 }
 
+// ===============================================
+// getDemoAsset - read an asset from chaincode state by id
+// ===============================================
+func getDemoAsset(stub shim.ChaincodeStubInterface, id string) (*DemoAsset, error) {
+	err := checkAssetID(id)
+	if err != nil {
+		return nil, err
+	}
+	assetBytes, err := stub.GetState(id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset %s: %s", id, err.Error())
+	} else if assetBytes == nil {
+		return nil, errors.New("Asset does not exist: " + id)
+	}
+
+	demoAsset := &DemoAsset{}
+	err = json.Unmarshal(assetBytes, demoAsset)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal asset %s: %s", id, err.Error())
+	}
+	return demoAsset, nil
+}
+
+// checkAssetID - asset ids are simple keys, an id starting with U+0000 would address the
+// composite keys of the chaincode, e.g. the assets of another tenant or the role registry
+func checkAssetID(id string) error {
+	if strings.ContainsRune(id, 0) {
+		return fmt.Errorf("Invalid asset id %q, asset ids must not contain U+0000", id)
+	}
+	return nil
+}
+
+// assetIndexAttributes - the composite key attributes of an asset in the index of queryKey
+func assetIndexAttributes(queryKey string, demoAsset *DemoAsset) []string {
+	if queryKey == "AssetType" {
+		return []string{demoAsset.Type, demoAsset.ID}
+	} else if queryKey == "AssetOwner" {
+		return []string{demoAsset.Owner, demoAsset.ID}
+	}
+	return []string{demoAsset.ID}
+}
+
+// createIndexHelper - create the configured index entries of an asset, a failed write is returned
 func createIndexHelper(stub shim.ChaincodeStubInterface, demoAsset *DemoAsset) error {
-	var err error = nil
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
 
-	for queryKey, indexName := range AssetQueryMap {
-		if queryKey == "AssetType" {
-			err = createIndex(stub, indexName, []string{demoAsset.Type, demoAsset.ID})
-		} else if queryKey == "AssetOwner" {
-			err = createIndex(stub, indexName, []string{demoAsset.Owner, demoAsset.ID})
+	for queryKey, indexName := range config.AssetIndexes {
+		err = createIndex(stub, indexName, assetIndexAttributes(queryKey, demoAsset))
+		if err != nil {
+			return err
 		}
 	}
 
@@ -990,7 +1341,6 @@ func createIndexHelper(stub shim.ChaincodeStubInterface, demoAsset *DemoAsset) e
 // createIndex - create search index for ledger
 // ===============================================
 func createIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
-	fmt.Println("- start create index")
 	var err error
 	//  ==== Index the object to enable range queries, e.g. return all parts made by supplier b ====
 	//  An 'index' is a normal key/value entry in state.
@@ -1004,20 +1354,37 @@ func createIndex(stub shim.ChaincodeStubInterface, indexName string, attributes
 	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
 	value := []byte{0x00}
 
-	stub.PutState(indexKey, value)
+	err = stub.PutState(indexKey, value)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("- end create index")
+	newTxLog(stub).Debug("create index", "index", indexName)
 	return nil
 }
 
+// ===============================================
+// updateIndexHelper - replace the indexes of an asset after it changed
+// ===============================================
+func updateIndexHelper(stub shim.ChaincodeStubInterface, oldAsset *DemoAsset, newAsset *DemoAsset) error {
+	err := deleteIndexHelper(stub, oldAsset)
+	if err != nil {
+		return err
+	}
+	return createIndexHelper(stub, newAsset)
+}
+
+// deleteIndexHelper - delete the configured index entries of an asset, a failed delete is returned
 func deleteIndexHelper(stub shim.ChaincodeStubInterface, demoAsset *DemoAsset) error {
-	var err error = nil
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
 
-	for queryKey, indexName := range AssetQueryMap {
-		if queryKey == "AssetType" {
-			err = deleteIndex(stub, indexName, []string{demoAsset.Type, demoAsset.ID})
-		} else if queryKey == "AssetOwner" {
-			err = deleteIndex(stub, indexName, []string{demoAsset.Owner, demoAsset.ID})
+	for queryKey, indexName := range config.AssetIndexes {
+		err = deleteIndex(stub, indexName, assetIndexAttributes(queryKey, demoAsset))
+		if err != nil {
+			return err
 		}
 	}
 
@@ -1028,7 +1395,6 @@ func deleteIndexHelper(stub shim.ChaincodeStubInterface, demoAsset *DemoAsset) e
 // deleteIndex - remove search index for ledger
 // ===============================================
 func deleteIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
-	fmt.Println("- start delete index")
 	var err error
 	//  ==== Index the object to enable range queries, e.g. return all parts made by supplier b ====
 	//  An 'index' is a normal key/value entry in state.
@@ -1039,8 +1405,11 @@ func deleteIndex(stub shim.ChaincodeStubInterface, indexName string, attributes
 		return err
 	}
 	//  Delete index by key
-	stub.DelState(indexKey)
+	err = stub.DelState(indexKey)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("- end delete index")
+	newTxLog(stub).Debug("delete index", "index", indexName)
 	return nil
 }
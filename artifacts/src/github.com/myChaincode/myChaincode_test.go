@@ -3,198 +3,329 @@ package main
 import (
 	// "bytes"
 	"encoding/json"
-	// "fmt"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	exampleCC "myChaincode/example02"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+	exampleCC "github.com/myChaincode/example02"
 	"testing"
 )
 
+// ResultJSON is the response of getAllAssets and richQuery
 type ResultJSON []struct {
-	Key    string `json:"Key"`
-	Record string `json:"Record"`
+	Key    string    `json:"Key"`
+	Record DemoAsset `json:"Record"`
 }
 
 func TestCreateAsset(t *testing.T) {
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
-	demoAsset := DemoAsset{"001", "test", "food", "cathy", true, "2018-05-25", 1502688979}
-
-	createAsset(t, stub, demoAsset)
+	t.Log("************ TestCreateAsset ****************")
+	valid := []string{"creatAsset", "001", "test", "food", "cathy", "true", "2018-05-25", "1502688979"}
+	tests := []struct {
+		name    string
+		args    []string
+		message string // expected error, empty when the call succeeds
+	}{
+		{"valid", valid, ""},
+		{"duplicate", valid, "This asset already exists: 001"},
+		{"missing argument", valid[:7], "Incorrect number of arguments. Expecting 7"},
+		{"empty id", []string{"creatAsset", "", "test", "food", "cathy", "true", "2018-05-25", "1502688979"}, "1st argument must be a non-empty string"},
+		{"empty owner", []string{"creatAsset", "002", "test", "food", "", "true", "2018-05-25", "1502688979"}, "4th argument must be a non-empty string"},
+		{"flag not boolean", []string{"creatAsset", "002", "test", "food", "cathy", "yes", "2018-05-25", "1502688979"}, "5th argument must be a boolean string"},
+		{"timestamp not numeric", []string{"creatAsset", "002", "test", "food", "cathy", "true", "2018-05-25", "now"}, "7th argument must be a numeric string"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		assertResponse(t, tt.name, invokeResult, tt.message)
+	}
 
-	// assetAsbytes, _ := stub.GetState(demoAsset.ID)
-	// if assetAsbytes == nil {
-	// 	t.Errorf("Asset not created!")
-	// }
-	// fmt.Println("Get state: " + string(assetAsbytes))
+	// type is stored upper case and both indexes exist
+	want := DemoAsset{"001", "test", "FOOD", "cathy", true, "2018-05-25", 1502688979, 1}
+	if got := getStateAsset(t, stub, "001"); got == nil || *got != want {
+		t.Errorf("Create asset stored wrong asset, got: %+v, want: %+v", got, want)
+	}
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"FOOD", "001"}, true)
+	assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"cathy", "001"}, true)
+	// failed calls did not write anything, the asset and its 2 index entries are all there is
+	if len(stub.State) != 3 {
+		t.Errorf("Create asset left unexpected state, got %d keys, want: %d", len(stub.State), 3)
+	}
+}
 
-	// getAsset
-	invokeFunc := "getAsset"
-	args := [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
-	invokeResult := stub.MockInvoke("12345", args)
-	if invokeResult.Status != 200 {
-		t.Errorf("Get asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+func TestGetAsset(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
 	}
-	// t.Log("invokeResult.Message: " + string(invokeResult.Message))
-	t.Log("Get asset by id invokeResult.Payload: " + string(invokeResult.Payload))
+	t.Log("************ TestGetAsset ****************")
+	createAsset(t, stub, DemoAsset{"001", "test", "food", "cathy", true, "2018-05-25", 1502688979, 1})
 
-	// Validate index was created
-	// indexKey, _ := stub.CreateCompositeKey("vehiclePart~assembler", []string{"panamaparts","abg1234"})
-	// indexEntry, _ := stub.GetState(indexKey)
-	// if indexEntry == nil {
-	// 	t.Errorf("Index on assembler not created!")
-	// }
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"existing", []string{"getAsset", "001"}, ""},
+		{"missing", []string{"getAsset", "999"}, "{\"Error\":\"Asset does not exist: 999\"}"},
+		{"no id", []string{"getAsset"}, "Incorrect number of arguments. Expecting 1 to 3: id, owner, If-None-Match"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if assertResponse(t, tt.name, invokeResult, tt.message) {
+			assertGolden(t, "getAsset", invokeResult.Payload)
+		}
+	}
 }
 
 func TestDeleteAsset(t *testing.T) {
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
-	demoAsset := DemoAsset{"001", "test", "food", "cathy", true, "2018-05-25", 1502688979}
+	t.Log("************ TestDeleteAsset ****************")
+	demoAsset := DemoAsset{"001", "test", "FOOD", "cathy", true, "2018-05-25", 1502688979, 1}
 	createAsset(t, stub, demoAsset)
 
-	// delete Asset
-	invokeFunc := "deleteAsset"
-	args := [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
-	invokeResult := stub.MockInvoke("12345", args)
-	if invokeResult.Status != 200 {
-		t.Errorf("Delete asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"no id", []string{"deleteAsset"}, "Incorrect number of arguments. Expecting 1 to 3: id, owner, expected version"},
+		{"existing", []string{"deleteAsset", "001"}, ""},
+		{"already deleted", []string{"deleteAsset", "001"}, "{\"Error\":\"Asset does not exist: 001\"}"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if !assertResponse(t, tt.name, invokeResult, tt.message) {
+			continue
+		}
+		// the deleted asset is returned
+		var deleted DemoAsset
+		if err := json.Unmarshal(invokeResult.Payload, &deleted); err != nil || deleted != demoAsset {
+			t.Errorf("Delete asset returned wrong asset, got: %s, want: %+v", invokeResult.Payload, demoAsset)
+		}
+		assertGolden(t, "deleteAsset", invokeResult.Payload)
+	}
+
+	if getStateAsset(t, stub, "001") != nil {
+		t.Errorf("Delete asset did not remove the asset")
+	}
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"FOOD", "001"}, false)
+	assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"cathy", "001"}, false)
+	if len(stub.State) != 0 {
+		t.Errorf("Delete asset left state behind, got %d keys", len(stub.State))
+	}
+
+	// an unreadable asset is kept, its indexes could not be found
+	stub.State["002"] = []byte("{")
+	assertResponse(t, "unreadable", stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAsset", "002")), "Failed to unmarshal asset 002: unexpected end of JSON input")
+	if stub.State["002"] == nil {
+		t.Errorf("Delete asset removed an unreadable asset")
 	}
-	t.Log("Delete asset invokeResult.Payload: " + string(invokeResult.Payload))
 }
 
 func TestGetAssetsByType(t *testing.T) {
-	var err error
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
 	t.Log("************ TestGetAssetsByType ****************")
-	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979}
-	createAsset(t, stub, demoAsset)
-	demoAsset.ID = "002"
-	demoAsset.Name = "test2"
-	createAsset(t, stub, demoAsset)
-	demoAsset.ID = "003"
-	demoAsset.Name = "test3"
-	demoAsset.Type = "drink"
-	createAsset(t, stub, demoAsset)
+	createTestAssets(t, stub)
 
-	invokeFunc := "getAssetByType"
-	args := [][]byte{[]byte(invokeFunc), []byte("food")}
-	invokeResult := stub.MockInvoke("12345", args)
+	tests := []struct {
+		name    string
+		args    []string
+		ids     []string
+		message string
+	}{
+		{"food", []string{"getAssetByType", "food"}, []string{"001", "002"}, ""},
+		{"type is case insensitive", []string{"getAssetByType", "DRINK"}, []string{"003"}, ""},
+		{"unknown type", []string{"getAssetByType", "toy"}, []string{}, ""},
+		{"no type", []string{"getAssetByType"}, nil, "Incorrect number of arguments. Expecting type to query"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if !assertResponse(t, tt.name, invokeResult, tt.message) {
+			continue
+		}
+		var resultPayload []DemoAsset
+		err := json.Unmarshal(invokeResult.GetPayload(), &resultPayload)
+		if err != nil {
+			t.Errorf("%s: Unmarshal failed: %s", tt.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, asset := range resultPayload {
+			ids = append(ids, asset.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("%s: get asset by type returned wrong assets, got: %v, want: %v", tt.name, ids, tt.ids)
+		}
+	}
+
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("getAssetByType", "food"))
+	assertGolden(t, "getAssetByType", invokeResult.Payload)
+}
+
+func TestGetHistoryForRecord(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+	t.Log("************ TestGetHistoryForRecord ****************")
+	// create asset
+	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1}
+	created := time.Date(2018, 5, 25, 8, 0, 0, 0, time.UTC)
+	stub.Clock = created
+	createAsset(t, stub, demoAsset)
+	// delete Asset
+	invokeFunc := "deleteAsset"
+	args := [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
+	deleted := time.Date(2018, 5, 28, 8, 0, 0, 0, time.UTC)
+	invokeResult := stub.MockInvokeAt("67890", deleted, args)
 	if invokeResult.Status != 200 {
-		t.Errorf("Create asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+		t.Errorf("Delete asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
 	}
 
+	// get history
+	invokeFunc = "getHistoryForRecord"
+	args = [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
+	invokeResult = stub.MockInvoke("12345", args)
+	if invokeResult.Status != 200 {
+		t.Errorf("Get history for record returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	}
 	t.Logf("invokeResult.Payload: %s \n", invokeResult.GetPayload())
 
-	var resultPayload []DemoAsset // []map[string]interface{}
-	err = json.Unmarshal(invokeResult.GetPayload(), &resultPayload)
-	if err != nil {
-		t.Errorf("Unmarshal failed: %s", err)
-	}
-	t.Logf("Total %d of assets! \n", len(resultPayload))
-	if len(resultPayload) != 2 {
-		t.Errorf("get asset by type return wrong number, got: %d, want: %d", len(resultPayload), 2)
-	}
-	//	t.Logf("%s \n", resultPayload[0].Name)
-}
-
-// func TestGetHistoryForRecord(t *testing.T) {
-// 	// var err error
-// 	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
-// 	if stub == nil {
-// 		t.Fatalf("MockStub creation failed")
-// 	}
-// 	t.Log("************ TestGetHistoryForRecord ****************")
-// 	// create asset
-// 	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979}
-// 	createAsset(t, stub, demoAsset)
-// 	// delete Asset
-// 	invokeFunc := "deleteAsset"
-// 	args := [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
-// 	invokeResult := stub.MockInvoke("12345", args)
-// 	if invokeResult.Status != 200 {
-// 		t.Errorf("Delete asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
-// 	}
-
-// 	// get history
-// 	invokeFunc = "getHistoryForRecord"
-// 	args = [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
-// 	invokeResult = stub.MockInvoke("12345", args)
-// 	if invokeResult.Status != 200 {
-// 		t.Errorf("Get history for record returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
-// 	}
-// 	t.Logf("invokeResult.Payload: %s \n", invokeResult.GetPayload())
-// }
+	var history []struct {
+		TxId      string
+		Value     *DemoAsset
+		Timestamp string
+		IsDelete  string
+	}
+	if err := json.Unmarshal(invokeResult.GetPayload(), &history); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Get history returned wrong number of entries, got: %d, want: %d", len(history), 2)
+	}
+	if history[0].TxId != "12345" || history[0].IsDelete != "false" || history[0].Value == nil || history[0].Value.Name != "test1" {
+		t.Errorf("Wrong create history entry: %+v", history[0])
+	}
+	if history[0].Timestamp != time.Unix(created.Unix(), 0).String() {
+		t.Errorf("Wrong create timestamp, got: %s, want: %s", history[0].Timestamp, time.Unix(created.Unix(), 0).String())
+	}
+	if history[1].TxId != "67890" || history[1].IsDelete != "true" || history[1].Value != nil {
+		t.Errorf("Wrong delete history entry: %+v", history[1])
+	}
+	if history[1].Timestamp != time.Unix(deleted.Unix(), 0).String() {
+		t.Errorf("Wrong delete timestamp, got: %s, want: %s", history[1].Timestamp, time.Unix(deleted.Unix(), 0).String())
+	}
+}
 
 func TestQueryAllAssets(t *testing.T) {
-	// var err error
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
+	t.Log("************ TestQueryAllAssets ****************")
 
-	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979}
-	createAsset(t, stub, demoAsset)
-	demoAsset.ID = "002"
-	demoAsset.Name = "test2"
-	createAsset(t, stub, demoAsset)
+	// empty ledger
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("getAllAssets"))
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != "[]" {
+		t.Errorf("Get all assets of an empty ledger returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
 
-	invokeFunc := "getAllAssets"
-	args := [][]byte{[]byte(invokeFunc)}
-	invokeResult := stub.MockInvoke("12345", args)
+	createTestAssets(t, stub)
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getAllAssets"))
 	if invokeResult.Status != 200 {
-		t.Errorf("Create asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+		t.Fatalf("Get all assets returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
 	}
-
-	//	t.Logf("invokeResult.Payload: %s \n", invokeResult.GetPayload())
-
-	// var resultPayload []map[string]interface{}
-	// err = json.Unmarshal(invokeResult.GetPayload(), &resultPayload)
-	// if err != nil {
-	// 	t.Errorf("Unmarshal failed: %s", err)
-	// }
-	// t.Logf("Total %d of assets! \n", len(resultPayload))
+	var resultPayload ResultJSON
+	err := json.Unmarshal(invokeResult.GetPayload(), &resultPayload)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	// index entries are not assets
+	if len(resultPayload) != 3 {
+		t.Fatalf("Get all assets returned wrong number, got: %d, want: %d", len(resultPayload), 3)
+	}
+	for i, id := range []string{"001", "002", "003"} {
+		if resultPayload[i].Key != id || resultPayload[i].Record.ID != id {
+			t.Errorf("Get all assets returned wrong record %d, got: %+v, want key: %s", i, resultPayload[i], id)
+		}
+	}
+	assertGolden(t, "getAllAssets", invokeResult.Payload)
 }
 
 func TestUpdateAsset(t *testing.T) {
-	// var err error
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
 	t.Log("************ TestUpdateAsset ****************")
 	// create asset
-	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979}
+	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1}
 	createAsset(t, stub, demoAsset)
-	// update Asset
-	demoAsset.Name = "test_new"
-	demoAsset.UpdatedDate = "2018-05-28"
-	updateAsset(t, stub, demoAsset)
 
-	// getAsset
-	invokeFunc := "getAsset"
-	args := [][]byte{[]byte(invokeFunc), []byte(demoAsset.ID)}
-	invokeResult := stub.MockInvoke("12345", args)
-	if invokeResult.Status != 200 {
-		t.Errorf("Get asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"missing asset", []string{"updateAsset", "999", "test", "food", "cathy", "true", "2018-05-28", "1502688979"}, "{\"Error\":\"Update asset fail - Asset does not exist: 999\"}"},
+		{"missing argument", []string{"updateAsset", "001", "test", "food", "cathy", "true", "2018-05-28"}, "Incorrect number of arguments. Expecting 7 to 9: id, name, type, owner, flag, updated date, timestamp, owner, expected version"},
+		{"empty name", []string{"updateAsset", "001", "", "food", "cathy", "true", "2018-05-28", "1502688979"}, "2nd argument must be a non-empty string"},
+		{"flag not boolean", []string{"updateAsset", "001", "test", "food", "cathy", "1.0", "2018-05-28", "1502688979"}, "5th argument must be a boolean string"},
+		{"timestamp not numeric", []string{"updateAsset", "001", "test", "food", "cathy", "true", "2018-05-28", ""}, "7th argument must be a numeric string"},
+		{"valid", []string{"updateAsset", "001", "test_new", "drink", "tom", "false", "2018-05-28", "1502688999"}, ""},
+	}
+	for _, tt := range tests {
+		before := getStateAsset(t, stub, "001")
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if !assertResponse(t, tt.name, invokeResult, tt.message) {
+			// failed updates leave the asset as it was
+			if after := getStateAsset(t, stub, "001"); *after != *before {
+				t.Errorf("%s: failed update changed the asset, got: %+v, want: %+v", tt.name, after, before)
+			}
+		}
+	}
+
+	want := DemoAsset{"001", "test_new", "DRINK", "tom", false, "2018-05-28", 1502688999, 2}
+	if got := getStateAsset(t, stub, "001"); got == nil || *got != want {
+		t.Errorf("Update asset stored wrong asset, got: %+v, want: %+v", got, want)
+	}
+	// indexes follow the new type and owner
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"FOOD", "001"}, false)
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"DRINK", "001"}, true)
+	assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"cathy", "001"}, false)
+	assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"tom", "001"}, true)
+	if stub.State["999"] != nil {
+		t.Errorf("Update of a missing asset created it")
 	}
-	t.Log("Get asset by id invokeResult.Payload: " + string(invokeResult.Payload))
 }
 
 func TestInvokeOtherCC(t *testing.T) {
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
-	if stub == nil {
-		t.Fatalf("MockStub creation failed")
-	}
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	t.Log("************ TestInvokeOtherCC ****************")
+	// invokeOtherCC requires an administrator
+	admin := NewTestCA(t, "Org1MSP").Creator(t, TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}})
+	stub.Creator = admin
 	// invoke other chaincode
 	invokeFunc, otherCCName := "invokeOtherCC", "obcs-example02"
 	// Register a peer chaincode with this MockStub
@@ -202,14 +333,58 @@ func TestInvokeOtherCC(t *testing.T) {
 	stub2.MockInit("123344", [][]byte{[]byte("Init"), []byte("a"), []byte("100"), []byte("b"), []byte("200")})
 	stub.MockPeerChaincode(otherCCName, stub2)
 	// args := [][]byte{[]byte(invokeFunc), []byte("obcs-example02"), []byte("invoke"), []byte("query"), []byte("a")}
-	// invoke test
+	// not allowlisted yet
 	args := util.ToChaincodeArgs(invokeFunc, otherCCName, "invoke", "query", "a")
 	invokeResult := stub.MockInvoke("12345", args)
+	if invokeResult.Status == 200 {
+		t.Errorf("Invoke other chaincode should fail before it is allowlisted")
+	}
+	// only admins change the allowlist
+	invokeResult = stub.MockInvokeAs(nil, "12345", "setCCAllowlist", "", otherCCName, "[\"*\"]")
+	if invokeResult.Status == 200 || !strings.HasPrefix(invokeResult.Message, "setCCAllowlist requires an administrator: ") {
+		t.Errorf("Set allowlist without an admin returned %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	invokeResult = stub.MockInvokeAs(nil, "12345", "removeCCAllowlist", "", otherCCName)
+	if invokeResult.Status == 200 || !strings.HasPrefix(invokeResult.Message, "removeCCAllowlist requires an administrator: ") {
+		t.Errorf("Remove allowlist without an admin returned %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	// allow query only
+	putCCAllowlist(t, stub.MockStub, "", otherCCName, "invoke:query")
+	// invoke test
+	invokeResult = stub.MockInvokeAs(admin, "12345", invokeFunc, otherCCName, "invoke", "query", "a")
 	if invokeResult.Status != 200 {
 		t.Errorf("Invoke other chaincode returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
 	}
+	if string(invokeResult.Payload) != "100" {
+		t.Errorf("Invoke other chaincode returned wrong payload, got: %s, want: %s.", invokeResult.Payload, "100")
+	}
 	t.Log("Invoke other chaincode invokeResult.Payload: " + string(invokeResult.Payload))
 
+	// move is not allowlisted
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs(invokeFunc, otherCCName, "invoke", "move", "a", "b", "10"))
+	if invokeResult.Status == 200 {
+		t.Errorf("Invoke other chaincode should reject a function outside the allowlist")
+	}
+
+	// callee errors are passed back intact
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs(invokeFunc, otherCCName, "invoke", "query", "nobody"))
+	if invokeResult.Status != 500 || invokeResult.Message != "{\"Error\":\"Nil amount for nobody\"}" {
+		t.Errorf("Invoke other chaincode did not propagate the callee error, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+
+	// invoke on another channel
+	stub.MockPeerChaincode(otherCCName+"/otherchannel", stub2)
+	args = util.ToChaincodeArgs("invokeOtherChannelCC", "otherchannel", otherCCName, "invoke", "query", "b")
+	invokeResult = stub.MockInvoke("12345", args)
+	if invokeResult.Status == 200 {
+		t.Errorf("Invoke other channel chaincode should fail before it is allowlisted")
+	}
+	putCCAllowlist(t, stub.MockStub, "otherchannel", otherCCName, AllowAllFunctions)
+	invokeResult = stub.MockInvoke("12345", args)
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != "200" {
+		t.Errorf("Invoke other channel chaincode failed, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
 	// invoke chaincode directly
 	// invokeResult := stub.InvokeChaincode("example02_cc", ccArgs, "mychan")
 	// if invokeResult.Status != 200 {
@@ -219,35 +394,98 @@ func TestInvokeOtherCC(t *testing.T) {
 	// t.Log("Get asset by id invokeResult.Payload: " + string(invokeResult.Payload))
 }
 
-// func TestCreator(t *testing.T) {
-// 	// var err error
-// 	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
-// 	if stub == nil {
-// 		t.Fatalf("MockStub creation failed")
-// 	}
-// 	t.Log("************ TestCreator ****************")
-
-// 	// getCertificate
-// 	invokeFunc := "getCertificate"
-// 	args := [][]byte{[]byte(invokeFunc), []byte("")}
-// 	invokeResult := stub.MockInvoke("12345", args)
-// 	if invokeResult.Status != 200 {
-// 		t.Errorf("Get creator cert returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
-// 	}
-// 	t.Log("Get creator cert invokeResult.Payload: " + string(invokeResult.Payload))
-// }
+// putCCAllowlist - write an allowlist entry as setCCAllowlist does for an admin
+func putCCAllowlist(t *testing.T, stub *shim.MockStub, channel string, chaincode string, functions ...string) {
+	entry := CCAllowlistEntry{Channel: resolveChannel(stub, channel), Chaincode: chaincode, Functions: functions}
+	key, err := stub.CreateCompositeKey(CCAllowlistIndex, []string{entry.Channel, entry.Chaincode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryJSONasBytes, _ := json.Marshal(entry)
+	stub.MockTransactionStart("allowlist")
+	stub.PutState(key, entryJSONasBytes)
+	stub.MockTransactionEnd("allowlist")
+}
+
+func TestCreator(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+	t.Log("************ TestCreator ****************")
+	ca := NewTestCA(t, "Org1MSP")
+	stub.SetIdentity(t, ca, TestIdentity{CommonName: "user1", Attrs: map[string]string{"role": "maker"}})
+
+	// getCertificate
+	invokeFunc := "getCertificate"
+	args := [][]byte{[]byte(invokeFunc), []byte("")}
+	invokeResult := stub.MockInvoke("12345", args)
+	if invokeResult.Status != 200 {
+		t.Errorf("Get creator cert returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	}
+	if string(invokeResult.Payload) != "Called testCertificate user1" {
+		t.Errorf("Get creator cert returned wrong payload, got: %s", invokeResult.Payload)
+	}
+	t.Log("Get creator cert invokeResult.Payload: " + string(invokeResult.Payload))
+
+	// getTxCreatorInfo
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getTxCreatorInfo"))
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != "userOrg: Org1MSP, userName: user1" {
+		t.Errorf("Get creator info returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// getABAC
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getABAC", "role"))
+	if invokeResult.Status != 200 || !strings.HasSuffix(string(invokeResult.Payload), "\"role\":\"maker\"}") {
+		t.Errorf("Get ABAC returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getABAC", "hf.Type"))
+	if invokeResult.Status == 200 {
+		t.Errorf("Get ABAC should fail for a missing attribute")
+	}
+
+	// an idemix creator has no certificate and no name
+	idemixID, _ := proto.Marshal(&msp.SerializedIdemixIdentity{NymX: []byte{1}, NymY: []byte{2}, Proof: []byte{3}})
+	stub.Creator = serializeIdentity(t, "IdemixOrg", idemixID)
+	assertResponse(t, "getCertificate idemix", stub.MockInvoke("12345", util.ToChaincodeArgs("getCertificate")), "The creator has no certificate, it is an idemix identity of IdemixOrg")
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getTxCreatorInfo"))
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != "userOrg: IdemixOrg, userName: " {
+		t.Errorf("Get creator info returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// malformed creators are errors, not panics
+	stub.Creator = serializeIdentity(t, "Org1MSP", []byte("-----BEGIN CERTIFICATE-----"))
+	assertResponse(t, "getCertificate malformed", stub.MockInvoke("12345", util.ToChaincodeArgs("getCertificate")),
+		"Creator identity of Org1MSP is neither an X.509 certificate nor an idemix identity")
+	assertResponse(t, "getTxCreatorInfo malformed", stub.MockInvoke("12345", util.ToChaincodeArgs("getTxCreatorInfo")),
+		"Error deserializing creator identity: Creator identity of Org1MSP is neither an X.509 certificate nor an idemix identity")
+	stub.Creator = nil
+	assertResponse(t, "getCertificate no creator", stub.MockInvoke("12345", util.ToChaincodeArgs("getCertificate")), "The transaction has no creator")
+}
 
 func TestGetTxTimestamp(t *testing.T) {
-	stub := shim.NewMockStub("GetTxTimestamp", new(MyChaincode))
+	stub := NewTestStub("GetTxTimestamp", new(MyChaincode))
 	// stub := NewMockStub("GetTxTimestamp", nil)
+	stub.Clock = time.Date(2018, 5, 25, 8, 0, 0, 0, time.UTC)
 	stub.MockTransactionStart("init")
 
 	timestamp, err := stub.GetTxTimestamp()
 	if timestamp == nil || err != nil {
 		t.FailNow()
 	}
+	if timestamp.Seconds != stub.Clock.Unix() {
+		t.Errorf("GetTxTimestamp is not the stub clock, got: %d, want: %d", timestamp.Seconds, stub.Clock.Unix())
+	}
 	t.Logf("GetTxTimestamp: %d", timestamp)
 	stub.MockTransactionEnd("init")
+
+	// the clock advances for every transaction
+	stub.MockTransactionStart("next")
+	next, _ := stub.GetTxTimestamp()
+	if next.Seconds != timestamp.Seconds+1 {
+		t.Errorf("GetTxTimestamp did not advance, got: %d, want: %d", next.Seconds, timestamp.Seconds+1)
+	}
+	stub.MockTransactionEnd("next")
 }
 
 func TestTestRESTCC(t *testing.T) {
@@ -256,18 +494,120 @@ func TestTestRESTCC(t *testing.T) {
 		t.Fatalf("MockStub creation failed")
 	}
 	t.Log("************ TestTestRESTCC ****************")
+	// no network access, the REST service is replaced by a fake transport
+	defer func(transport http.RoundTripper) { restClient.Transport = transport }(restClient.Transport)
 
-	// TestRESTCC
-	invokeFunc := "testRESTCC"
-	args := [][]byte{[]byte(invokeFunc)}
-	invokeResult := stub.MockInvoke("12345", args)
-	if invokeResult.Status != 200 {
-		t.Errorf("testRESTCC returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	tests := []struct {
+		name     string
+		response *http.Response
+		err      error
+		payload  string
+		message  string
+	}{
+		{"ok", fakeHTTPResponse(http.StatusOK, `{"items":[]}`), nil, `{"items":[]}`, ""},
+		{"server error", fakeHTTPResponse(http.StatusInternalServerError, "down"), nil, "", "testRESTCC response status: 500 Internal Server Error"},
+		{"unreachable", nil, errors.New("connection refused"), "", "testRESTCC request failed: Get " + testRESTURL + ": connection refused"},
+	}
+	for _, tt := range tests {
+		var requested string
+		restClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requested = req.URL.String()
+			return tt.response, tt.err
+		})
+
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("testRESTCC"))
+		if requested != testRESTURL {
+			t.Errorf("%s: testRESTCC requested wrong url, got: %s, want: %s", tt.name, requested, testRESTURL)
+		}
+		if tt.message != "" {
+			// url.Error quotes the url since go1.14
+			message := strings.Replace(invokeResult.Message, "\""+testRESTURL+"\"", testRESTURL, 1)
+			if invokeResult.Status == 200 || message != tt.message {
+				t.Errorf("%s: testRESTCC returned wrong error, got: %d %s, want: %s", tt.name, invokeResult.Status, invokeResult.Message, tt.message)
+			}
+			continue
+		}
+		if invokeResult.Status != 200 || string(invokeResult.Payload) != tt.payload {
+			t.Errorf("%s: testRESTCC returned wrong result, got: %d %s, want: %s", tt.name, invokeResult.Status, invokeResult.Payload, tt.payload)
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper answering requests without network access
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func fakeHTTPResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     make(http.Header),
+	}
+}
+
+// assertResponse checks the status and error message of a response, it returns true for a successful response
+func assertResponse(t *testing.T, name string, invokeResult peer.Response, message string) bool {
+	t.Helper()
+	if message == "" {
+		if invokeResult.Status != 200 {
+			t.Errorf("%s: returned non-OK status, got: %d, want: %d. %s", name, invokeResult.Status, 200, invokeResult.Message)
+		}
+		return invokeResult.Status == 200
+	}
+	if invokeResult.Status == 200 {
+		t.Errorf("%s: should fail with %q", name, message)
+		return true
+	}
+	if invokeResult.Message != message {
+		t.Errorf("%s: returned wrong error, got: %q, want: %q", name, invokeResult.Message, message)
+	}
+	return false
+}
+
+// assertIndex checks whether the index entry of an asset is in state
+func assertIndex(t *testing.T, stub *TestStub, indexName string, attributes []string, exists bool) {
+	t.Helper()
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		t.Fatalf("Failed to create index key: %s", err)
 	}
-	t.Log("testRESTCC invokeResult.Payload: " + string(invokeResult.Payload))
+	if (stub.State[indexKey] != nil) != exists {
+		t.Errorf("Index %s %v exists: %t, want: %t", indexName, attributes, !exists, exists)
+	}
+}
+
+// getStateAsset reads an asset directly from state, nil if it does not exist
+func getStateAsset(t *testing.T, stub *TestStub, id string) *DemoAsset {
+	t.Helper()
+	assetBytes := stub.State[id]
+	if assetBytes == nil {
+		return nil
+	}
+	demoAsset := &DemoAsset{}
+	if err := json.Unmarshal(assetBytes, demoAsset); err != nil {
+		t.Fatalf("Unmarshal asset %s failed: %s", id, err)
+	}
+	return demoAsset
+}
+
+// createTestAssets creates 001 and 002 of type food and 003 of type drink
+func createTestAssets(t *testing.T, stub mockInvoker) {
+	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1}
+	createAsset(t, stub, demoAsset)
+	demoAsset.ID = "002"
+	demoAsset.Name = "test2"
+	createAsset(t, stub, demoAsset)
+	demoAsset.ID = "003"
+	demoAsset.Name = "test3"
+	demoAsset.Type = "drink"
+	createAsset(t, stub, demoAsset)
 }
 
-func createAsset(t *testing.T, stub *shim.MockStub, demoAsset DemoAsset) {
+func createAsset(t *testing.T, stub mockInvoker, demoAsset DemoAsset) {
 	// args := [][]byte{[]byte("creatAsset"), []byte("001"), []byte("test"), []byte("type"), []byte("cathy"), []byte("true"), []byte("2018-05-25"), []byte("1502688979")}
 	invokeFunc := "creatAsset"
 
@@ -284,7 +624,7 @@ func createAsset(t *testing.T, stub *shim.MockStub, demoAsset DemoAsset) {
 	}
 }
 
-func updateAsset(t *testing.T, stub *shim.MockStub, demoAsset DemoAsset) {
+func updateAsset(t *testing.T, stub mockInvoker, demoAsset DemoAsset) {
 	// args := [][]byte{[]byte("creatAsset"), []byte("001"), []byte("test"), []byte("type"), []byte("cathy"), []byte("true"), []byte("2018-05-25"), []byte("1502688979")}
 	invokeFunc := "updateAsset"
 
@@ -301,7 +641,6 @@ func updateAsset(t *testing.T, stub *shim.MockStub, demoAsset DemoAsset) {
 	}
 }
 
-
 func TestFireCCEvent(t *testing.T) {
 	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
@@ -309,51 +648,1601 @@ func TestFireCCEvent(t *testing.T) {
 	}
 	t.Log("************ Test fireCCEvent ****************")
 
-	// fireCCEvent
-	invokeFunc := "fireCCEvent"
-	args := [][]byte{[]byte(invokeFunc), []byte("Event body")}
-	invokeResult := stub.MockInvoke("12345", args)
-	if invokeResult.Status != 200 {
-		t.Errorf("fireCCEvent returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"event body", []string{"fireCCEvent", "Event body"}, "Event body"},
+		{"default body", []string{"fireCCEvent"}, "Defaulting"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if invokeResult.Status != 200 || string(invokeResult.Payload) != tt.want {
+			t.Errorf("%s: fireCCEvent returned wrong result, got: %d %s, want: %s", tt.name, invokeResult.Status, invokeResult.Payload, tt.want)
+		}
+		select {
+		case ccEvent := <-stub.ChaincodeEventsChannel:
+			if ccEvent.EventName != "testEvent" || string(ccEvent.Payload) != tt.want {
+				t.Errorf("%s: fireCCEvent emitted wrong event, got: %s %s", tt.name, ccEvent.EventName, ccEvent.Payload)
+			}
+		default:
+			t.Errorf("%s: fireCCEvent did not emit an event", tt.name)
+		}
 	}
-	t.Log("fireCCEvent invokeResult.Payload: " + string(invokeResult.Payload))
 }
 
-
 func TestRichQuery(t *testing.T) {
-	var err error
-	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
 	t.Log("************ Test RichQuery ****************")
-	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979}
-	createAsset(t, stub, demoAsset)
-	demoAsset.ID = "002"
-	demoAsset.Name = "test2"
-	createAsset(t, stub, demoAsset)
-	demoAsset.ID = "003"
-	demoAsset.Name = "test3"
-	demoAsset.Type = "drink"
-	createAsset(t, stub, demoAsset)
+	createTestAssets(t, stub)
 
 	invokeFunc := "richQuery"
 	args := [][]byte{[]byte(invokeFunc), []byte("{\"selector\": {\"owner\":\"cathy\"}}")}
 	result := stub.MockInvoke("12345", args)
 	if result.Status != 200 {
-		t.Errorf("Rich Query returned non-OK status, got: %d, want: %d.", result.Status, 200)
+		t.Fatalf("Rich Query returned non-OK status, got: %d, want: %d.", result.Status, 200)
 	}
 
-	t.Logf("Rich Query: %s \n", result.GetPayload())
-
-	var resultPayload []DemoAsset // []map[string]interface{}
-	err = json.Unmarshal(result.GetPayload(), &resultPayload)
+	var resultPayload ResultJSON
+	err := json.Unmarshal(result.GetPayload(), &resultPayload)
 	if err != nil {
-		t.Errorf("Unmarshal failed: %s", err)
+		t.Fatalf("Unmarshal failed: %s", err)
 	}
-	t.Logf("Total %d of assets! \n", len(resultPayload))
 	if len(resultPayload) != 3 {
 		t.Errorf("Rich Query return wrong number, got: %d, want: %d", len(resultPayload), 3)
 	}
-	//	t.Logf("%s \n", resultPayload[0].Name)
-}
\ No newline at end of file
+	for _, result := range resultPayload {
+		if result.Record.Owner != "cathy" || result.Key != result.Record.ID {
+			t.Errorf("Rich Query returned wrong record: %+v", result)
+		}
+	}
+	assertGolden(t, "richQuery", result.Payload)
+
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"no query", []string{"richQuery"}, "Incorrect number of arguments. Expecting 1"},
+		{"invalid query", []string{"richQuery", "{\"selector\":"}, "Rich query failed"},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...)), tt.message)
+	}
+}
+
+func TestAssetEvents(t *testing.T) {
+	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+	t.Log("************ TestAssetEvents ****************")
+	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1}
+	createAsset(t, stub, demoAsset)
+	created := nextAssetEvent(t, stub)
+	if created.EventType != EventAssetCreated || created.AssetID != "001" || created.AssetType != "FOOD" {
+		t.Errorf("Unexpected create event: %+v", created)
+	}
+	if created.BeforeDigest != "" || created.AfterDigest == "" || created.TxID != "12345" {
+		t.Errorf("Unexpected create event digests: %+v", created)
+	}
+
+	demoAsset.Name = "test_new"
+	updateAsset(t, stub, demoAsset)
+	updated := nextAssetEvent(t, stub)
+	if updated.EventType != EventAssetUpdated || updated.BeforeDigest != created.AfterDigest || updated.AfterDigest == created.AfterDigest {
+		t.Errorf("Unexpected update event: %+v", updated)
+	}
+
+	args := [][]byte{[]byte("deleteAsset"), []byte(demoAsset.ID)}
+	invokeResult := stub.MockInvoke("12345", args)
+	if invokeResult.Status != 200 {
+		t.Errorf("Delete asset returned non-OK status, got: %d, want: %d.", invokeResult.Status, 200)
+	}
+	deleted := nextAssetEvent(t, stub)
+	if deleted.EventType != EventAssetDeleted || deleted.BeforeDigest != updated.AfterDigest || deleted.AfterDigest != "" {
+		t.Errorf("Unexpected delete event: %+v", deleted)
+	}
+}
+
+func TestPutPrivateDataArguments(t *testing.T) {
+	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestPutPrivateDataArguments ****************")
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"no arguments", []string{"putPrivateData"}, "Incorrect number of arguments. Expecting 2: collection, marble JSON, or 1 with the marble in the transient map"},
+		{"no transient marble", []string{"putPrivateData", "privateDataCollection"}, "marble must be a key in the transient map"},
+		{"not JSON", []string{"putPrivateData", "privateDataCollection", `{"MarbleID":`}, "2nd argument must be a marble JSON: unexpected end of JSON input"},
+		{"no id", []string{"putPrivateData", "privateDataCollection", `{"Name":"mmm","Color":"red"}`}, "MarbleID must be a non-empty string"},
+	}
+	for _, tt := range tests {
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...))
+		if invokeResult.Status == shim.OK || invokeResult.Message != tt.message {
+			t.Errorf("%s: got %d %q, want: %q", tt.name, invokeResult.Status, invokeResult.Message, tt.message)
+		}
+	}
+}
+
+func nextAssetEvent(t *testing.T, stub *shim.MockStub) AssetEvent {
+	var event AssetEvent
+	select {
+	case ccEvent := <-stub.ChaincodeEventsChannel:
+		if ccEvent.EventName != AssetEventName {
+			t.Errorf("Unexpected event name, got: %s, want: %s", ccEvent.EventName, AssetEventName)
+		}
+		if err := json.Unmarshal(ccEvent.Payload, &event); err != nil {
+			t.Errorf("Unmarshal event failed: %s", err)
+		}
+	default:
+		t.Errorf("No chaincode event was emitted")
+	}
+	return event
+}
+
+func TestPurchaseAsset(t *testing.T) {
+	stub := shim.NewMockStub("mockChaincodeStub", new(MyChaincode))
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+	t.Log("************ TestPurchaseAsset ****************")
+	stub2 := shim.NewMockStub("mockChaincodeStub", new(exampleCC.SimpleChaincode))
+	stub2.MockInit("123344", [][]byte{[]byte("Init"), []byte("a"), []byte("100"), []byte("cathy"), []byte("200")})
+	stub.MockPeerChaincode(Example02CCName, stub2)
+	putCCAllowlist(t, stub, "", Example02CCName, "invoke:query", "invoke:move")
+
+	demoAsset := DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1}
+	createAsset(t, stub, demoAsset)
+
+	var tests = []struct {
+		name    string
+		offer   *Offer
+		price   string
+		message string
+	}{
+		{"not for sale", nil, "60", "Asset 001 is not offered for sale by its owner cathy"},
+		{"offer of a previous owner", &Offer{"001", "bob", 60}, "60", "Asset 001 is not offered for sale by its owner cathy"},
+		{"below asking price", &Offer{"001", "cathy", 60}, "10", "Price 10 does not match the asking price 60"},
+		{"anonymous buyer", &Offer{"001", "cathy", 60}, "60", "The caller must be identified"},
+	}
+	for _, test := range tests {
+		if test.offer != nil {
+			putOffer(t, stub, *test.offer)
+		}
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("purchaseAsset", "001", "a", test.price))
+		if invokeResult.Status == 200 || !strings.HasPrefix(invokeResult.Message, test.message) {
+			t.Errorf("%s: purchase should fail with %q, got: %d %s", test.name, test.message, invokeResult.Status, invokeResult.Message)
+		}
+	}
+	if string(stub2.State["a"]) != "100" || string(stub2.State["cathy"]) != "200" {
+		t.Errorf("Rejected purchases moved balances, got: a=%s cathy=%s", stub2.State["a"], stub2.State["cathy"])
+	}
+
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("offerAsset", "001", "60"))
+	if invokeResult.Status == 200 || !strings.HasPrefix(invokeResult.Message, "The caller must be identified") {
+		t.Errorf("Anonymous offer should fail, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+}
+
+func TestOfferAndPurchaseAsset(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestOfferAndPurchaseAsset ****************")
+	stub2 := shim.NewMockStub("mockChaincodeStub", new(exampleCC.SimpleChaincode))
+	stub2.MockInit("123344", [][]byte{[]byte("Init"), []byte("a"), []byte("100"), []byte("cathy"), []byte("200")})
+	stub.MockPeerChaincode(Example02CCName, stub2)
+	putCCAllowlist(t, stub.MockStub, "", Example02CCName, "invoke:query", "invoke:move")
+	createAsset(t, stub, DemoAsset{"001", "test1", "food", "cathy", true, "2018-05-25", 1502688979, 1})
+	ca := NewTestCA(t, "Org1MSP")
+
+	var tests = []struct {
+		name    string
+		caller  string
+		args    []string
+		message string
+	}{
+		{"stranger offers", "a", []string{"offerAsset", "001", "60"}, "Only the owner can offer the asset, a is not the owner cathy"},
+		{"owner offers", "cathy", []string{"offerAsset", "001", "60"}, ""},
+		{"stranger withdraws", "a", []string{"withdrawOffer", "001"}, "Only the seller can withdraw the offer, a is not the seller cathy"},
+		{"owner buys", "cathy", []string{"purchaseAsset", "001", "cathy", "60"}, "Buyer already owns the asset: cathy"},
+		{"spend another balance", "cathy", []string{"purchaseAsset", "001", "a", "60"}, "Only the buyer can purchase, a is not the caller cathy"},
+		{"below asking price", "a", []string{"purchaseAsset", "001", "a", "50"}, "Price 50 does not match the asking price 60"},
+		{"buyer purchases", "a", []string{"purchaseAsset", "001", "a", "60"}, ""},
+		{"sold asset is off sale", "a", []string{"withdrawOffer", "001"}, "Asset is not offered for sale: 001"},
+	}
+	for _, test := range tests {
+		stub.SetIdentity(t, ca, TestIdentity{CommonName: test.caller})
+		invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs(test.args...))
+		if test.message == "" && invokeResult.Status != 200 {
+			t.Fatalf("%s: returned non-OK status, got: %d, want: %d. %s", test.name, invokeResult.Status, 200, invokeResult.Message)
+		} else if test.message != "" && (invokeResult.Status == 200 || invokeResult.Message != test.message) {
+			t.Errorf("%s: should fail with %q, got: %d %s", test.name, test.message, invokeResult.Status, invokeResult.Message)
+		}
+	}
+
+	purchased, err := getDemoAsset(stub, "001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purchased.Owner != "a" {
+		t.Errorf("Purchase did not change the owner, got: %s", purchased.Owner)
+	}
+	if string(stub2.State["a"]) != "40" || string(stub2.State["cathy"]) != "260" {
+		t.Errorf("Purchase did not move balances, got: a=%s cathy=%s", stub2.State["a"], stub2.State["cathy"])
+	}
+	oldIndex, _ := stub.CreateCompositeKey(AssetQueryMap["AssetOwner"], []string{"cathy", "001"})
+	newIndex, _ := stub.CreateCompositeKey(AssetQueryMap["AssetOwner"], []string{"a", "001"})
+	if stub.State[oldIndex] != nil || stub.State[newIndex] == nil {
+		t.Errorf("Purchase did not update the owner index")
+	}
+}
+
+// putOffer - write an offer straight to the ledger, the way offerAsset stores it
+func putOffer(t *testing.T, stub *shim.MockStub, offer Offer) {
+	key, err := stub.CreateCompositeKey(OfferObjectType, []string{offer.AssetID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offerJSONasBytes, _ := json.Marshal(offer)
+	stub.MockTransactionStart("offer")
+	stub.PutState(key, offerJSONasBytes)
+	stub.MockTransactionEnd("offer")
+}
+
+func TestRichQuerySelectors(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	createAsset(t, stub, DemoAsset{"001", "apple", "food", "cathy", true, "2018-05-25", 1502688979, 1})
+	createAsset(t, stub, DemoAsset{"002", "banana", "food", "tom", false, "2018-05-26", 1502688980, 1})
+	createAsset(t, stub, DemoAsset{"003", "cola", "drink", "cathy", true, "2018-05-27", 1502688981, 1})
+	createAsset(t, stub, DemoAsset{"004", "milk", "drink", "jerry", false, "2018-05-28", 1502688982, 1})
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"eq", `{"selector": {"owner": "cathy"}}`, "001,003"},
+		{"explicit eq", `{"selector": {"type": {"$eq": "DRINK"}}}`, "003,004"},
+		{"gt", `{"selector": {"timeStamp": {"$gt": 1502688980}}}`, "003,004"},
+		{"lt and gte", `{"selector": {"timeStamp": {"$gte": 1502688980, "$lt": 1502688982}}}`, "002,003"},
+		{"in", `{"selector": {"owner": {"$in": ["tom", "jerry"]}}}`, "002,004"},
+		{"regex", `{"selector": {"name": {"$regex": "^[a-c]"}}}`, "001,002,003"},
+		{"and", `{"selector": {"$and": [{"type": "FOOD"}, {"flag": true}]}}`, "001"},
+		{"or", `{"selector": {"$or": [{"owner": "tom"}, {"name": "milk"}]}}`, "002,004"},
+		{"sort desc", `{"selector": {"owner": "cathy"}, "sort": [{"timeStamp": "desc"}]}`, "003,001"},
+		{"limit skip", `{"selector": {"flag": {"$exists": true}}, "skip": 1, "limit": 2}`, "002,003"},
+		{"no match", `{"selector": {"owner": "nobody"}}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := stub.MockInvoke("12345", util.ToChaincodeArgs("richQuery", tt.query))
+			if result.Status != 200 {
+				t.Fatalf("Rich Query returned non-OK status, got: %d, want: %d. %s", result.Status, 200, result.Message)
+			}
+			var records []struct {
+				Key    string    `json:"Key"`
+				Record DemoAsset `json:"Record"`
+			}
+			if err := json.Unmarshal(result.GetPayload(), &records); err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+			keys := []string{}
+			for _, record := range records {
+				if record.Key != record.Record.ID {
+					t.Errorf("Rich Query returned key %s for record %s", record.Key, record.Record.ID)
+				}
+				keys = append(keys, record.Key)
+			}
+			if strings.Join(keys, ",") != tt.want {
+				t.Errorf("Rich Query returned wrong assets, got: %v, want: %s", keys, tt.want)
+			}
+		})
+	}
+
+	// nested fields
+	stub.MockTransactionStart("nested")
+	stub.PutState("m_001", []byte(`{"MarbleID":"m_001","Metadata":{"origin":{"country":"CN"}}}`))
+	stub.MockTransactionEnd("nested")
+	for _, query := range []string{
+		`{"selector": {"Metadata.origin.country": "CN"}}`,
+		`{"selector": {"Metadata": {"origin": {"country": {"$eq": "CN"}}}}}`,
+	} {
+		result := stub.MockInvoke("12345", util.ToChaincodeArgs("richQuery", query))
+		if result.Status != 200 || !strings.Contains(string(result.Payload), `"Key":"m_001"`) || strings.Count(string(result.Payload), `"Key"`) != 1 {
+			t.Errorf("Nested field query %s returned: %d %s", query, result.Status, result.Payload)
+		}
+	}
+}
+
+func TestPrivateData(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	stub.LoadCollections(t, "collection_definition.json")
+	stub.MSPID = "OBPFounder"
+	t.Log("************ TestPrivateData ****************")
+
+	marble := `{"MarbleID":"m_001","Name":"mmm","Color":"red","Size":"10","OwnerID":"ssd"}`
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("putPrivateData", "privateDataCollection", marble))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Put private data returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	if stub.State["m_001"] != nil {
+		t.Errorf("Private data leaked into the public state")
+	}
+	// every channel member sees the event, it must not name the marble
+	event := nextAssetEvent(t, stub.MockStub)
+	if event.EventType != EventPrivateDataPut || event.Collection != "privateDataCollection" ||
+		event.AssetID != "" || event.BeforeDigest != "" || event.AfterDigest != "" {
+		t.Errorf("Private data event leaked the marble, got: %+v", event)
+	}
+
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getPrivateData", "privateDataCollection", "m_001"))
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != marble {
+		t.Errorf("Get private data returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	// private data is per collection
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getPrivateData", "collectionPrivateDetails", "m_001"))
+	if invokeResult.Status == 200 {
+		t.Errorf("Get private data should not find the marble in another collection")
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("putPrivateData", "noSuchCollection", marble))
+	if invokeResult.Status == 200 {
+		t.Errorf("Put private data should fail for an undefined collection")
+	}
+
+	// marble passed in the transient map
+	stub.Transient = map[string][]byte{"marble": []byte(`{"MarbleID":"m_002","Name":"nnn","Color":"blue","Size":"20","OwnerID":"ssd"}`)}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("putPrivateData", "collectionPrivateDetails"))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Put transient private data returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	if stub.PrivateState["collectionPrivateDetails"]["m_002"] == nil {
+		t.Errorf("Transient marble was not stored")
+	}
+
+	// peers of other orgs do not hold the private data
+	stub.MSPID = "myfabric"
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getPrivateData", "privateDataCollection", "m_001"))
+	if invokeResult.Status != 200 {
+		t.Errorf("Member peer should read private data, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getPrivateData", "collectionPrivateDetails", "m_002"))
+	if invokeResult.Status == 200 {
+		t.Errorf("Non-member peer should not read private data, got: %s", invokeResult.Payload)
+	}
+}
+
+// failingWriteStub fails every state write, the reads go to the TestStub
+type failingWriteStub struct {
+	*TestStub
+}
+
+func (s failingWriteStub) PutState(key string, value []byte) error {
+	return errors.New("put failed")
+}
+
+func (s failingWriteStub) DelState(key string) error {
+	return errors.New("delete failed")
+}
+
+func TestIndexWriteErrors(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestIndexWriteErrors ****************")
+	demoAsset := &DemoAsset{ID: "001", Name: "test", Type: "FOOD", Owner: "cathy"}
+	if err := createIndexHelper(failingWriteStub{stub}, demoAsset); err == nil || err.Error() != "put failed" {
+		t.Errorf("createIndexHelper returned %v, want: put failed", err)
+	}
+	if err := deleteIndexHelper(failingWriteStub{stub}, demoAsset); err == nil || err.Error() != "delete failed" {
+		t.Errorf("deleteIndexHelper returned %v, want: delete failed", err)
+	}
+}
+
+func TestCleanIndex(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestCleanIndex ****************")
+	indexName := AssetQueryMap["AssetType"]
+	stub.MockTransactionStart("v1")
+	assetJSON, _ := json.Marshal(DemoAsset{"001", "test001", "FOOD", "tom", true, "2018-05-25", 1502688979, 1})
+	stub.PutState("001", assetJSON)
+	stub.PutState("002", []byte(`{"id":`))
+	for _, attributes := range [][]string{{"DRINK", "003"}, {"FOOD", "001"}, {"FOOD", "002"}} {
+		indexKey, _ := stub.CreateCompositeKey(indexName, attributes)
+		stub.PutState(indexKey, []byte{0x00})
+	}
+	stub.MockTransactionEnd("v1")
+
+	// an asset that cannot be read fails the clean up instead of losing its entry
+	cursor, count := "", 0
+	stub.MockTransactionStart("clean1")
+	_, err := cleanIndex(stub, "AssetType", indexName, &cursor, 10, &count)
+	stub.MockTransactionEnd("clean1")
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to unmarshal asset 002") {
+		t.Errorf("cleanIndex should fail on an unreadable asset, got: %v", err)
+	}
+	assertIndex(t, stub, indexName, []string{"FOOD", "002"}, true)
+
+	// resume after the first FOOD entry, the DRINK entry before the cursor is left alone
+	stub.MockTransactionStart("fix")
+	assetJSON, _ = json.Marshal(DemoAsset{"002", "test002", "FOOD", "tom", true, "2018-05-25", 1502688980, 1})
+	stub.PutState("002", assetJSON)
+	stub.MockTransactionEnd("fix")
+	cursor, _ = stub.CreateCompositeKey(indexName, []string{"FOOD", "001"})
+	count = 0
+	stub.MockTransactionStart("clean2")
+	more, err := cleanIndex(stub, "AssetType", indexName, &cursor, 10, &count)
+	stub.MockTransactionEnd("clean2")
+	if err != nil || more || count != 1 {
+		t.Errorf("cleanIndex resumed wrongly, got: more %v, count %d, err %v", more, count, err)
+	}
+	assertIndex(t, stub, indexName, []string{"DRINK", "003"}, true)
+	assertIndex(t, stub, indexName, []string{"FOOD", "002"}, true)
+
+	// from the start the entry of the deleted asset 003 goes
+	cursor, count = "", 0
+	stub.MockTransactionStart("clean3")
+	_, err = cleanIndex(stub, "AssetType", indexName, &cursor, 10, &count)
+	stub.MockTransactionEnd("clean3")
+	if err != nil || count != 3 {
+		t.Errorf("cleanIndex returned wrong result, got: count %d, err %v", count, err)
+	}
+	assertIndex(t, stub, indexName, []string{"DRINK", "003"}, false)
+	assertIndex(t, stub, indexName, []string{"FOOD", "001"}, true)
+}
+
+func TestInitMigrations(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestInitMigrations ****************")
+
+	// ledger written by v1: a record without flag and timeStamp, records without version,
+	// and the type index of 002 still pointing at DRINK after its type was updated to FOOD
+	stub.MockTransactionStart("v1")
+	stub.PutState("001", []byte(`{"id":"001","name":"old","type":"FOOD","owner":"cathy"}`))
+	for i, id := range []string{"002", "003", "004", "005"} {
+		assetJSON, _ := json.Marshal(DemoAsset{id, "test" + id, "FOOD", "tom", true, "2018-05-25", 1502688979 + i, 0})
+		stub.PutState(id, assetJSON)
+	}
+	staleIndex, _ := stub.CreateCompositeKey(AssetQueryMap["AssetType"], []string{"DRINK", "002"})
+	stub.PutState(staleIndex, []byte{0x00})
+	stub.MockTransactionEnd("v1")
+
+	var status SchemaStatus
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("getSchemaStatus"))
+	if err := json.Unmarshal(invokeResult.Payload, &status); err != nil || status.Version != 0 || status.Target != 3 {
+		t.Fatalf("Get schema status of a v1 ledger returned wrong status, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// upgrade migrates 2 records per transaction
+	invokeResult = stub.MockInit("upgrade", util.ToChaincodeArgs("init", "", "2"))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	json.Unmarshal(invokeResult.Payload, &status)
+	if status.Version != 0 || status.Cursor != "002" || status.Next != migrations[0].Description {
+		t.Errorf("Init returned wrong status, got: %+v", status)
+	}
+
+	// migrate requires an administrator
+	stub.SetIdentity(t, NewTestCA(t, "Org1MSP"), TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}})
+	// resume until done: rewriting 5 assets, indexing 5 assets, checking 11 index entries and versioning
+	// 5 assets take 12 transactions of 2 records, a completed step hands over within the transaction
+	transactions := 1
+	for status.Version < status.Target {
+		if transactions > 20 {
+			t.Fatalf("Migration did not complete, status: %+v", status)
+		}
+		invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("migrate", "2"))
+		if invokeResult.Status != 200 {
+			t.Fatalf("Migrate returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+		}
+		status = SchemaStatus{}
+		json.Unmarshal(invokeResult.Payload, &status)
+		transactions++
+	}
+	if transactions != 12 || status.Cursor != "" || status.Next != "" {
+		t.Errorf("Migration completed with wrong status after %d transactions: %+v", transactions, status)
+	}
+
+	want := DemoAsset{"001", "old", "FOOD", "cathy", false, "", 0, 1}
+	if string(stub.State["001"]) != `{"id":"001","name":"old","type":"FOOD","owner":"cathy","flag":false,"updatedDate":"","timeStamp":0,"version":1}` {
+		t.Errorf("Migration did not rewrite the v1 record, got: %s, want: %+v", stub.State["001"], want)
+	}
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"DRINK", "002"}, false)
+	for _, id := range []string{"002", "003", "004", "005"} {
+		assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"FOOD", id}, true)
+		assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"tom", id}, true)
+	}
+	assertIndex(t, stub, AssetQueryMap["AssetOwner"], []string{"cathy", "001"}, true)
+
+	// a later upgrade has nothing to do
+	invokeResult = stub.MockInit("upgrade2", util.ToChaincodeArgs("init"))
+	status = SchemaStatus{}
+	json.Unmarshal(invokeResult.Payload, &status)
+	if invokeResult.Status != 200 || status.Version != 3 || status.TxID != "upgrade2" {
+		t.Errorf("Init of a migrated ledger returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// invalid limits
+	assertResponse(t, "zero limit", stub.MockInvoke("12345", util.ToChaincodeArgs("migrate", "0")), "1st argument must be a positive integer")
+	assertResponse(t, "too many arguments", stub.MockInvoke("12345", util.ToChaincodeArgs("migrate", "1", "2")), "Incorrect number of arguments. Expecting 0 or 1: limit")
+}
+
+func TestConfig(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestConfig ****************")
+	defer func(transport http.RoundTripper) { restClient.Transport = transport }(restClient.Transport)
+
+	// Init overrides the defaults with its JSON argument
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"eventName":"assetFired","marbleColors":["red"],"adminMSPs":["Org1MSP"]}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getConfig"))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Get config returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	assertGolden(t, "getConfig", invokeResult.Payload)
+
+	// handlers read their settings from config
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("fireCCEvent", "body"))
+	if ccEvent := <-stub.ChaincodeEventsChannel; invokeResult.Status != 200 || ccEvent.EventName != "assetFired" {
+		t.Errorf("fireCCEvent did not use the configured event name, got: %s", ccEvent.EventName)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("putPrivateData", "privateDataCollection", `{"MarbleID":"m_001","Color":"blue"}`))
+	assertResponse(t, "color not configured", invokeResult, "Color must be one of [red]")
+
+	// only admins change the config
+	ca := NewTestCA(t, "Org2MSP")
+	tests := []struct {
+		name     string
+		identity *TestIdentity
+		config   string
+		message  string
+	}{
+		{"no identity", nil, `{"restUrl":"http://rest.example.com/"}`, "setConfig requires an administrator: Expecting a PEM-encoded X509 certificate; PEM block not found"},
+		{"not an admin", &TestIdentity{CommonName: "user1"}, `{"restUrl":"http://rest.example.com/"}`, "setConfig requires an administrator, Org2MSP is not an admin MSP and the identity does not have admin=true or the admin role"},
+		{"admin attribute", &TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}}, `{"restUrl":"http://rest.example.com/"}`, ""},
+		{"unknown setting", &TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}}, `{"restEndpoint":"http://rest.example.com/"}`, "Invalid config JSON: json: unknown field \"restEndpoint\""},
+		{"empty event name", &TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}}, `{"eventName":""}`, "eventName must be a non-empty string"},
+		{"missing index", &TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}}, `{"assetIndexes":{"AssetType":"Asset~Type"}}`, "assetIndexes must name the AssetOwner index"},
+		{"index names", &TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}}, `{"assetIndexes":{"AssetType":"Asset~Type","AssetOwner":"Asset~Owner"}}`, ""},
+	}
+	for _, tt := range tests {
+		stub.Creator = nil
+		if tt.identity != nil {
+			stub.SetIdentity(t, ca, *tt.identity)
+		}
+		assertResponse(t, tt.name, stub.MockInvoke("12345", util.ToChaincodeArgs("setConfig", tt.config)), tt.message)
+	}
+
+	var requested string
+	restClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requested = req.URL.String()
+		return fakeHTTPResponse(http.StatusOK, "[]"), nil
+	})
+	stub.MockInvoke("12345", util.ToChaincodeArgs("testRESTCC"))
+	if requested != "http://rest.example.com/" {
+		t.Errorf("testRESTCC did not use the configured url, got: %s", requested)
+	}
+
+	// assets are indexed under the configured names, which then cannot change
+	createAsset(t, stub, DemoAsset{"001", "test", "food", "cathy", true, "2018-05-25", 1502688979, 1})
+	assertIndex(t, stub, "Asset~Type", []string{"FOOD", "001"}, true)
+	assertIndex(t, stub, AssetQueryMap["AssetType"], []string{"FOOD", "001"}, false)
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getAssetByType", "food"))
+	if invokeResult.Status != 200 || !strings.Contains(string(invokeResult.Payload), "\"id\":\"001\"") {
+		t.Errorf("Get asset by type did not use the configured index, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("setConfig", `{"assetIndexes":{"AssetType":"Asset~T","AssetOwner":"Asset~O"}}`))
+	assertResponse(t, "index names with assets", invokeResult, "assetIndexes cannot change once assets exist")
+}
+
+func TestAssetsBatch(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestAssetsBatch ****************")
+	model := &assetModel{assets: make(map[string]DemoAsset), mutations: make(map[string]int)}
+
+	nextBatchEvent := func() BatchEvent {
+		var batchEvent BatchEvent
+		select {
+		case ccEvent := <-stub.ChaincodeEventsChannel:
+			if ccEvent.EventName != BatchEventName {
+				t.Errorf("Unexpected event name, got: %s, want: %s", ccEvent.EventName, BatchEventName)
+			}
+			json.Unmarshal(ccEvent.Payload, &batchEvent)
+		default:
+			t.Errorf("No batch event was emitted")
+		}
+		return batchEvent
+	}
+
+	// an atomic batch with invalid items writes nothing and reports every item
+	assets := `[{"id":"001","name":"test1","type":"food","owner":"cathy","flag":true,"updatedDate":"2018-05-25","timeStamp":1502688979},
+		{"id":"002","name":"test2","type":"food","owner":"","flag":true,"updatedDate":"2018-05-25","timeStamp":1502688979},
+		{"id":"001","name":"test3","type":"drink","owner":"tom","flag":false,"updatedDate":"2018-05-25","timeStamp":1502688979}]`
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("createAssetsBatch", assets))
+	var result BatchResult
+	if err := json.Unmarshal([]byte(invokeResult.Message), &result); invokeResult.Status == 200 || err != nil {
+		t.Fatalf("Invalid atomic batch returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	if result.Succeeded != 1 || result.Failed != 2 || result.Items[1].Error != "owner must be a non-empty string" || result.Items[2].Error != "This asset already exists: 001" {
+		t.Errorf("Invalid atomic batch returned wrong items: %+v", result)
+	}
+	if len(stub.State) != 0 || len(stub.ChaincodeEventsChannel) != 0 {
+		t.Errorf("Invalid atomic batch changed the ledger")
+	}
+
+	// valid batch
+	assets = strings.Replace(strings.Replace(assets, `"owner":""`, `"owner":"cathy"`, 1), `"id":"001","name":"test3"`, `"id":"003","name":"test3"`, 1)
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("createAssetsBatch", assets))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Create assets batch returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	assertGolden(t, "createAssetsBatch", invokeResult.Payload)
+	if batchEvent := nextBatchEvent(); len(batchEvent.Events) != 3 || batchEvent.Events[2].EventType != EventAssetCreated || batchEvent.Events[2].AssetType != "DRINK" {
+		t.Errorf("Create assets batch emitted wrong event: %+v", batchEvent)
+	}
+	model.assets["001"] = DemoAsset{"001", "test1", "FOOD", "cathy", true, "2018-05-25", 1502688979, 1}
+	model.assets["002"] = DemoAsset{"002", "test2", "FOOD", "cathy", true, "2018-05-25", 1502688979, 1}
+	model.assets["003"] = DemoAsset{"003", "test3", "DRINK", "tom", false, "2018-05-25", 1502688979, 1}
+	model.mutations["001"], model.mutations["002"], model.mutations["003"] = 1, 1, 1
+	if err := checkAssetInvariants(stub, model); err != nil {
+		t.Errorf("Create assets batch: %s", err)
+	}
+
+	// best effort update applies the valid items
+	assets = `[{"id":"001","name":"test1_new","type":"toy","owner":"jerry","flag":true,"updatedDate":"2018-05-28","timeStamp":1502688999},
+		{"id":"999","name":"test","type":"food","owner":"cathy","flag":true,"updatedDate":"2018-05-28","timeStamp":1502688999},
+		{"id":"002","name":"","type":"food","owner":"cathy","flag":true,"updatedDate":"2018-05-28","timeStamp":1502688999}]`
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("updateAssetsBatch", assets, BatchModeBestEffort))
+	result = BatchResult{}
+	if err := json.Unmarshal(invokeResult.Payload, &result); invokeResult.Status != 200 || err != nil {
+		t.Fatalf("Best effort batch returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	if result.Succeeded != 1 || result.Failed != 2 || !result.Items[0].OK || result.Items[1].Error != "Asset does not exist: 999" || result.Items[2].Error != "name must be a non-empty string" {
+		t.Errorf("Best effort batch returned wrong items: %+v", result)
+	}
+	if batchEvent := nextBatchEvent(); len(batchEvent.Events) != 1 || batchEvent.Events[0].EventType != EventAssetUpdated {
+		t.Errorf("Update assets batch emitted wrong event: %+v", batchEvent)
+	}
+	model.assets["001"] = DemoAsset{"001", "test1_new", "TOY", "jerry", true, "2018-05-28", 1502688999, 2}
+	model.mutations["001"]++
+	if err := checkAssetInvariants(stub, model); err != nil {
+		t.Errorf("Update assets batch: %s", err)
+	}
+
+	// items are bare ids or ids with the expected version
+	assertResponse(t, "stale delete", stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAssetsBatch", `["003",{"id":"002","version":5}]`)),
+		`{"mode":"atomic","succeeded":1,"failed":1,"items":[{"index":0,"id":"003","ok":true},{"index":1,"id":"002","ok":false,"error":"Version conflict on asset 002: expected version 5, current version 1"}]}`)
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAssetsBatch", `[{"id":"002","version":1},"003"]`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Delete assets batch returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	if batchEvent := nextBatchEvent(); len(batchEvent.Events) != 2 || batchEvent.Events[1].EventType != EventAssetDeleted {
+		t.Errorf("Delete assets batch emitted wrong event: %+v", batchEvent)
+	}
+	delete(model.assets, "002")
+	delete(model.assets, "003")
+	model.mutations["002"]++
+	model.mutations["003"]++
+	if err := checkAssetInvariants(stub, model); err != nil {
+		t.Errorf("Delete assets batch: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"unknown mode", []string{"deleteAssetsBatch", `["001"]`, "sometimes"}, "2nd argument must be atomic or bestEffort"},
+		{"not an array", []string{"deleteAssetsBatch", `"001"`}, "1st argument must be a JSON array: json: cannot unmarshal string into Go value of type []main.BatchDeleteItem"},
+		{"unknown delete field", []string{"deleteAssetsBatch", `[{"id":"001","owner":"tom"}]`}, "1st argument must be a JSON array: json: unknown field \"owner\""},
+		{"empty array", []string{"createAssetsBatch", `[]`}, "1st argument must contain at least one item"},
+		{"unknown field", []string{"createAssetsBatch", `[{"id":"004","color":"red"}]`}, "1st argument must be a JSON array: json: unknown field \"color\""},
+		{"no arguments", []string{"updateAssetsBatch"}, "Incorrect number of arguments. Expecting 1 or 2: JSON array, mode"},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...)), tt.message)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	source := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestExportImportState ****************")
+	createTestAssets(t, source)
+
+	// export in pages of two
+	var pages []string
+	bookmark := ""
+	for {
+		invokeResult := source.MockInvoke("12345", util.ToChaincodeArgs("exportState", "2", bookmark))
+		if invokeResult.Status != 200 {
+			t.Fatalf("Export state returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+		}
+		var header ExportHeader
+		lines := strings.Split(strings.TrimRight(string(invokeResult.Payload), "\n"), "\n")
+		if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Count != len(lines)-1 {
+			t.Fatalf("Export state returned invalid header: %s", lines[0])
+		}
+		pages = append(pages, string(invokeResult.Payload))
+		if header.Bookmark == "" {
+			break
+		}
+		bookmark = header.Bookmark
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Export state returned %d pages, want: 2", len(pages))
+	}
+	wantPage := `{"format":"myChaincode-state/1","schemaVersion":0,"count":1,"bookmark":""}
+{"key":"003","record":{"id":"003","name":"test3","type":"DRINK","owner":"cathy","flag":true,"updatedDate":"2018-05-25","timeStamp":1502688979,"version":1},"indexes":{"AssetOwner":["cathy","003"],"AssetType":["DRINK","003"]}}
+`
+	if pages[1] != wantPage {
+		t.Errorf("Export state returned wrong page, got:\n%s\nwant:\n%s", pages[1], wantPage)
+	}
+
+	// import every page twice, the second import changes nothing
+	target := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	// importState requires an administrator
+	target.SetIdentity(t, NewTestCA(t, "Org1MSP"), TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}})
+	for _, page := range pages {
+		for i := 0; i < 2; i++ {
+			invokeResult := target.MockInvoke("12345", util.ToChaincodeArgs("importState", page))
+			if invokeResult.Status != 200 {
+				t.Fatalf("Import state returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+			}
+		}
+	}
+	model := &assetModel{assets: make(map[string]DemoAsset), mutations: make(map[string]int)}
+	for _, id := range []string{"001", "002", "003"} {
+		model.assets[id] = *getStateAsset(t, source, id)
+		model.mutations[id] = 1
+	}
+	if err := checkAssetInvariants(target, model); err != nil {
+		t.Errorf("Import state: %s", err)
+	}
+	if len(target.ChaincodeEventsChannel) != 2 {
+		t.Errorf("Import state emitted %d events, want: 2", len(target.ChaincodeEventsChannel))
+	}
+
+	// a changed record is a conflict, with overwrite it updates the asset, moves its indexes
+	// and the version still goes up
+	changed := strings.Replace(strings.Replace(pages[1], `"owner":"cathy"`, `"owner":"tom"`, 1), `["cathy","003"]`, `["tom","003"]`, 1)
+	assertResponse(t, "changed record", target.MockInvoke("12345", util.ToChaincodeArgs("importState", changed)),
+		`{"mode":"atomic","succeeded":0,"failed":1,"items":[{"index":0,"id":"003","ok":false,"error":"asset 003 differs from the ledger version 1, import with mode overwrite to replace it"}]}`)
+	invokeResult := target.MockInvoke("12345", util.ToChaincodeArgs("importState", changed, ImportOverwrite))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Import state returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	assertIndex(t, target, AssetQueryMap["AssetOwner"], []string{"cathy", "003"}, false)
+	assertIndex(t, target, AssetQueryMap["AssetOwner"], []string{"tom", "003"}, true)
+	if demoAsset := getStateAsset(t, target, "003"); demoAsset.Owner != "tom" || demoAsset.Version != 2 {
+		t.Errorf("Import state with overwrite stored %+v, want owner tom and version 2", demoAsset)
+	}
+
+	migrated := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	migrated.MockInit("1", util.ToChaincodeArgs("init"))
+	migrated.Creator = target.Creator
+	tests := []struct {
+		name    string
+		stub    *TestStub
+		args    []string
+		message string
+	}{
+		{"schema mismatch", migrated, []string{"importState", pages[1]}, "Export schema version 0 does not match ledger schema version 3"},
+		{"wrong format", target, []string{"importState", strings.Replace(pages[1], ExportFormat, "csv", 1)}, `Unsupported export format "csv", expecting "myChaincode-state/1"`},
+		{"missing record", target, []string{"importState", strings.Replace(pages[1], `"count":1`, `"count":2`, 1)}, "Export page has 1 records, the header counts 2"},
+		{"empty page", target, []string{"importState", ""}, "Invalid export header: EOF"},
+		{"unknown mode", target, []string{"importState", pages[1], "replace"}, "2nd argument must be overwrite"},
+		{"page size", source, []string{"exportState", "0"}, "1st argument must be a page size between 1 and 500"},
+		{"stale indexes", target, []string{"importState", strings.Replace(pages[1], `["DRINK","003"]`, `["FOOD","003"]`, 1)},
+			`{"mode":"atomic","succeeded":0,"failed":1,"items":[{"index":0,"id":"003","ok":false,"error":"indexes do not match the asset"}]}`},
+		{"key mismatch", target, []string{"importState", strings.Replace(pages[1], `"key":"003"`, `"key":"004"`, 1)},
+			`{"mode":"atomic","succeeded":0,"failed":1,"items":[{"index":0,"id":"004","ok":false,"error":"key 004 does not match the asset id 003"}]}`},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, tt.stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...)), tt.message)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestWhoami ****************")
+	ca := NewTestCA(t, "Org1MSP")
+
+	stub.SetIdentity(t, ca, TestIdentity{CommonName: "user1", OUs: []string{"client", "dept1"}, Attrs: map[string]string{"role": "maker", "hf.EnrollmentID": "user1"}})
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("whoami"))
+	if invokeResult.Status != 200 {
+		t.Fatalf("whoami returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	assertGolden(t, "whoami", invokeResult.Payload)
+
+	// the certificate expired before the transaction
+	stub.SetIdentity(t, ca, TestIdentity{CommonName: "user2", NotAfter: stub.Clock.Add(-time.Hour)})
+	var whoami struct {
+		Role    string `json:"role"`
+		Expired bool   `json:"expired"`
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("whoami"))
+	if err := json.Unmarshal(invokeResult.Payload, &whoami); err != nil || !whoami.Expired || whoami.Role != "" {
+		t.Errorf("whoami of an expired identity returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// idemix identities have a role but no certificate fields
+	idemixRole, _ := proto.Marshal(&common.MSPRole{MspIdentifier: "IdemixOrg", Role: common.MSPRole_ADMIN})
+	idemixID, _ := proto.Marshal(&msp.SerializedIdemixIdentity{NymX: []byte{1}, NymY: []byte{2}, Role: idemixRole, Proof: []byte{3}})
+	stub.Creator = serializeIdentity(t, "IdemixOrg", idemixID)
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("whoami"))
+	want := `{"mspId":"IdemixOrg","type":"idemix","ous":[],"attributes":{"role":"ADMIN"},"role":"admin","expired":false}`
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != want {
+		t.Errorf("whoami of an idemix identity returned %d %s, want: %s", invokeResult.Status, invokeResult.Payload, want)
+	}
+
+	stub.Creator = nil
+	assertResponse(t, "no creator", stub.MockInvoke("12345", util.ToChaincodeArgs("whoami")), "The transaction has no creator")
+	assertResponse(t, "arguments", stub.MockInvoke("12345", util.ToChaincodeArgs("whoami", "user1")), "Incorrect number of arguments. Expecting 0")
+}
+
+func TestGuards(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestGuards ****************")
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"guards":{
+		"creatAsset":"hf.Type=client AND role in {maker,checker}",
+		"deleteAsset":"auditor OR role=checker",
+		"getTxCreatorInfo":"hf.Type=client"}}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+
+	ca := NewTestCA(t, "Org1MSP")
+	asset := []string{"creatAsset", "001", "test", "food", "cathy", "true", "2018-05-25", "1502688979"}
+	tests := []struct {
+		name     string
+		identity *TestIdentity
+		args     []string
+		message  string
+	}{
+		{"no identity", nil, asset, "Access denied to creatAsset, requires hf.Type=client AND role in {maker,checker}: Expecting a PEM-encoded X509 certificate; PEM block not found"},
+		{"missing attribute", &TestIdentity{CommonName: "user1", Attrs: map[string]string{"role": "maker"}}, asset,
+			"Access denied to creatAsset, requires hf.Type=client AND role in {maker,checker}: Attribute 'hf.Type' was not found"},
+		{"wrong role", &TestIdentity{CommonName: "user1", Attrs: map[string]string{"hf.Type": "client", "role": "viewer"}}, asset,
+			"Access denied to creatAsset, requires hf.Type=client AND role in {maker,checker}: Attribute 'role' equals 'viewer', not one of {maker,checker}"},
+		{"maker", &TestIdentity{CommonName: "user1", Attrs: map[string]string{"hf.Type": "client", "role": "maker"}}, asset, ""},
+		{"unguarded function", nil, []string{"getAsset", "001"}, ""},
+		{"no alternative", &TestIdentity{CommonName: "user1", Attrs: map[string]string{"auditor": "yes", "role": "maker"}}, []string{"deleteAsset", "001"},
+			"Access denied to deleteAsset, requires auditor OR role=checker: Attribute 'auditor' is not true OR Attribute 'role' equals 'maker', not 'checker'"},
+		{"boolean attribute", &TestIdentity{CommonName: "user1", Attrs: map[string]string{"auditor": "true"}}, []string{"deleteAsset", "001"}, ""},
+		{"ACL function", &TestIdentity{CommonName: "peer1", Attrs: map[string]string{"hf.Type": "peer"}}, []string{"getTxCreatorInfo"},
+			"Access denied to getTxCreatorInfo, requires hf.Type=client: Attribute 'hf.Type' equals 'peer', not 'client'"},
+	}
+	for _, tt := range tests {
+		stub.Creator = nil
+		if tt.identity != nil {
+			stub.SetIdentity(t, ca, *tt.identity)
+		}
+		assertResponse(t, tt.name, stub.MockInvoke("12345", util.ToChaincodeArgs(tt.args...)), tt.message)
+	}
+
+	// guards are parsed when the config is set
+	stub.SetIdentity(t, ca, TestIdentity{CommonName: "admin1", Attrs: map[string]string{"admin": "true"}})
+	for expr, message := range map[string]string{
+		"role in {maker,}":   `Invalid guard "role in {maker,}": empty value in role in {maker,}`,
+		"role in maker":      `Invalid guard "role in maker": "role in maker" is not an attribute name`,
+		"admin AND ":         `Invalid guard "admin AND ": "" is not an attribute name`,
+		"hf.Type = client":   "",
+		"a=1 OR b AND c=2":   "",
+		"role in { x , y }":  "",
+		"hf.Affiliation=org": "",
+	} {
+		config, _ := json.Marshal(map[string]interface{}{"guards": map[string]string{"creatAsset": expr}})
+		assertResponse(t, expr, stub.MockInvoke("12345", util.ToChaincodeArgs("setConfig", string(config))), message)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestApprovals ****************")
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"adminMSPs":["Org2MSP"],
+		"approvals":{"deleteAsset":{"required":2,"approverMSPs":["Org2MSP"],"approverGuard":"role=checker","timeout":60}}}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	createTestAssets(t, stub)
+
+	org1, org2 := NewTestCA(t, "Org1MSP"), NewTestCA(t, "Org2MSP")
+	maker := org1.Creator(t, TestIdentity{CommonName: "maker1", Attrs: map[string]string{"role": "maker"}})
+	checker := org1.Creator(t, TestIdentity{CommonName: "checker1", Attrs: map[string]string{"role": "checker"}})
+	viewer := org1.Creator(t, TestIdentity{CommonName: "viewer1"})
+	org2User := org2.Creator(t, TestIdentity{CommonName: "user1"})
+	var request ApprovalRequest
+	decodeRequest := func(invokeResult peer.Response) ApprovalRequest {
+		t.Helper()
+		request = ApprovalRequest{}
+		if err := json.Unmarshal(invokeResult.Payload, &request); invokeResult.Status != 200 || err != nil {
+			t.Fatalf("Approval returned %d %s", invokeResult.Status, invokeResult.Message)
+		}
+		return request
+	}
+
+	// the delete is held back until two approvers accept it
+	decodeRequest(stub.MockInvokeAs(maker, "req1", "deleteAsset", "001"))
+	if request.ID != "req1" || request.Status != ApprovalPending || request.ExpiresAt != request.CreatedAt+60 || stub.State["001"] == nil {
+		t.Errorf("deleteAsset did not create a pending request: %+v", request)
+	}
+	invokeResult = stub.MockInvokeAs(nil, "12345", "getPendingApprovals", "deleteAsset")
+	var pending []ApprovalRequest
+	if err := json.Unmarshal(invokeResult.Payload, &pending); err != nil || len(pending) != 1 || pending[0].ID != "req1" {
+		t.Errorf("getPendingApprovals returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	assertResponse(t, "self approval", stub.MockInvokeAs(maker, "12345", "approveRequest", "req1"), "The proposer cannot approve their own request")
+	assertResponse(t, "not an approver", stub.MockInvokeAs(viewer, "12345", "approveRequest", "req1"),
+		"Not an approver, Org1MSP is not an approver MSP and the identity does not satisfy role=checker: Attribute 'role' was not found")
+	decodeRequest(stub.MockInvokeAs(checker, "12345", "approveRequest", "req1"))
+	if request.Status != ApprovalPending || len(request.Approvals) != 1 || stub.State["001"] == nil {
+		t.Errorf("First approval changed the request to %+v", request)
+	}
+	assertResponse(t, "second approval by the same identity", stub.MockInvokeAs(checker, "12345", "approveRequest", "req1"), "The request is already approved by this identity")
+	decodeRequest(stub.MockInvokeAs(org2User, "12345", "approveRequest", "req1"))
+	if request.Status != ApprovalExecuted || len(request.Approvals) != 2 || stub.State["001"] != nil {
+		t.Errorf("Second approval did not delete the asset: %+v", request)
+	}
+	assertIndex(t, stub, PendingApprovalIndex, []string{"deleteAsset", "req1"}, false)
+	// the approved call runs as the proposer, not as the last approver
+	var proposer, executor WhoAmI
+	json.Unmarshal(stub.MockInvokeAs(maker, "12345", "whoami").Payload, &proposer)
+	json.Unmarshal(new(MyChaincode).whoami(&proposerStub{stub, request.ProposerCreator}, nil).Payload, &executor)
+	if executor.ID == "" || executor.ID != proposer.ID || executor.ID != request.Proposer {
+		t.Errorf("Approved call ran as %s, want the proposer %s", executor.ID, proposer.ID)
+	}
+	assertResponse(t, "executed", stub.MockInvokeAs(checker, "12345", "approveRequest", "req1"), "Approval request req1 is executed")
+
+	// a failing call keeps the request pending
+	stub.MockInvokeAs(maker, "req2", "deleteAsset", "999")
+	stub.MockInvokeAs(checker, "12345", "approveRequest", "req2")
+	assertResponse(t, "failing call", stub.MockInvokeAs(org2User, "12345", "approveRequest", "req2"), "Approved deleteAsset failed: {\"Error\":\"Asset does not exist: 999\"}")
+	decodeRequest(stub.MockInvokeAs(nil, "12345", "getApprovalRequest", "req2"))
+	if request.Status != ApprovalPending || len(request.Approvals) != 1 {
+		t.Errorf("Failing call changed the request to %+v", request)
+	}
+
+	// requests expire
+	decodeRequest(stub.MockInvokeAs(maker, "req3", "deleteAsset", "002"))
+	stub.Clock = stub.Clock.Add(2 * time.Minute)
+	assertResponse(t, "expired", stub.MockInvokeAs(checker, "12345", "approveRequest", "req3"),
+		"Approval request req3 expired at "+time.Unix(request.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	invokeResult = stub.MockInvokeAs(nil, "12345", "getPendingApprovals")
+	if err := json.Unmarshal(invokeResult.Payload, &pending); err != nil || len(pending) != 2 || pending[0].Status != ApprovalExpired {
+		t.Errorf("getPendingApprovals returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	invokeResult = stub.MockInvokeAs(nil, "12345", "expireApprovals")
+	if invokeResult.Status != 200 || string(invokeResult.Payload) != `["req2","req3"]` {
+		t.Errorf("expireApprovals returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	if invokeResult = stub.MockInvokeAs(nil, "12345", "getPendingApprovals"); string(invokeResult.Payload) != "[]" {
+		t.Errorf("getPendingApprovals after expiry returned %s", invokeResult.Payload)
+	}
+
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"anonymous proposer", nil, []string{"deleteAsset", "002"}, "deleteAsset requires approval, the proposer must be identified: Expecting a PEM-encoded X509 certificate; PEM block not found"},
+		{"unknown request", checker, []string{"approveRequest", "req9"}, "Approval request does not exist: req9"},
+		{"not approvable", org2User, []string{"setConfig", `{"approvals":{"creatAsset":{"required":1,"timeout":60}}}`}, "approvals cannot be required for creatAsset, only for [deleteAsset updateAsset]"},
+		{"no approvers", org2User, []string{"setConfig", `{"approvals":{"updateAsset":{"required":0,"timeout":60}}}`}, "approvals.updateAsset.required must be a positive integer"},
+		{"no timeout", org2User, []string{"setConfig", `{"approvals":{"updateAsset":{"required":1}}}`}, "approvals.updateAsset.timeout must be a positive number of seconds"},
+		{"batch delete bypass", maker, []string{"deleteAssetsBatch", `["002"]`}, "deleteAssetsBatch is disabled while deleteAsset requires approval, call deleteAsset for each asset"},
+		{"batch update without policy", maker, []string{"updateAssetsBatch", `[]`}, "1st argument must contain at least one item"},
+		{"update approvals", org2User, []string{"setConfig", `{"approvals":{"updateAsset":{"required":1,"timeout":60}}}`}, ""},
+		{"batch update bypass", maker, []string{"updateAssetsBatch", `[]`}, "updateAssetsBatch is disabled while updateAsset requires approval, call updateAsset for each asset"},
+		{"import bypass", org2User, []string{"importState", ""}, "importState is disabled while updateAsset requires approval, call updateAsset for each asset"},
+		{"purchase bypass", maker, []string{"purchaseAsset", "002"}, "purchaseAsset is disabled while updateAsset requires approval, call updateAsset for each asset"},
+		{"batch delete without policy", maker, []string{"deleteAssetsBatch", `[]`}, "1st argument must contain at least one item"},
+		{"no approvals", org2User, []string{"setConfig", `{"approvals":{}}`}, ""},
+		{"immediate delete", nil, []string{"deleteAsset", "002"}, ""},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestRoles ****************")
+	ca := NewTestCA(t, "Org1MSP")
+	admin := ca.Creator(t, TestIdentity{CommonName: "admin1"})
+	user1 := ca.Creator(t, TestIdentity{CommonName: "user1"})
+	user2 := ca.Creator(t, TestIdentity{CommonName: "user2"})
+	configAdmin := ca.Creator(t, TestIdentity{CommonName: "admin2", Attrs: map[string]string{"admin": "true"}})
+	// identities are named by the id whoami reports
+	idOf := func(creator []byte) string {
+		var whoami WhoAmI
+		json.Unmarshal(stub.MockInvokeAs(creator, "12345", "whoami").Payload, &whoami)
+		return whoami.ID
+	}
+
+	// without admins the registry is not enforced, the admin functions need a config administrator
+	// and the registry cannot be changed
+	createAsset(t, stub, DemoAsset{"001", "test", "food", "cathy", true, "2018-05-25", 1502688979, 1})
+	assertResponse(t, "read without admins", stub.MockInvokeAs(user1, "12345", "getAsset", "001"), "")
+	assertResponse(t, "admin function without admins", stub.MockInvokeAs(user1, "12345", "migrate"),
+		"migrate requires an administrator, Org1MSP is not an admin MSP and the identity does not have admin=true or the admin role")
+	assertResponse(t, "grant without admins", stub.MockInvokeAs(user1, "12345", "grantRole", RoleAdmin, "Org1MSP", idOf(user1)),
+		"grantRole requires an administrator, Org1MSP is not an admin MSP and the identity does not have admin=true or the admin role")
+	assertResponse(t, "config admin grants without admins", stub.MockInvokeAs(configAdmin, "12345", "grantRole", RoleAdmin, "Org1MSP", idOf(user1)),
+		"The role registry has no admins, Init sets the first ones")
+
+	invokeResult := stub.MockInit("upgrade", util.ToChaincodeArgs("init", "", "", `[{"mspId":"Org1MSP","id":"`+idOf(admin)+`"}]`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	asset := []string{"creatAsset", "002", "test", "food", "cathy", "true", "2018-05-25", "1502688979"}
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"anonymous read", nil, []string{"getAsset", "001"}, "Access denied to getAsset, the caller must be identified: Expecting a PEM-encoded X509 certificate; PEM block not found"},
+		{"no role", user1, []string{"getAsset", "001"}, "Access denied to getAsset, requires one of the roles [admin reader writer]"},
+		{"open function", user1, []string{"whoami"}, ""},
+		{"reader function", user1, []string{"getSchemaStatus"}, "Access denied to getSchemaStatus, requires one of the roles [admin reader writer]"},
+		{"undeclared function", admin, []string{"dropLedger"}, "Access denied to dropLedger, the function does not declare its roles"},
+		{"admin reads", admin, []string{"getAsset", "001"}, ""},
+		{"grant writer", admin, []string{"grantRole", RoleWriter, "Org1MSP", idOf(user1)}, ""},
+		{"grant reader", admin, []string{"grantRole", RoleReader, "Org1MSP", idOf(user2)}, ""},
+		{"writer creates", user1, asset, ""},
+		{"reader reads", user2, []string{"getAsset", "002"}, ""},
+		{"reader cannot write", user2, []string{"deleteAsset", "002"}, "Access denied to deleteAsset, requires one of the roles [admin writer]"},
+		{"writer cannot grant", user1, []string{"grantRole", RoleAdmin, "Org1MSP", idOf(user1)}, "Access denied to grantRole, requires one of the roles [admin]"},
+		{"unknown role", admin, []string{"grantRole", "owner", "Org1MSP", idOf(user1)}, `Unknown role "owner", expecting one of [admin reader writer]`},
+		{"any caller is not a role", admin, []string{"grantRole", AnyCaller, "Org1MSP", idOf(user1)}, `Unknown role "*", expecting one of [admin reader writer]`},
+		{"empty id", admin, []string{"grantRole", RoleReader, "Org1MSP", ""}, "role, MSP ID and id must be non-empty strings"},
+		{"revoke writer", admin, []string{"revokeRole", RoleWriter, "Org1MSP", idOf(user1)}, ""},
+		{"revoked writer", user1, []string{"deleteAsset", "002"}, "Access denied to deleteAsset, requires one of the roles [admin writer]"},
+		{"revoke missing role", admin, []string{"revokeRole", RoleWriter, "Org1MSP", "nobody"}, "nobody does not have the role writer"},
+		{"last admin", admin, []string{"revokeRole", RoleAdmin, "Org1MSP", idOf(admin)}, "The last admin cannot be revoked"},
+		{"ledger admin sets config", admin, []string{"setConfig", `{"eventName":"assetEvent"}`}, ""},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+
+	invokeResult = stub.MockInvokeAs(user2, "12345", "listRoles")
+	var members []RoleMember
+	if err := json.Unmarshal(invokeResult.Payload, &members); err != nil || len(members) != 2 ||
+		members[0].Role != RoleAdmin || members[0].GrantedBy != "Init" || members[1].Role != RoleReader || members[1].GrantedBy != "Org1MSP/"+idOf(admin) {
+		t.Errorf("listRoles returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	assertResponse(t, "bad admins", stub.MockInit("upgrade", util.ToChaincodeArgs("init", "", "", `[{"msp":"Org1MSP"}]`)), `Invalid admins JSON: json: unknown field "msp"`)
+}
+
+// TestFunctionRoles checks that every function Invoke dispatches declares its roles
+func TestFunctionRoles(t *testing.T) {
+	source, err := ioutil.ReadFile("myChaincode.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	functions := regexp.MustCompile(`function == "(\w+)"`).FindAllStringSubmatch(string(source), -1)
+	if len(functions) < 40 {
+		t.Fatalf("found %d dispatched functions", len(functions))
+	}
+	for _, function := range functions {
+		if _, ok := functionRoles[function[1]]; !ok {
+			t.Errorf("%s does not declare its roles in functionRoles", function[1])
+		}
+	}
+	for function, roles := range functionRoles {
+		for _, role := range roles {
+			if role != AnyCaller && !containsString(knownRoles, role) {
+				t.Errorf("%s declares the unknown role %q", function, role)
+			}
+		}
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestTenancy ****************")
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"tenancy":true,"adminMSPs":["Org1MSP"]}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	org1 := NewTestCA(t, "Org1MSP").Creator(t, TestIdentity{CommonName: "user1"})
+	org2 := NewTestCA(t, "Org2MSP").Creator(t, TestIdentity{CommonName: "user2"})
+	org3 := NewTestCA(t, "Org3MSP").Creator(t, TestIdentity{CommonName: "user3"})
+	// the names of the assets in a response, records of getAllAssets or assets of getAssetByType
+	assertAssets := func(name string, invokeResult peer.Response, names ...string) {
+		t.Helper()
+		var assets []struct {
+			Record *DemoAsset
+			Name   string
+		}
+		got := []string{}
+		err := json.Unmarshal(invokeResult.Payload, &assets)
+		for _, asset := range assets {
+			if asset.Record != nil {
+				asset.Name = asset.Record.Name
+			}
+			got = append(got, asset.Name)
+		}
+		if err != nil || strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Errorf("%s returned %d %s %s, want %v", name, invokeResult.Status, invokeResult.Message, invokeResult.Payload, names)
+		}
+	}
+
+	// a composite key as asset id would bypass the tenant namespace
+	rawKey, _ := stub.CreateCompositeKey(TenantAssetIndex, []string{"Org1MSP", "001"})
+	rawKeyMessage := fmt.Sprintf("Invalid asset id %q, asset ids must not contain U+0000", rawKey)
+
+	// both tenants own an asset 001
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"anonymous", nil, []string{"getAllAssets"}, "Tenancy requires an identified caller: Expecting a PEM-encoded X509 certificate; PEM block not found"},
+		{"org1 creates", org1, []string{"creatAsset", "001", "org1asset", "food", "cathy", "true", "2018-05-25", "1502688979"}, ""},
+		{"org1 creates 002", org1, []string{"creatAsset", "002", "org1other", "tool", "cathy", "true", "2018-05-25", "1502688979"}, ""},
+		{"org2 creates the same id", org2, []string{"creatAsset", "001", "org2asset", "food", "bob", "true", "2018-05-25", "1502688979"}, ""},
+		{"org2 updates its asset", org2, []string{"updateAsset", "001", "org2asset", "food", "bob", "false", "2018-05-26", "1502688979"}, ""},
+		{"org2 cannot see 002", org2, []string{"getAsset", "002"}, `{"Error":"Asset does not exist: 002"}`},
+		{"org2 cannot delete 002", org2, []string{"deleteAsset", "002"}, `{"Error":"Asset does not exist: 002"}`},
+		{"raw key read", org2, []string{"getAsset", rawKey}, rawKeyMessage},
+		{"raw key history", org2, []string{"getHistoryForRecord", rawKey}, rawKeyMessage},
+		{"raw key update", org2, []string{"updateAsset", rawKey, "org1asset", "food", "bob", "false", "2018-05-26", "1502688979"}, rawKeyMessage},
+		{"raw key delete", org2, []string{"deleteAsset", rawKey}, rawKeyMessage},
+		{"raw key create", org2, []string{"creatAsset", rawKey, "org2asset", "food", "bob", "true", "2018-05-25", "1502688979"}, rawKeyMessage},
+		{"not granted", org2, []string{"getAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org2MSP for read"},
+		{"grant", org1, []string{"grantAsset", "002", "Org2MSP", "read", "2030-01-01T00:00:00Z"}, ""},
+		{"granted read", org2, []string{"getAsset", "002", "Org1MSP"}, ""},
+		{"granted to org2 only", org3, []string{"getAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org3MSP for read"},
+		{"grant is per tenant", org2, []string{"deleteAsset", "002"}, `{"Error":"Asset does not exist: 002"}`},
+		{"revoke", org1, []string{"revokeGrant", "002", "Org2MSP"}, ""},
+		{"revoked read", org2, []string{"getAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org2MSP for read"},
+		{"share missing asset", org1, []string{"shareAsset", "003", "Org2MSP"}, "Asset does not exist: 003"},
+		{"share with itself", org1, []string{"shareAsset", "002", "Org1MSP"}, "2nd argument must be the MSP ID of another tenant"},
+		{"share with a user", org1, []string{"shareAsset", "002", "Org2MSP/user2"}, "2nd argument must be the MSP ID of another tenant"},
+		{"share", org1, []string{"shareAsset", "002", "Org2MSP"}, ""},
+		{"shared read", org2, []string{"getAsset", "002", "Org1MSP"}, ""},
+		{"shared is read only", org2, []string{"deleteAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org2MSP for write"},
+		{"unshare", org1, []string{"unshareAsset", "002", "Org2MSP"}, ""},
+		{"unshared read", org2, []string{"getAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org2MSP for read"},
+		{"unshare twice", org1, []string{"unshareAsset", "002", "Org2MSP"}, "Asset 002 is not shared with Org2MSP"},
+		{"grant is not a share", org1, []string{"grantAsset", "002", "Org2MSP", "read", "2030-01-01T00:00:00Z"}, ""},
+		{"unshare a grant", org1, []string{"unshareAsset", "002", "Org2MSP"}, "Asset 002 is not shared with Org2MSP"},
+		{"revoke the grant", org1, []string{"revokeGrant", "002", "Org2MSP"}, ""},
+		{"tenancy is fixed", org1, []string{"setConfig", `{"tenancy":false}`}, "tenancy cannot change once assets exist"},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+
+	invokeResult = stub.MockInvokeAs(org2, "12345", "deleteAssetsBatch", `["`+strings.Replace(rawKey, "\x00", `\u0000`, -1)+`"]`)
+	if invokeResult.Status == shim.OK || !strings.Contains(invokeResult.Message, "asset ids must not contain U+0000") {
+		t.Errorf("deleteAssetsBatch of a raw key returned %d %s", invokeResult.Status, invokeResult.Message)
+	}
+
+	assertAssets("getAllAssets of org1", stub.MockInvokeAs(org1, "12345", "getAllAssets"), "org1asset", "org1other")
+	assertAssets("getAllAssets of org2", stub.MockInvokeAs(org2, "12345", "getAllAssets"), "org2asset")
+	assertAssets("getAllAssets of org3", stub.MockInvokeAs(org3, "12345", "getAllAssets"))
+	assertAssets("getAssetByType of org2", stub.MockInvokeAs(org2, "12345", "getAssetByType", "food"), "org2asset")
+	invokeResult = stub.MockInvokeAs(org1, "12345", "richQuery", `{"selector":{"type":"FOOD"}}`)
+	if !strings.Contains(string(invokeResult.Payload), `"Key":"001"`) || strings.Contains(string(invokeResult.Payload), "org2asset") {
+		t.Errorf("richQuery of org1 returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	invokeResult = stub.MockInvokeAs(org2, "12345", "getHistoryForRecord", "001")
+	if strings.Count(string(invokeResult.Payload), "TxId") != 2 {
+		t.Errorf("getHistoryForRecord of org2 returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// deleting an asset deletes its grants, a new asset with the id is not granted
+	assertResponse(t, "grant again", stub.MockInvokeAs(org1, "12345", "grantAsset", "002", "Org2MSP", "read", "2030-01-01T00:00:00Z"), "")
+	assertResponse(t, "delete granted", stub.MockInvokeAs(org1, "12345", "deleteAsset", "002"), "")
+	assertResponse(t, "recreate", stub.MockInvokeAs(org1, "12345", "creatAsset", "002", "org1new", "tool", "cathy", "true", "2018-05-25", "1502688979"), "")
+	assertResponse(t, "recreated read", stub.MockInvokeAs(org2, "12345", "getAsset", "002", "Org1MSP"), "Asset 002 of Org1MSP is not granted to Org2MSP for read")
+
+	// migrations run in every tenant, one asset per transaction
+	schemaKey, _ := stub.CreateCompositeKey(SchemaIndex, []string{})
+	delete(stub.State, schemaKey)
+	stub.Creator = nil
+	invokeResult = stub.MockInit("upgrade", util.ToChaincodeArgs("init", "", "1"))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	var status SchemaStatus
+	for i := 0; i < 10 && (i == 0 || status.Cursor != ""); i++ {
+		invokeResult = stub.MockInvokeAs(org1, "12345", "migrate", "1")
+		status = SchemaStatus{}
+		if err := json.Unmarshal(invokeResult.Payload, &status); err != nil {
+			t.Fatalf("migrate returned %d %s %s", invokeResult.Status, invokeResult.Message, invokeResult.Payload)
+		}
+		if status.Cursor != "" && !strings.HasPrefix(status.Cursor, "Org") {
+			t.Errorf("migrate cursor %q does not name a tenant", status.Cursor)
+		}
+	}
+	if status.Version != status.Target || status.Cursor != "" {
+		t.Errorf("migrate returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	assertAssets("getAssetByType after migrations", stub.MockInvokeAs(org1, "12345", "getAssetByType", "tool"), "org1new")
+}
+
+func TestGrants(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestGrants ****************")
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"tenancy":true}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	org2 := NewTestCA(t, "Org2MSP")
+	owner := NewTestCA(t, "Org1MSP").Creator(t, TestIdentity{CommonName: "user1"})
+	user2 := org2.Creator(t, TestIdentity{CommonName: "user2"})
+	user3 := org2.Creator(t, TestIdentity{CommonName: "user3"})
+	var whoami WhoAmI
+	json.Unmarshal(stub.MockInvokeAs(user2, "12345", "whoami").Payload, &whoami)
+	user2Grantee := "Org2MSP/" + whoami.ID
+
+	// the clock starts at 2018-05-25T00:00:00Z
+	assertResponse(t, "create food", stub.MockInvokeAs(owner, "12345", "creatAsset", "001", "bread", "food", "cathy", "true", "2018-05-25", "1502688979"), "")
+	assertResponse(t, "create tool", stub.MockInvokeAs(owner, "12345", "creatAsset", "002", "hammer", "tool", "cathy", "true", "2018-05-25", "1502688979"), "")
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"missing expiry", owner, []string{"grantAsset", "001", "Org2MSP", "read"}, "Incorrect number of arguments. Expecting 4 or 5: id, grantee, access, expiry, object type"},
+		{"own tenant", owner, []string{"grantAsset", "001", "Org1MSP/x", "read", "2018-05-26T00:00:00Z"}, "2nd argument must be a grantee other than the owner Org1MSP"},
+		{"empty user", owner, []string{"grantAsset", "001", "Org2MSP/", "read", "2018-05-26T00:00:00Z"}, "2nd argument must be an MSP ID or MSP ID/id"},
+		{"bad access", owner, []string{"grantAsset", "001", "Org2MSP", "delete", "2018-05-26T00:00:00Z"}, "3rd argument must be read or write"},
+		{"bad expiry", owner, []string{"grantAsset", "001", "Org2MSP", "read", "tomorrow"}, "4th argument must be an RFC 3339 timestamp"},
+		{"past expiry", owner, []string{"grantAsset", "001", "Org2MSP", "read", "2018-05-24T00:00:00Z"}, "4th argument must be after the transaction timestamp"},
+		{"missing asset", owner, []string{"grantAsset", "003", "Org2MSP", "read", "2018-05-26T00:00:00Z"}, "Asset does not exist: 003"},
+		{"grant org2 read", owner, []string{"grantAsset", "001", "Org2MSP", "read", "2018-05-26T00:00:00Z"}, ""},
+		{"grant user2 write", owner, []string{"grantAsset", "002", user2Grantee, "write", "2018-05-25T01:00:00Z"}, ""},
+		{"member reads", user3, []string{"getAsset", "001", "Org1MSP"}, ""},
+		{"read grant", user2, []string{"updateAsset", "001", "roll", "food", "cathy", "true", "2018-05-26", "1502688979", "Org1MSP"}, "Asset 001 of Org1MSP is not granted to Org2MSP for write"},
+		{"user grant", user3, []string{"getAsset", "002", "Org1MSP"}, "Asset 002 of Org1MSP is not granted to Org2MSP for read"},
+		{"write implies read", user2, []string{"getAsset", "002", "Org1MSP"}, ""},
+		{"granted write", user2, []string{"updateAsset", "002", "mallet", "tool", "cathy", "true", "2018-05-26", "1502688979", "Org1MSP"}, ""},
+		{"revoke missing", owner, []string{"revokeGrant", "001", user2Grantee}, "Asset 001 has no grant for " + user2Grantee},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+	if asset, err := getDemoAsset(newTenantStub(stub, defaultConfig(), "Org1MSP"), "002"); err != nil || asset.Name != "mallet" {
+		t.Errorf("granted update wrote %v %v to the owner's tenant", asset, err)
+	}
+
+	// list queries add the assets granted to the caller
+	invokeResult = stub.MockInvokeAs(user2, "12345", "getAllAssets")
+	if !strings.Contains(string(invokeResult.Payload), `{"Key":"001", "Tenant":"Org1MSP", "Record":`) || !strings.Contains(string(invokeResult.Payload), `"mallet"`) {
+		t.Errorf("getAllAssets of user2 returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	var assets []DemoAsset
+	invokeResult = stub.MockInvokeAs(user3, "12345", "getAssetByType", "food")
+	if err := json.Unmarshal(invokeResult.Payload, &assets); err != nil || len(assets) != 1 || assets[0].Name != "bread" {
+		t.Errorf("getAssetByType of user3 returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	// grant events are emitted for audit
+	drainEvents(stub)
+	invokeResult = stub.MockInvokeAs(owner, "12345", "grantAsset", "001", "Org2MSP", "read", "2018-05-27T00:00:00Z")
+	select {
+	case ccEvent := <-stub.ChaincodeEventsChannel:
+		var event GrantEvent
+		if err := json.Unmarshal(ccEvent.Payload, &event); err != nil || ccEvent.EventName != GrantEventName ||
+			event.EventType != EventGrantCreated || event.Grant.ExpiresAt != time.Date(2018, 5, 27, 0, 0, 0, 0, time.UTC).Unix() || event.Creator != "Org1MSP.user1" {
+			t.Errorf("grantAsset emitted %s %s", ccEvent.EventName, ccEvent.Payload)
+		}
+	default:
+		t.Errorf("grantAsset emitted no event: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+
+	// expired grants stop applying
+	stub.Clock = stub.Clock.Add(2 * time.Hour)
+	assertResponse(t, "expired write", stub.MockInvokeAs(user2, "12345", "updateAsset", "002", "hammer", "tool", "cathy", "true", "2018-05-26", "1502688979", "Org1MSP"), "Asset 002 of Org1MSP is not granted to Org2MSP for write")
+	invokeResult = stub.MockInvokeAs(user2, "12345", "getAllAssets")
+	if strings.Contains(string(invokeResult.Payload), `"mallet"`) {
+		t.Errorf("getAllAssets of user2 returned an expired grant: %s", invokeResult.Payload)
+	}
+	var grants []Grant
+	invokeResult = stub.MockInvokeAs(owner, "12345", "listGrants")
+	if err := json.Unmarshal(invokeResult.Payload, &grants); err != nil || len(grants) != 2 ||
+		grants[0].ID != "001" || grants[0].Expired || grants[1].ID != "002" || !grants[1].Expired || grants[1].GrantedBy == "" {
+		t.Errorf("listGrants returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	assertResponse(t, "revoke", stub.MockInvokeAs(owner, "12345", "revokeGrant", "002", user2Grantee), "")
+	assertResponse(t, "list other tenant", stub.MockInvokeAs(user2, "12345", "listGrants", "001"), "")
+	if invokeResult = stub.MockInvokeAs(owner, "12345", "listGrants", "002"); string(invokeResult.Payload) != "[]" {
+		t.Errorf("listGrants after revoke returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+}
+
+func TestGrantsWithoutTenancy(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestGrantsWithoutTenancy ****************")
+	org1 := NewTestCA(t, "Org1MSP")
+	cathy := org1.Creator(t, TestIdentity{CommonName: "cathy"})
+	erin := org1.Creator(t, TestIdentity{CommonName: "erin"})
+	bob := NewTestCA(t, "Org2MSP").Creator(t, TestIdentity{CommonName: "bob"})
+	dave := NewTestCA(t, "Org3MSP").Creator(t, TestIdentity{CommonName: "dave"})
+
+	// DemoAsset.Owner is the common name of the owner's account
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"create", cathy, []string{"creatAsset", "001", "bread", "food", "cathy", "true", "2018-05-25", "1502688979"}, ""},
+		{"create 002", cathy, []string{"creatAsset", "002", "hammer", "tool", "cathy", "true", "2018-05-25", "1502688979"}, ""},
+		{"other MSP", bob, []string{"grantAsset", "001", "Org2MSP", "read", "2018-05-26T00:00:00Z"}, "Only the owner can grant Asset 001, Org2MSP/bob is not the owner cathy"},
+		{"same MSP", erin, []string{"grantAsset", "001", "Org2MSP", "read", "2018-05-26T00:00:00Z"}, "Only the owner can grant Asset 001, Org1MSP/erin is not the owner cathy"},
+		{"not granted", bob, []string{"getAsset", "001", "cathy"}, "Asset 001 of cathy is not granted to Org2MSP for read"},
+		{"grant", cathy, []string{"grantAsset", "001", "Org2MSP", "write", "2018-05-26T00:00:00Z"}, ""},
+		{"granted read", bob, []string{"getAsset", "001", "cathy"}, ""},
+		{"granted to org2 only", dave, []string{"getAsset", "001", "cathy"}, "Asset 001 of cathy is not granted to Org3MSP for read"},
+		{"other owner", bob, []string{"getAsset", "001", "dave"}, "Asset 001 is not owned by dave"},
+		{"owner reads", cathy, []string{"getAsset", "001", "cathy"}, ""},
+		{"granted write", bob, []string{"updateAsset", "001", "roll", "food", "cathy", "true", "2018-05-26", "1502688979", "cathy"}, ""},
+		{"revoke missing", cathy, []string{"revokeGrant", "001", "Org3MSP"}, "Asset 001 has no grant for Org3MSP"},
+		{"grant 002", cathy, []string{"grantAsset", "002", "Org2MSP", "read", "2018-05-26T00:00:00Z"}, ""},
+		{"delete granted", cathy, []string{"deleteAsset", "002"}, ""},
+		{"recreate", cathy, []string{"creatAsset", "002", "mallet", "tool", "cathy", "true", "2018-05-25", "1502688979"}, ""},
+		{"recreated read", bob, []string{"getAsset", "002", "cathy"}, "Asset 002 of cathy is not granted to Org2MSP for read"},
+		{"change owner", cathy, []string{"updateAsset", "001", "roll", "food", "dave", "true", "2018-05-26", "1502688979"}, ""},
+		{"grant of the old owner", bob, []string{"getAsset", "001", "cathy"}, "Asset 001 is not owned by cathy"},
+		{"no grant of the new owner", bob, []string{"getAsset", "001", "dave"}, "Asset 001 of dave is not granted to Org2MSP for read"},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+
+	var grants []Grant
+	invokeResult := stub.MockInvokeAs(cathy, "12345", "listGrants")
+	if err := json.Unmarshal(invokeResult.Payload, &grants); err != nil || len(grants) != 1 ||
+		grants[0].ObjectType != DemoAssetObjectType || grants[0].Owner != "cathy" || grants[0].ID != "001" {
+		t.Errorf("listGrants of cathy returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	if invokeResult = stub.MockInvokeAs(bob, "12345", "listGrants"); string(invokeResult.Payload) != "[]" {
+		t.Errorf("listGrants of bob returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+}
+
+func TestDarGrants(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestDarGrants ****************")
+	org1 := NewTestCA(t, "Org1MSP").Creator(t, TestIdentity{CommonName: "user1"})
+	org2 := NewTestCA(t, "Org2MSP").Creator(t, TestIdentity{CommonName: "user2"})
+	doc := `{"docId":"doc1","aclId":"acl1","version":"1","docDigest":"5d41402a","type":"contract","fields":[]}`
+	update := `{"docId":"doc1","aclId":"acl1","version":"2","docDigest":"7d793037","type":"contract","fields":[],"owner":"Org2MSP"}`
+
+	tests := []struct {
+		name    string
+		creator []byte
+		args    []string
+		message string
+	}{
+		{"bad JSON", org1, []string{"createDar", "{"}, "Invalid DAR JSON: unexpected end of JSON input"},
+		{"no docId", org1, []string{"createDar", `{"version":"1"}`}, "docId must be a non-empty string"},
+		{"create", org1, []string{"createDar", doc}, ""},
+		{"create twice", org2, []string{"createDar", doc}, "DAR already exists: doc1"},
+		{"missing DAR", org1, []string{"grantAsset", "doc2", "Org2MSP", "read", "2018-05-26T00:00:00Z", "DAR"}, "DAR does not exist: doc2"},
+		{"bad object type", org1, []string{"grantAsset", "doc1", "Org2MSP", "read", "2018-05-26T00:00:00Z", "Folder"}, "5th argument must be DemoAsset or DAR"},
+		{"not the owner", org2, []string{"grantAsset", "doc1", "Org2MSP", "read", "2018-05-26T00:00:00Z", "DAR"}, "Only the owner can grant DAR doc1, Org2MSP/user2 is not the owner Org1MSP"},
+		{"grant the owner", org1, []string{"grantAsset", "doc1", "Org1MSP", "read", "2018-05-26T00:00:00Z", "DAR"}, "2nd argument must be a grantee other than the owner Org1MSP"},
+		{"not granted", org2, []string{"getDar", "doc1"}, "DAR doc1 of Org1MSP is not granted to Org2MSP for read"},
+		{"grant read", org1, []string{"grantAsset", "doc1", "Org2MSP", "read", "2018-05-26T00:00:00Z", "DAR"}, ""},
+		{"granted read", org2, []string{"getDar", "doc1"}, ""},
+		{"read grant", org2, []string{"updateDar", update}, "DAR doc1 of Org1MSP is not granted to Org2MSP for write"},
+		{"grant write", org1, []string{"grantAsset", "doc1", "Org2MSP", "write", "2018-05-26T00:00:00Z", "DAR"}, ""},
+		{"granted write", org2, []string{"updateDar", update}, ""},
+		{"asset grant", org1, []string{"revokeGrant", "doc1", "Org2MSP"}, "Asset doc1 has no grant for Org2MSP"},
+		{"revoke", org1, []string{"revokeGrant", "doc1", "Org2MSP", "DAR"}, ""},
+		{"revoked read", org2, []string{"getDar", "doc1"}, "DAR doc1 of Org1MSP is not granted to Org2MSP for read"},
+	}
+	for _, tt := range tests {
+		assertResponse(t, tt.name, stub.MockInvokeAs(tt.creator, "12345", tt.args...), tt.message)
+	}
+
+	// the owner stays the creator's MSP
+	var dar DAR
+	invokeResult := stub.MockInvokeAs(org1, "12345", "getDar", "doc1")
+	if err := json.Unmarshal(invokeResult.Payload, &dar); err != nil || dar.Version != "2" || dar.Owner != "Org1MSP" {
+		t.Errorf("getDar returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	var grants []Grant
+	invokeResult = stub.MockInvokeAs(org1, "12345", "listGrants", "doc1", "DAR")
+	if err := json.Unmarshal(invokeResult.Payload, &grants); err != nil || len(grants) != 0 {
+		t.Errorf("listGrants of doc1 returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestAuditLog ****************")
+	invokeResult := stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"audit":true,"adminMSPs":["Org1MSP"]}`))
+	if invokeResult.Status != 200 {
+		t.Fatalf("Init returned non-OK status, got: %d, want: %d. %s", invokeResult.Status, 200, invokeResult.Message)
+	}
+	user1 := NewTestCA(t, "Org1MSP").Creator(t, TestIdentity{CommonName: "user1"})
+	user2 := NewTestCA(t, "Org2MSP").Creator(t, TestIdentity{CommonName: "user2"})
+	txCount := 0
+	nextTxID := func() string {
+		txCount++
+		return fmt.Sprintf("tx%d", txCount)
+	}
+
+	// the clock starts at 2018-05-25T00:00:00Z and advances a second per transaction
+	created := []string{"creatAsset", "001", "test", "food", "cathy", "true", "2018-05-25", "1502688979"}
+	assertResponse(t, "user1 creates", stub.MockInvokeAs(user1, nextTxID(), created...), "")
+	assertResponse(t, "reads are not recorded", stub.MockInvokeAs(user1, nextTxID(), "getAsset", "001"), "")
+	assertResponse(t, "failures are not recorded", stub.MockInvokeAs(user2, nextTxID(), "deleteAsset", "002"), `{"Error":"Asset does not exist: 002"}`)
+	stub.Clock = stub.Clock.Add(24 * time.Hour)
+	assertResponse(t, "user2 updates", stub.MockInvokeAs(user2, nextTxID(), "updateAsset", "001", "test", "food", "bob", "true", "2018-05-26", "1502688979"), "")
+	assertResponse(t, "user1 deletes", stub.MockInvokeAs(user1, nextTxID(), "deleteAsset", "001"), "")
+
+	argsJSONasBytes, _ := json.Marshal(created[1:])
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"by identity", []string{"Org1MSP.user1", "", "", ""}, []string{"tx1 creatAsset", "tx5 deleteAsset"}},
+		{"by identity and function", []string{"Org1MSP.user1", "deleteAsset", "", ""}, []string{"tx5 deleteAsset"}},
+		{"by identity and time", []string{"Org1MSP.user1", "", "2018-05-25T00:00:00Z", "2018-05-26T00:00:00Z"}, []string{"tx1 creatAsset"}},
+		{"by day", []string{"", "", "2018-05-26T00:00:00Z", "2018-05-27T00:00:00Z"}, []string{"tx4 updateAsset", "tx5 deleteAsset"}},
+		{"by function and time", []string{"", "updateAsset", "2018-05-20T00:00:00Z", ""}, []string{"tx4 updateAsset"}},
+		{"within a day", []string{"", "", "2018-05-26T00:00:04Z", "2018-05-26T00:00:05Z"}, []string{"tx4 updateAsset"}},
+		{"unknown identity", []string{"Org3MSP.user3", "", "", ""}, []string{}},
+	}
+	for _, tt := range tests {
+		invokeResult = stub.MockInvokeAs(user1, nextTxID(), append([]string{"queryAuditLog"}, tt.args...)...)
+		var entries []AuditEntry
+		got := []string{}
+		err := json.Unmarshal(invokeResult.Payload, &entries)
+		for _, entry := range entries {
+			got = append(got, entry.TxID+" "+entry.Function)
+			if entry.TxID == "tx1" && (entry.ArgsDigest != digest(argsJSONasBytes) || entry.Creator != "Org1MSP.user1" ||
+				entry.Timestamp != "2018-05-25T00:00:01.000000000Z") {
+				t.Errorf("%s: creatAsset entry is %+v", tt.name, entry)
+			}
+		}
+		if err != nil || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: queryAuditLog returned %d %s %s, want %v", tt.name, invokeResult.Status, invokeResult.Message, invokeResult.Payload, tt.want)
+		}
+	}
+	assertResponse(t, "without identity and time", stub.MockInvokeAs(user1, nextTxID(), "queryAuditLog", "", "creatAsset", "", ""), "Querying the audit log without an identity requires a time range")
+	assertResponse(t, "long range", stub.MockInvokeAs(user1, nextTxID(), "queryAuditLog", "", "", "2017-01-01T00:00:00Z", "2018-05-26T00:00:00Z"), "Querying the audit log without an identity is limited to 366 days")
+	assertResponse(t, "bad time", stub.MockInvokeAs(user1, nextTxID(), "queryAuditLog", "", "", "yesterday", ""), "3rd argument must be an RFC 3339 timestamp")
+}
+
+func TestLogger(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	stub.LoadCollections(t, "collection_definition.json")
+	stub.MSPID = "OBPFounder"
+	stub.Creator = NewTestCA(t, "OBPFounder").Creator(t, TestIdentity{CommonName: "user1"})
+	t.Log("************ TestLogger ****************")
+	var lines []string
+	defer func(write func(shim.LoggingLevel, string)) {
+		writeLog = write
+		logger.SetLevel(shim.LogInfo)
+	}(writeLog)
+	writeLog = func(level shim.LoggingLevel, line string) { lines = append(lines, line) }
+
+	formatTests := []struct {
+		msg     string
+		keyvals []interface{}
+		want    string
+	}{
+		{"plain", []interface{}{"id", "001", "size", 3}, `msg="plain" id=001 size=3`},
+		{"quoted", []interface{}{"error", `bad "value"`, "empty", ""}, `msg="quoted" error="bad \"value\"" empty=""`},
+		{"odd", []interface{}{"id"}, `msg="odd" id=<missing>`},
+		{"redacted", []interface{}{"value", redacted("secret")}, `msg="redacted" value="<redacted 6 bytes>"`},
+	}
+	for _, tt := range formatTests {
+		if got := formatLogLine(tt.msg, tt.keyvals); got != tt.want {
+			t.Errorf("formatLogLine(%q) = %s, want: %s", tt.msg, got, tt.want)
+		}
+	}
+
+	// the config sets the level, the environment variable overrides it
+	assertResponse(t, "bad level", stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"logLevel":"verbose"}`)), "logLevel must be one of DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
+	assertResponse(t, "error level", stub.MockInit("instantiate", util.ToChaincodeArgs("init", `{"logLevel":"ERROR","audit":true}`)), "")
+	createTestAssets(t, stub)
+	if len(lines) != 0 {
+		t.Errorf("ERROR level wrote %d lines: %s", len(lines), lines[0])
+	}
+	os.Setenv(LogLevelEnv, "debug")
+	defer os.Unsetenv(LogLevelEnv)
+
+	// every line has the transaction and function, private data and payloads are never written
+	marble := `{"MarbleID":"m_secret","Name":"mmm","Color":"red","Size":"10","OwnerID":"ssd"}`
+	assertResponse(t, "put private data", stub.MockInvoke("tx1", util.ToChaincodeArgs("putPrivateData", "privateDataCollection", marble)), "")
+	assertResponse(t, "get private data", stub.MockInvoke("tx2", util.ToChaincodeArgs("getPrivateData", "privateDataCollection", "m_secret")), "")
+	assertResponse(t, "invalid marble", stub.MockInvoke("tx3", util.ToChaincodeArgs("putPrivateData", "privateDataCollection", `{"MarbleID":"m_secret","Name":"mmm","Color":"purple"}`)), "Color must be one of [red blue green]")
+	assertResponse(t, "get all assets", stub.MockInvoke("tx4", util.ToChaincodeArgs("getAllAssets")), "")
+	assertResponse(t, "public failure", stub.MockInvoke("tx0", util.ToChaincodeArgs("deleteAsset", "999")), `{"Error":"Asset does not exist: 999"}`)
+	if len(lines) < 6 {
+		t.Fatalf("DEBUG level wrote %d lines", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, " txId=tx") || !strings.Contains(line, " function=") {
+			t.Errorf("line has no transaction fields: %s", line)
+		}
+		if strings.Contains(line, "m_secret") || strings.Contains(line, "ssd") || strings.Contains(line, "mmm") || strings.Contains(line, "cathy") {
+			t.Errorf("line leaks a payload: %s", line)
+		}
+	}
+	for _, want := range []string{
+		`msg="put private data" txId=tx1 function=putPrivateData collection=privateDataCollection value="<redacted 78 bytes>"`,
+		`msg="invoke failed" txId=tx3 function=putPrivateData status=500 error="<redacted 37 bytes>"`,
+		`msg="invoke failed" txId=tx0 function=deleteAsset status=500 error="{\"Error\":\"Asset does not exist: 999\"}"`,
+	} {
+		if !strings.Contains(strings.Join(lines, "\n"), want) {
+			t.Errorf("line %s is missing from:\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+
+	// the audit log of the ledger has no digest of collection contents either
+	entry, err := getAuditEntry(stub, "tx1")
+	if err != nil || entry.Function != "putPrivateData" || entry.ArgsDigest != "" {
+		t.Errorf("audit entry of putPrivateData is %+v %v", entry, err)
+	}
+}
+
+func TestAssetVersions(t *testing.T) {
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	t.Log("************ TestAssetVersions ****************")
+	createTestAssets(t, stub)
+
+	// reads carry the ETag, a matching If-None-Match is not modified
+	invokeResult := stub.MockInvoke("12345", util.ToChaincodeArgs("getAsset", "001"))
+	etag := invokeResult.Message
+	if invokeResult.Status != 200 || etag != assetETag(stub.State["001"]) {
+		t.Fatalf("Get asset returned wrong ETag, got: %d %q", invokeResult.Status, etag)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getAsset", "001", "", etag))
+	if invokeResult.Status != StatusNotModified || invokeResult.Message != etag || invokeResult.Payload != nil {
+		t.Errorf("Conditional get asset returned wrong response, got: %d %q %s", invokeResult.Status, invokeResult.Message, invokeResult.Payload)
+	}
+
+	// two clients edit version 1, the second one is stale
+	update := []string{"updateAsset", "001", "test_new", "drink", "tom", "false", "2018-05-28", "1502688999", "", "1"}
+	assertResponse(t, "update version 1", stub.MockInvoke("12345", util.ToChaincodeArgs(update...)), "")
+	if demoAsset := getStateAsset(t, stub, "001"); demoAsset.Version != 2 {
+		t.Errorf("Update asset stored version %d, want: 2", demoAsset.Version)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs(update...))
+	if invokeResult.Status != StatusConflict || invokeResult.Message != `{"Error":"Version conflict on asset 001: expected version 1, current version 2","conflict":{"id":"001","expected":1,"version":2}}` {
+		t.Errorf("Stale update returned wrong response, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("getAsset", "001", "", etag))
+	if invokeResult.Status != 200 || invokeResult.Message == etag || invokeResult.Payload == nil {
+		t.Errorf("Get changed asset returned wrong response, got: %d %q", invokeResult.Status, invokeResult.Message)
+	}
+	update[9] = "first"
+	assertResponse(t, "invalid version", stub.MockInvoke("12345", util.ToChaincodeArgs(update...)), "9th argument must be a positive version number")
+
+	// a batch item with a version is checked as well
+	assets := `[{"id":"002","name":"test2","type":"food","owner":"cathy","version":3}]`
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("updateAssetsBatch", assets, BatchModeBestEffort))
+	var result BatchResult
+	if err := json.Unmarshal(invokeResult.Payload, &result); err != nil || result.Failed != 1 || result.Items[0].Error != "Version conflict on asset 002: expected version 3, current version 1" {
+		t.Errorf("Stale batch update returned wrong result, got: %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+
+	invokeResult = stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAsset", "001", "", "1"))
+	if invokeResult.Status != StatusConflict || getStateAsset(t, stub, "001") == nil {
+		t.Errorf("Stale delete returned wrong response, got: %d %s", invokeResult.Status, invokeResult.Message)
+	}
+	assertResponse(t, "delete version 2", stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAsset", "001", "", "2")), "")
+	assertResponse(t, "unconditional delete", stub.MockInvoke("12345", util.ToChaincodeArgs("deleteAsset", "002")), "")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/common/util"
+)
+
+// propertySeed replays a single failing sequence: go test -run TestAssetProperties -property.seed 7
+var propertySeed = flag.Int64("property.seed", 0, "run TestAssetProperties with this seed only")
+
+// assetModel is the expected ledger content of a random call sequence
+type assetModel struct {
+	assets    map[string]DemoAsset
+	mutations map[string]int
+}
+
+var (
+	propertyIDs    = []string{"001", "002", "003", "004", "005"}
+	propertyTypes  = []string{"food", "drink", "toy"}
+	propertyOwners = []string{"cathy", "tom", "jerry"}
+)
+
+// TestAssetProperties drives Invoke with random create/update/delete/query sequences and
+// checks the ledger against a model after every step
+func TestAssetProperties(t *testing.T) {
+	seeds, steps := 20, 150
+	if testing.Short() {
+		seeds, steps = 5, 50
+	}
+	if *propertySeed != 0 {
+		runAssetProperties(t, *propertySeed, steps)
+		return
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		runAssetProperties(t, seed, steps)
+	}
+}
+
+func runAssetProperties(t *testing.T, seed int64, steps int) {
+	r := rand.New(rand.NewSource(seed))
+	stub := NewTestStub("mockChaincodeStub", new(MyChaincode))
+	model := &assetModel{assets: make(map[string]DemoAsset), mutations: make(map[string]int)}
+
+	var trace []string
+	for step := 0; step < steps; step++ {
+		args := randomAssetCall(r)
+		trace = append(trace, strings.Join(args, " "))
+		invokeResult := stub.MockInvoke("tx"+strconv.Itoa(step), util.ToChaincodeArgs(args...))
+		drainEvents(stub)
+
+		err := model.apply(args, invokeResult.Status == 200, invokeResult.Payload)
+		if err == nil {
+			err = checkAssetInvariants(stub, model)
+		}
+		if err != nil {
+			t.Fatalf("seed %d, step %d: %s\ncalls:\n%s", seed, step, err, strings.Join(trace, "\n"))
+		}
+	}
+}
+
+func randomAssetCall(r *rand.Rand) []string {
+	id := propertyIDs[r.Intn(len(propertyIDs))]
+	switch r.Intn(6) {
+	case 0, 1:
+		return []string{"creatAsset", id, "name" + strconv.Itoa(r.Intn(100)), propertyTypes[r.Intn(len(propertyTypes))],
+			propertyOwners[r.Intn(len(propertyOwners))], strconv.FormatBool(r.Intn(2) == 0), "2018-05-25", strconv.Itoa(1502688979 + r.Intn(1000))}
+	case 2:
+		call := []string{"updateAsset", id, "name" + strconv.Itoa(r.Intn(100)), propertyTypes[r.Intn(len(propertyTypes))],
+			propertyOwners[r.Intn(len(propertyOwners))], strconv.FormatBool(r.Intn(2) == 0), "2018-05-28", strconv.Itoa(1502688979 + r.Intn(1000))}
+		if r.Intn(2) == 0 {
+			// an expected version, stale about half of the time
+			call = append(call, "", strconv.Itoa(1+r.Intn(3)))
+		}
+		return call
+	case 3:
+		return []string{"deleteAsset", id}
+	case 4:
+		return []string{"getAsset", id}
+	default:
+		return []string{"getAssetByType", propertyTypes[r.Intn(len(propertyTypes))]}
+	}
+}
+
+// apply checks the outcome of a call against the model and updates the model
+func (m *assetModel) apply(args []string, ok bool, payload []byte) error {
+	function, id := args[0], args[1]
+	current, exists := m.assets[id]
+	switch function {
+	case "creatAsset", "updateAsset":
+		want := (function == "creatAsset") != exists
+		if len(args) == 10 && args[9] != strconv.Itoa(current.Version) {
+			want = false
+		}
+		if ok != want {
+			return fmt.Errorf("%s %s succeeded: %t, want: %t", function, id, ok, want)
+		}
+		if ok {
+			_flag, _ := strconv.ParseBool(args[5])
+			_timestamp, _ := strconv.Atoi(args[7])
+			m.assets[id] = DemoAsset{id, args[2], strings.ToUpper(args[3]), args[4], _flag, args[6], _timestamp, current.Version + 1}
+			m.mutations[id]++
+		}
+	case "deleteAsset":
+		if ok != exists {
+			return fmt.Errorf("deleteAsset %s succeeded: %t, want: %t", id, ok, exists)
+		}
+		if ok {
+			delete(m.assets, id)
+			m.mutations[id]++
+		}
+	case "getAsset":
+		if ok != exists {
+			return fmt.Errorf("getAsset %s succeeded: %t, want: %t", id, ok, exists)
+		}
+		if ok {
+			var got DemoAsset
+			if err := json.Unmarshal(payload, &got); err != nil || got != current {
+				return fmt.Errorf("getAsset %s returned %s, want: %+v", id, payload, current)
+			}
+		}
+	case "getAssetByType":
+		var got []DemoAsset
+		if err := json.Unmarshal(payload, &got); !ok || err != nil {
+			return fmt.Errorf("getAssetByType %s returned %s", id, payload)
+		}
+		want := []DemoAsset{}
+		for _, key := range m.sortedIDs() {
+			if m.assets[key].Type == strings.ToUpper(id) {
+				want = append(want, m.assets[key])
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("getAssetByType %s returned %+v, want: %+v", id, got, want)
+		}
+	}
+	return nil
+}
+
+func (m *assetModel) sortedIDs() []string {
+	ids := make([]string, 0, len(m.assets))
+	for id := range m.assets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// checkAssetInvariants - state, indexes, getAllAssets and history agree with the model
+func checkAssetInvariants(stub *TestStub, model *assetModel) error {
+	// every asset has exactly its type and owner index entries
+	wantIndexes := make(map[string]bool)
+	for _, asset := range model.assets {
+		for _, attributes := range [][]string{{AssetQueryMap["AssetType"], asset.Type, asset.ID}, {AssetQueryMap["AssetOwner"], asset.Owner, asset.ID}} {
+			indexKey, err := stub.CreateCompositeKey(attributes[0], attributes[1:])
+			if err != nil {
+				return err
+			}
+			wantIndexes[indexKey] = true
+		}
+	}
+	for key := range stub.State {
+		if !strings.HasPrefix(key, compositeKeyNamespace) {
+			continue
+		}
+		if !wantIndexes[key] {
+			return fmt.Errorf("stale index entry %q", key)
+		}
+		delete(wantIndexes, key)
+	}
+	for key := range wantIndexes {
+		return fmt.Errorf("missing index entry %q", key)
+	}
+
+	// getAllAssets lists the model
+	invokeResult := stub.MockInvoke("getAllAssets", util.ToChaincodeArgs("getAllAssets"))
+	var all ResultJSON
+	if err := json.Unmarshal(invokeResult.Payload, &all); invokeResult.Status != 200 || err != nil {
+		return fmt.Errorf("getAllAssets returned %d %s", invokeResult.Status, invokeResult.Payload)
+	}
+	ids := model.sortedIDs()
+	if len(all) != len(ids) {
+		return fmt.Errorf("getAllAssets returned %d assets, want: %d", len(all), len(ids))
+	}
+	for i, id := range ids {
+		if all[i].Key != id || all[i].Record != model.assets[id] {
+			return fmt.Errorf("getAllAssets returned %+v, want: %+v", all[i], model.assets[id])
+		}
+	}
+
+	// one history entry per successful mutation
+	for _, id := range propertyIDs {
+		if len(stub.History[id]) != model.mutations[id] {
+			return fmt.Errorf("history of %s has %d entries, want: %d", id, len(stub.History[id]), model.mutations[id])
+		}
+	}
+	return nil
+}
+
+// drainEvents empties the event channel of the mock, it blocks once it holds 100 events
+func drainEvents(stub *TestStub) {
+	for {
+		select {
+		case <-stub.ChaincodeEventsChannel:
+		default:
+			return
+		}
+	}
+}
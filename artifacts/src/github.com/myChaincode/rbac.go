@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// RoleIndex is the composite key object type of role memberships: role, MSP ID, cid.GetID
+const RoleIndex = "Role~MSP~ID"
+
+// Roles of the registry, RoleAdmin may call every function and manages the registry
+const (
+	RoleAdmin  = "admin"
+	RoleWriter = "writer"
+	RoleReader = "reader"
+)
+
+// knownRoles are the roles grantRole accepts
+var knownRoles = []string{RoleAdmin, RoleReader, RoleWriter}
+
+// AnyCaller declares a function every caller may invoke, it is not a role of the registry
+const AnyCaller = "*"
+
+// functionRoles declares the roles that may call an Invoke function, in addition to RoleAdmin.
+// Roles are enforced once Init has bootstrapped the admins, undeclared functions are always denied.
+// Until then the functions reserved to RoleAdmin require a config administrator, see checkAdmin.
+var functionRoles = map[string][]string{
+	"creatAsset":           {RoleWriter},
+	"updateAsset":          {RoleWriter},
+	"deleteAsset":          {RoleWriter},
+	"createAssetsBatch":    {RoleWriter},
+	"updateAssetsBatch":    {RoleWriter},
+	"deleteAssetsBatch":    {RoleWriter},
+	"offerAsset":           {RoleWriter},
+	"withdrawOffer":        {RoleWriter},
+	"purchaseAsset":        {RoleWriter},
+	"putPrivateData":       {RoleWriter},
+	"fireCCEvent":          {RoleWriter},
+	"approveRequest":       {RoleWriter},
+	"expireApprovals":      {RoleWriter},
+	"createAcl":            {RoleWriter},
+	"updateAcl":            {RoleWriter},
+	"createDar":            {RoleWriter},
+	"updateDar":            {RoleWriter},
+	"shareAsset":           {RoleWriter},
+	"unshareAsset":         {RoleWriter},
+	"grantAsset":           {RoleWriter},
+	"revokeGrant":          {RoleWriter},
+	"getAsset":             {RoleReader, RoleWriter},
+	"getAllAssets":         {RoleReader, RoleWriter},
+	"getAssetByType":       {RoleReader, RoleWriter},
+	"getHistoryForRecord":  {RoleReader, RoleWriter},
+	"richQuery":            {RoleReader, RoleWriter},
+	"getPrivateData":       {RoleReader, RoleWriter},
+	"exportState":          {RoleReader, RoleWriter},
+	"listRoles":            {RoleReader, RoleWriter},
+	"getApprovalRequest":   {RoleReader, RoleWriter},
+	"getPendingApprovals":  {RoleReader, RoleWriter},
+	"getSchemaStatus":      {RoleReader, RoleWriter},
+	"getConfig":            {RoleReader, RoleWriter},
+	"getCCAllowlist":       {RoleReader, RoleWriter},
+	"getCertificate":       {RoleReader, RoleWriter},
+	"getTxCreatorInfo":     {RoleReader, RoleWriter},
+	"getABAC":              {RoleReader, RoleWriter},
+	"testRESTCC":           {RoleReader, RoleWriter},
+	"getAcl":               {RoleReader, RoleWriter},
+	"getDar":               {RoleReader, RoleWriter},
+	"whoami":               {AnyCaller},
+	"listGrants":           {RoleReader, RoleWriter},
+	"grantRole":            {},
+	"revokeRole":           {},
+	"importState":          {},
+	"queryAuditLog":        {},
+	"migrate":              {},
+	"setCCAllowlist":       {},
+	"removeCCAllowlist":    {},
+	"invokeOtherCC":        {},
+	"invokeOtherChannelCC": {},
+	"setConfig":            {},
+}
+
+// RoleMember is an identity and a role it holds
+type RoleMember struct {
+	Role      string `json:"role"`
+	MSPID     string `json:"mspId"`
+	ID        string `json:"id"`
+	GrantedBy string `json:"grantedBy"`
+	TxID      string `json:"txId"`
+}
+
+// ===============================================
+// grantRole - give an identity a role, the id is cid.GetID of the identity as returned by whoami
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"grantRole","args":["writer", "Org1MSP", "<id>"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) grantRole(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: role, MSP ID, id")
+	}
+	if !containsString(knownRoles, args[0]) {
+		return shim.Error(fmt.Sprintf("Unknown role %q, expecting one of %v", args[0], knownRoles))
+	}
+	// without admins the registry cannot be changed, Init bootstraps it
+	enabled, err := rbacEnabled(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if !enabled {
+		return shim.Error("The role registry has no admins, Init sets the first ones")
+	}
+	caller, err := newCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callerMSP, callerID, err := caller.names()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	member := &RoleMember{Role: args[0], MSPID: args[1], ID: args[2], GrantedBy: callerMSP + "/" + callerID, TxID: stub.GetTxID()}
+	err = putRoleMember(stub, member)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	memberJSONasBytes, err := json.Marshal(member)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(memberJSONasBytes)
+}
+
+// ===============================================
+// revokeRole - take a role from an identity, the last admin cannot be revoked
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"revokeRole","args":["writer", "Org1MSP", "<id>"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) revokeRole(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: role, MSP ID, id")
+	}
+	key, err := stub.CreateCompositeKey(RoleIndex, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	memberBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if memberBytes == nil {
+		return shim.Error(fmt.Sprintf("%s does not have the role %s", args[2], args[0]))
+	}
+	if args[0] == RoleAdmin {
+		admins, err := getRoleMembers(stub, []string{RoleAdmin})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(admins) == 1 {
+			return shim.Error("The last admin cannot be revoked")
+		}
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(memberBytes)
+}
+
+// ===============================================
+// listRoles - list the role memberships, optionally of one role
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"listRoles","args":["writer"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) listRoles(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: role")
+	}
+	members, err := getRoleMembers(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	membersJSONasBytes, err := json.Marshal(members)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(membersJSONasBytes)
+}
+
+// bootstrapAdmins - grant RoleAdmin to the identities of the Init argument,
+// a JSON array of {"mspId": ..., "id": ...}
+func bootstrapAdmins(stub shim.ChaincodeStubInterface, adminsJSON string) error {
+	var admins []RoleMember
+	decoder := json.NewDecoder(strings.NewReader(adminsJSON))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&admins)
+	if err != nil {
+		return errors.New("Invalid admins JSON: " + err.Error())
+	}
+	for _, admin := range admins {
+		admin.Role, admin.GrantedBy, admin.TxID = RoleAdmin, "Init", stub.GetTxID()
+		err = putRoleMember(stub, &admin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putRoleMember(stub shim.ChaincodeStubInterface, member *RoleMember) error {
+	if len(member.Role) <= 0 || len(member.MSPID) <= 0 || len(member.ID) <= 0 {
+		return errors.New("role, MSP ID and id must be non-empty strings")
+	}
+	key, err := stub.CreateCompositeKey(RoleIndex, []string{member.Role, member.MSPID, member.ID})
+	if err != nil {
+		return err
+	}
+	memberJSONasBytes, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, memberJSONasBytes)
+}
+
+// getRoleMembers - the memberships in key order, attributes narrows them to a role
+func getRoleMembers(stub shim.ChaincodeStubInterface, attributes []string) ([]RoleMember, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(RoleIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	members := []RoleMember{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		member := RoleMember{}
+		err = json.Unmarshal(queryResponse.Value, &member)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// rbacEnabled - roles are enforced once the registry has an admin
+func rbacEnabled(stub shim.ChaincodeStubInterface) (bool, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(RoleIndex, []string{RoleAdmin})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	return resultsIterator.HasNext(), nil
+}
+
+// hasRole - whether the registry grants the role to the identity
+func hasRole(stub shim.ChaincodeStubInterface, role string, mspid string, id string) (bool, error) {
+	key, err := stub.CreateCompositeKey(RoleIndex, []string{role, mspid, id})
+	if err != nil {
+		return false, err
+	}
+	memberBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return memberBytes != nil, nil
+}
+
+// checkRoles - return an error unless the caller holds a role declared for function or is an admin
+func checkRoles(stub shim.ChaincodeStubInterface, config *Config, function string) error {
+	roles, ok := functionRoles[function]
+	if !ok {
+		return fmt.Errorf("Access denied to %s, the function does not declare its roles", function)
+	} else if containsString(roles, AnyCaller) {
+		return nil
+	}
+	enabled, err := rbacEnabled(stub)
+	if err != nil {
+		return err
+	} else if !enabled {
+		// before Init bootstraps the registry only the admin functions are restricted
+		if len(roles) == 0 {
+			return checkAdmin(stub, config, function)
+		}
+		return nil
+	}
+
+	allowed := append([]string{RoleAdmin}, roles...)
+	sort.Strings(allowed)
+	caller, err := newCaller(stub)
+	if err != nil {
+		return fmt.Errorf("Access denied to %s, the caller must be identified: %s", function, err.Error())
+	}
+	mspid, id, err := caller.names()
+	if err != nil {
+		return err
+	}
+	for _, role := range allowed {
+		ok, err = hasRole(stub, role, mspid, id)
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Access denied to %s, requires one of the roles %v", function, allowed)
+}
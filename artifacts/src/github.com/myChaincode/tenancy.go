@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key object types of tenancy mode
+const (
+	// TenantAssetIndex keys an asset by the MSP ID of its tenant and its id
+	TenantAssetIndex = "Tenant~Asset"
+	// TenantIndex lists the MSP IDs that wrote assets, migrations run in each of them
+	TenantIndex = "Tenant~MSP"
+)
+
+// compositeKeyNamespace is the first character of every composite key
+const compositeKeyNamespace = "\x00"
+
+// tenantStub confines the asset handlers to the namespace of one tenant. Simple keys are
+// asset ids and map to TenantAssetIndex keys, the asset index object types get the tenant
+// as their first attribute. Every other composite key is shared by all tenants.
+type tenantStub struct {
+	shim.ChaincodeStubInterface
+	tenant  string
+	indexes map[string]bool
+}
+
+// tenantScope - the stub of the caller's tenant in tenancy mode, otherwise stub itself
+func tenantScope(stub shim.ChaincodeStubInterface, config *Config) (shim.ChaincodeStubInterface, error) {
+	if !config.Tenancy {
+		return stub, nil
+	}
+	mspid, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, errors.New("Tenancy requires an identified caller: " + err.Error())
+	}
+	return newTenantStub(stub, config, mspid), nil
+}
+
+func newTenantStub(stub shim.ChaincodeStubInterface, config *Config, tenant string) *tenantStub {
+	indexes := make(map[string]bool)
+	for _, indexName := range config.AssetIndexes {
+		indexes[indexName] = true
+	}
+	return &tenantStub{ChaincodeStubInterface: baseStub(stub), tenant: tenant, indexes: indexes}
+}
+
+// scopeToTenant - run in the namespace of another tenant, a no-op without tenancy
+func scopeToTenant(stub shim.ChaincodeStubInterface, tenant string) shim.ChaincodeStubInterface {
+	if s, ok := stub.(*tenantStub); ok {
+		return &tenantStub{ChaincodeStubInterface: s.ChaincodeStubInterface, tenant: tenant, indexes: s.indexes}
+	}
+	return stub
+}
+
+// baseStub - the stub without tenant namespace
+func baseStub(stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	if s, ok := stub.(*tenantStub); ok {
+		return s.ChaincodeStubInterface
+	}
+	return stub
+}
+
+func isCompositeKey(key string) bool {
+	return strings.HasPrefix(key, compositeKeyNamespace)
+}
+
+func (s *tenantStub) assetKey(id string) (string, error) {
+	return s.ChaincodeStubInterface.CreateCompositeKey(TenantAssetIndex, []string{s.tenant, id})
+}
+
+// assetID - the asset id of a TenantAssetIndex key of this tenant
+func (s *tenantStub) assetID(key string) (string, bool) {
+	objectType, components, err := s.ChaincodeStubInterface.SplitCompositeKey(key)
+	if err != nil || objectType != TenantAssetIndex || len(components) != 2 || components[0] != s.tenant {
+		return "", false
+	}
+	return components[1], true
+}
+
+func (s *tenantStub) GetState(key string) ([]byte, error) {
+	if isCompositeKey(key) {
+		return s.ChaincodeStubInterface.GetState(key)
+	}
+	assetKey, err := s.assetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.ChaincodeStubInterface.GetState(assetKey)
+}
+
+func (s *tenantStub) PutState(key string, value []byte) error {
+	if isCompositeKey(key) {
+		return s.ChaincodeStubInterface.PutState(key, value)
+	}
+	assetKey, err := s.assetKey(key)
+	if err != nil {
+		return err
+	}
+	tenantKey, err := s.ChaincodeStubInterface.CreateCompositeKey(TenantIndex, []string{s.tenant})
+	if err != nil {
+		return err
+	}
+	err = s.ChaincodeStubInterface.PutState(tenantKey, []byte(s.tenant))
+	if err != nil {
+		return err
+	}
+	return s.ChaincodeStubInterface.PutState(assetKey, value)
+}
+
+func (s *tenantStub) DelState(key string) error {
+	if isCompositeKey(key) {
+		return s.ChaincodeStubInterface.DelState(key)
+	}
+	assetKey, err := s.assetKey(key)
+	if err != nil {
+		return err
+	}
+	return s.ChaincodeStubInterface.DelState(assetKey)
+}
+
+func (s *tenantStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	if isCompositeKey(key) {
+		return s.ChaincodeStubInterface.GetHistoryForKey(key)
+	}
+	assetKey, err := s.assetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.ChaincodeStubInterface.GetHistoryForKey(assetKey)
+}
+
+func (s *tenantStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	if s.indexes[objectType] {
+		attributes = append([]string{s.tenant}, attributes...)
+	}
+	return s.ChaincodeStubInterface.CreateCompositeKey(objectType, attributes)
+}
+
+func (s *tenantStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	objectType, components, err := s.ChaincodeStubInterface.SplitCompositeKey(compositeKey)
+	if err == nil && s.indexes[objectType] && len(components) > 0 {
+		components = components[1:]
+	}
+	return objectType, components, err
+}
+
+func (s *tenantStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	if s.indexes[objectType] {
+		keys = append([]string{s.tenant}, keys...)
+	}
+	return s.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, keys)
+}
+
+// GetStateByRange - the assets of the tenant with ids in [startKey, endKey), an empty endKey is unbounded
+func (s *tenantStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	resultsIterator, err := s.ChaincodeStubInterface.GetStateByPartialCompositeKey(TenantAssetIndex, []string{s.tenant})
+	if err != nil {
+		return nil, err
+	}
+	return &tenantIterator{StateQueryIteratorInterface: resultsIterator, assetID: func(key string) (string, bool) {
+		id, ok := s.assetID(key)
+		return id, ok && id >= startKey && (endKey == "" || id < endKey)
+	}}, nil
+}
+
+// GetQueryResult - the results of the query that are assets of the tenant
+func (s *tenantStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	resultsIterator, err := s.ChaincodeStubInterface.GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+	return &tenantIterator{StateQueryIteratorInterface: resultsIterator, assetID: s.assetID}, nil
+}
+
+func (s *tenantStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if s.indexes[objectType] {
+		keys = append([]string{s.tenant}, keys...)
+	}
+	return s.ChaincodeStubInterface.GetStateByPartialCompositeKeyWithPagination(objectType, keys, pageSize, bookmark)
+}
+
+// the pages of the other tenants would be filtered out of the results, so pagination cannot be kept
+
+func (s *tenantStub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return nil, nil, errors.New("Range queries with pagination are not supported in tenancy mode")
+}
+
+func (s *tenantStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return nil, nil, errors.New("Rich queries with pagination are not supported in tenancy mode")
+}
+
+// tenantIterator - the results whose key is an asset of the tenant, keyed by the asset id
+type tenantIterator struct {
+	shim.StateQueryIteratorInterface
+	assetID func(key string) (string, bool)
+	next    *queryresult.KV
+	err     error
+}
+
+func (it *tenantIterator) HasNext() bool {
+	for it.next == nil && it.err == nil && it.StateQueryIteratorInterface.HasNext() {
+		queryResponse, err := it.StateQueryIteratorInterface.Next()
+		if err != nil {
+			it.err = err
+		} else if id, ok := it.assetID(queryResponse.Key); ok {
+			it.next = &queryresult.KV{Namespace: queryResponse.Namespace, Key: id, Value: queryResponse.Value}
+		}
+	}
+	return it.next != nil || it.err != nil
+}
+
+func (it *tenantIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	next, err := it.next, it.err
+	it.next, it.err = nil, nil
+	return next, err
+}
+
+// ledgerHasAssets - whether assets exist in the flat key space or in any tenant
+func ledgerHasAssets(stub shim.ChaincodeStubInterface) (bool, error) {
+	stub = baseStub(stub)
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return false, err
+	}
+	hasAssets := resultsIterator.HasNext()
+	resultsIterator.Close()
+	if hasAssets {
+		return true, nil
+	}
+
+	resultsIterator, err = stub.GetStateByPartialCompositeKey(TenantAssetIndex, []string{})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	return resultsIterator.HasNext(), nil
+}
+
+// runInTenants - run a migration step in the namespace of each tenant in turn, at most limit
+// records of each, the cursor is the tenant and the cursor of the step within it
+func runInTenants(stub shim.ChaincodeStubInterface, config *Config, run func(shim.ChaincodeStubInterface, string, int) (string, error), cursor string, limit int) (string, error) {
+	stub = baseStub(stub)
+	resumeTenant, tenantCursor := "", ""
+	if cursor != "" {
+		parts := strings.SplitN(cursor, compositeKeyNamespace, 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Invalid tenancy migration cursor %q", cursor)
+		}
+		resumeTenant, tenantCursor = parts[0], parts[1]
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TenantIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		tenant := string(queryResponse.Value)
+		if tenant < resumeTenant {
+			continue
+		} else if tenant > resumeTenant {
+			tenantCursor = ""
+		}
+		next, err := run(newTenantStub(stub, config, tenant), tenantCursor, limit)
+		if err != nil {
+			return "", fmt.Errorf("tenant %s: %s", tenant, err.Error())
+		} else if next != "" {
+			return tenant + compositeKeyNamespace + next, nil
+		}
+	}
+	return "", nil
+}
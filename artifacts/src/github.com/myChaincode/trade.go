@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/myChaincode/example02/client"
+	"github.com/myChaincode/identity"
+)
+
+// Example02CCName is the name the example02 chaincode is deployed under
+const Example02CCName = "obcs-example02"
+
+// OfferObjectType is the composite key object type of asset offers
+const OfferObjectType = "Offer"
+
+// Offer is the asking price the owner of an asset sells it for
+type Offer struct {
+	AssetID string `json:"assetId"`
+	Seller  string `json:"seller"`
+	Price   int    `json:"price"`
+}
+
+// newExample02Client - example02 client on the current channel, calls go through the allowlist
+func newExample02Client(stub shim.ChaincodeStubInterface) *client.Client {
+	return client.NewWithInvoker(func(args []string) peer.Response {
+		return invokeChaincode(stub, "", Example02CCName, args)
+	})
+}
+
+// ===============================================
+// offerAsset - owner puts the asset up for sale at an asking price, the caller must be the owner,
+// whose account is the common name of its certificate
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"offerAsset","args":["001", "10"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) offerAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: asset id, price")
+	}
+	price, err := strconv.Atoi(args[1])
+	if err != nil || price <= 0 {
+		return shim.Error("2nd argument must be a positive integer")
+	}
+
+	demoAsset, err := getDemoAsset(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if caller != demoAsset.Owner {
+		return shim.Error(fmt.Sprintf("Only the owner can offer the asset, %s is not the owner %s", caller, demoAsset.Owner))
+	}
+
+	offer := Offer{AssetID: demoAsset.ID, Seller: demoAsset.Owner, Price: price}
+	offerBytes, err := json.Marshal(offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offerKey, err := stub.CreateCompositeKey(OfferObjectType, []string{offer.AssetID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(offerKey, offerBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(offerBytes)
+}
+
+// ===============================================
+// withdrawOffer - owner takes the asset off sale, the caller must be the seller of the offer
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"withdrawOffer","args":["001"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) withdrawOffer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: asset id")
+	}
+
+	offer, err := getOffer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if offer == nil {
+		return shim.Error("Asset is not offered for sale: " + args[0])
+	}
+	caller, err := callerAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if caller != offer.Seller {
+		return shim.Error(fmt.Sprintf("Only the seller can withdraw the offer, %s is not the seller %s", caller, offer.Seller))
+	}
+
+	offerKey, err := stub.CreateCompositeKey(OfferObjectType, []string{offer.AssetID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(offerKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ===============================================
+// purchaseAsset - buyer pays the owner in example02 and becomes the owner of the asset, the owner
+// must have offered the asset at the price and the buyer must be the caller, whose account is the
+// common name of its certificate, any failure fails the whole transaction
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/invocation \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"purchaseAsset","args":["001", "a", "10"],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) purchaseAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: asset id, buyer, price")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	price, err := strconv.Atoi(args[2])
+	if err != nil || price <= 0 {
+		return shim.Error("3rd argument must be a positive integer")
+	}
+
+	// ==== Check the asset, the offer and the buyer before moving funds ====
+	oldAsset, err := getDemoAsset(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer, err := getOffer(stub, oldAsset.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if offer == nil || offer.Seller != oldAsset.Owner {
+		// an offer made by a previous owner does not bind the current one
+		return shim.Error(fmt.Sprintf("Asset %s is not offered for sale by its owner %s", oldAsset.ID, oldAsset.Owner))
+	} else if price != offer.Price {
+		return shim.Error(fmt.Sprintf("Price %d does not match the asking price %d", price, offer.Price))
+	}
+	buyer := args[1]
+	caller, err := callerAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if buyer != caller {
+		return shim.Error(fmt.Sprintf("Only the buyer can purchase, %s is not the caller %s", buyer, caller))
+	}
+	if buyer == oldAsset.Owner {
+		return shim.Error("Buyer already owns the asset: " + buyer)
+	}
+
+	example02 := newExample02Client(stub)
+	account, err := example02.Query(buyer)
+	if err != nil {
+		return shim.Error("Failed to get buyer balance: " + err.Error())
+	}
+	if account.Amount < price {
+		return shim.Error(fmt.Sprintf("Insufficient balance for %s, has %d, price is %d", buyer, account.Amount, price))
+	}
+
+	// ==== Pay the current owner ====
+	err = example02.Move(buyer, oldAsset.Owner, price)
+	if err != nil {
+		return shim.Error("Payment failed: " + err.Error())
+	}
+
+	// ==== Transfer ownership ====
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	assetBytes, err := json.Marshal(oldAsset)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	newAsset := *oldAsset
+	newAsset.Owner = buyer
+	newAsset.UpdatedDate = time.Unix(txTimestamp.Seconds, 0).UTC().Format("2006-01-02")
+	newAsset.Timestamp = int(txTimestamp.Seconds)
+	newAsset.Version++
+	assetJSONasBytes, err := json.Marshal(newAsset)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(newAsset.ID, assetJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = updateIndexHelper(stub, oldAsset, &newAsset)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offerKey, err := stub.CreateCompositeKey(OfferObjectType, []string{newAsset.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(offerKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitEvents(stub, newAssetEvent(stub, EventAssetPurchased, newAsset.ID, newAsset.Type, assetBytes, assetJSONasBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(assetJSONasBytes)
+}
+
+// getOffer - the offer of an asset, nil if the asset is not for sale
+func getOffer(stub shim.ChaincodeStubInterface, id string) (*Offer, error) {
+	offerKey, err := stub.CreateCompositeKey(OfferObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	offerBytes, err := stub.GetState(offerKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get offer for %s: %s", id, err.Error())
+	} else if offerBytes == nil {
+		return nil, nil
+	}
+	offer := &Offer{}
+	err = json.Unmarshal(offerBytes, offer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal offer for %s: %s", id, err.Error())
+	}
+	return offer, nil
+}
+
+// callerAccount - the example02 account of the caller, the common name of its certificate
+func callerAccount(stub shim.ChaincodeStubInterface) (string, error) {
+	id, err := identity.New(stub)
+	if err != nil {
+		return "", errors.New("The caller must be identified: " + err.Error())
+	} else if id.CommonName == "" {
+		return "", errors.New("The caller has no account, its identity has no common name")
+	}
+	return id.CommonName, nil
+}
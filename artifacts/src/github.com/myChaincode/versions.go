@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Response statuses of versioned calls, both follow HTTP so a REST layer can pass them on.
+// Fabric endorses statuses below shim.ERRORTHRESHOLD, a conflict fails the transaction.
+const (
+	// StatusNotModified answers a conditional getAsset whose ETag still matches
+	StatusNotModified = 304
+	// StatusConflict answers an update or delete whose expected version is stale
+	StatusConflict = 409
+)
+
+// VersionConflict is the error of a write with a stale expected version
+type VersionConflict struct {
+	ID       string `json:"id"`
+	Expected int    `json:"expected"`
+	Version  int    `json:"version"`
+}
+
+func (c *VersionConflict) Error() string {
+	return fmt.Sprintf("Version conflict on asset %s: expected version %d, current version %d", c.ID, c.Expected, c.Version)
+}
+
+// parseExpectedVersion - an empty argument is 0 and skips the version check
+func parseExpectedVersion(arg string, position string) (int, error) {
+	if len(arg) <= 0 {
+		return 0, nil
+	}
+	expected, err := strconv.Atoi(arg)
+	if err != nil || expected <= 0 {
+		return 0, fmt.Errorf("%s argument must be a positive version number", position)
+	}
+	return expected, nil
+}
+
+// checkVersion - a *VersionConflict unless expected is 0 or the version of the asset
+func checkVersion(demoAsset *DemoAsset, expected int) error {
+	if expected != 0 && expected != demoAsset.Version {
+		return &VersionConflict{ID: demoAsset.ID, Expected: expected, Version: demoAsset.Version}
+	}
+	return nil
+}
+
+// versionError - StatusConflict with the conflict as JSON message, otherwise shim.Error
+func versionError(err error) peer.Response {
+	conflict, ok := err.(*VersionConflict)
+	if !ok {
+		return shim.Error(err.Error())
+	}
+	conflictJSONasBytes, err := json.Marshal(map[string]interface{}{"Error": conflict.Error(), "conflict": conflict})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return peer.Response{Status: StatusConflict, Message: string(conflictJSONasBytes)}
+}
+
+// assetETag - the strong entity tag of a stored asset, it changes with every write,
+// unlike the version it also tells an asset deleted and created again apart
+func assetETag(assetBytes []byte) string {
+	return strconv.Quote(digest(assetBytes))
+}
+
+// conditionalResponse - the asset with its ETag as message, StatusNotModified without
+// payload when ifNoneMatch is the ETag or "*"
+func conditionalResponse(assetBytes []byte, ifNoneMatch string) peer.Response {
+	etag := assetETag(assetBytes)
+	if ifNoneMatch == etag || ifNoneMatch == "*" {
+		return peer.Response{Status: StatusNotModified, Message: etag}
+	}
+	return peer.Response{Status: shim.OK, Message: etag, Payload: assetBytes}
+}
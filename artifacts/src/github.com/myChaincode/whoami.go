@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/myChaincode/identity"
+)
+
+// WhoAmI is the response of whoami, the decoded identity with the fields derived from it
+type WhoAmI struct {
+	*identity.Identity
+	// ID is cid.GetID, unique within the MSP, it is empty for an idemix identity
+	ID string `json:"id,omitempty"`
+	// Role is client, peer, orderer or admin from the NodeOUs, empty without NodeOUs
+	Role string `json:"role"`
+	// Expired is true when the certificate is not valid at the transaction timestamp
+	Expired bool `json:"expired"`
+}
+
+// ===============================================
+// whoami - describe the caller: MSP ID, client ID, DNs, role, OUs, attributes and expiry
+// curl --request POST \
+//   --url http://localhost:3100/bcsgw/rest/v1/transaction/query \
+//   --header 'content-type: application/json' \
+//   --data '{"channel":"samchannel","chaincode":"myChaincode","method":"whoami","args":[],"chaincodeVer":"v1.8"}'
+// ===============================================
+func (t *MyChaincode) whoami(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	id, err := identity.New(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	whoami := WhoAmI{Identity: id, Role: id.Role()}
+	if id.Certificate != nil {
+		whoami.ID, err = cid.GetID(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		whoami.Expired = !id.ValidAt(time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)))
+	}
+
+	whoamiJSONasBytes, err := json.Marshal(whoami)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(whoamiJSONasBytes)
+}